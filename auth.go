@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// principalKey is the key of the authenticated principal in the echo
+// context.
+const principalKey = "bunker.principal"
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// AuthConfig is the structure of the file given via -auth.
+type AuthConfig struct {
+	Tokens []TokenConfig `json:"tokens"`
+	Users  []UserConfig  `json:"users"`
+}
+
+// TokenConfig is a static token, sent as "Authorization: Bearer ...".
+type TokenConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	AuthScope
+}
+
+// UserConfig is a user for HTTP basic auth, e.g. fluent-bit's
+// http_User and http_Passwd.
+type UserConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	AuthScope
+}
+
+// AuthScope limits what a client may write. Empty lists allow
+// everything, otherwise the namespace and tag of every record must
+// match one of the glob patterns. Clients with Read can also query
+// the stored records of their namespaces.
+type AuthScope struct {
+	Namespaces []string `json:"namespaces"`
+	Tags       []string `json:"tags"`
+	Read       bool     `json:"read"`
+}
+
+func (s AuthScope) validate() error {
+	for _, pattern := range append(append([]string{}, s.Namespaces...), s.Tags...) {
+		if pattern == "" {
+			return errors.New("patterns must not be empty")
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// principal is an authenticated client.
+type principal struct {
+	name  string
+	scope AuthScope
+}
+
+// Allows returns an error if the record is outside of the scope of
+// the principal.
+func (p *principal) Allows(record *Record, tag string) error {
+	if !matchAnyGlob(p.scope.Namespaces, record.Kubernetes.NamespaceName) {
+		return &scopeError{
+			principal: p.name,
+			field:     "namespace",
+			value:     record.Kubernetes.NamespaceName,
+		}
+	}
+
+	if !matchAnyGlob(p.scope.Tags, tag) {
+		return &scopeError{
+			principal: p.name,
+			field:     "tag",
+			value:     tag,
+		}
+	}
+
+	return nil
+}
+
+// matchAnyGlob returns true if there are no patterns or one of them
+// matches the value.
+func matchAnyGlob(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matchGlob(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scopeError is returned when a client tries to write records it is
+// not allowed to, or to read records without the read scope.
+type scopeError struct {
+	principal string
+	field     string
+	value     string
+}
+
+func (e *scopeError) Error() string {
+	if e.field == "" {
+		return fmt.Sprintf("%s is not allowed to read records", e.principal)
+	}
+
+	return fmt.Sprintf("%s is not allowed to write records with %s %q", e.principal, e.field, e.value)
+}
+
+// authMethod authenticates requests using one kind of credentials.
+type authMethod interface {
+	// Authenticate returns the principal of the request, nil if the
+	// request carries no credentials of this kind or an error if the
+	// credentials are invalid.
+	Authenticate(req *http.Request) (*principal, error)
+
+	// Challenge returns the WWW-Authenticate header value.
+	Challenge() string
+}
+
+// secretHash is used to compare secrets in constant time, regardless
+// of their length.
+func secretHash(secret string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(secret))
+}
+
+func secretEqual(hash [sha256.Size]byte, secret string) bool {
+	given := secretHash(secret)
+	return subtle.ConstantTimeCompare(hash[:], given[:]) == 1
+}
+
+type bearerToken struct {
+	hash      [sha256.Size]byte
+	principal *principal
+}
+
+type bearerAuth struct {
+	tokens []bearerToken
+}
+
+func (a *bearerAuth) Authenticate(req *http.Request) (*principal, error) {
+	header := req.Header.Get(echo.HeaderAuthorization)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return nil, nil
+	}
+
+	token := strings.TrimSpace(header[7:])
+
+	// check all tokens, so that the time does not depend on the match
+	var matched *principal
+	for _, t := range a.tokens {
+		if secretEqual(t.hash, token) && matched == nil {
+			matched = t.principal
+		}
+	}
+
+	if matched == nil {
+		return nil, errInvalidCredentials
+	}
+
+	return matched, nil
+}
+
+func (a *bearerAuth) Challenge() string {
+	return `Bearer realm="bunker"`
+}
+
+type basicUser struct {
+	passwordHash [sha256.Size]byte
+	principal    *principal
+}
+
+type basicAuth struct {
+	users map[string]basicUser
+}
+
+func (a *basicAuth) Authenticate(req *http.Request) (*principal, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	user, exists := a.users[username]
+	if !exists || !secretEqual(user.passwordHash, password) {
+		return nil, errInvalidCredentials
+	}
+
+	return user.principal, nil
+}
+
+func (a *basicAuth) Challenge() string {
+	return `Basic realm="bunker"`
+}
+
+// auth checks the credentials of ingest and query requests. Without
+// any tokens or users, all requests are allowed.
+type auth struct {
+	lock    sync.RWMutex
+	methods []authMethod
+}
+
+func NewAuth(config *Config) (*auth, error) {
+	methods, err := loadAuthMethods(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth{
+		methods: methods,
+	}, nil
+}
+
+// loadAuthMethods reads and validates the credentials.
+func loadAuthMethods(config *Config) ([]authMethod, error) {
+	authConfig := AuthConfig{}
+
+	if config.Auth != "" {
+		content, err := readConfigFile(config.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials: %w", err)
+		}
+
+		if err := decodeStrict(content, &authConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse credentials: %w", err)
+		}
+	} else if config.InlineAuth != nil {
+		authConfig = *config.InlineAuth
+	}
+
+	methods := make([]authMethod, 0)
+
+	if len(authConfig.Tokens) > 0 {
+		bearer := &bearerAuth{}
+		seen := make(map[string]struct{})
+
+		for i, token := range authConfig.Tokens {
+			if token.Name == "" {
+				token.Name = fmt.Sprintf("token-%d", i)
+			}
+
+			if token.Token == "" {
+				return nil, fmt.Errorf("token %q must not be empty", token.Name)
+			}
+
+			if _, exists := seen[token.Token]; exists {
+				return nil, fmt.Errorf("token %q is not unique", token.Name)
+			}
+			seen[token.Token] = struct{}{}
+
+			if err := token.AuthScope.validate(); err != nil {
+				return nil, fmt.Errorf("invalid scope for token %q: %w", token.Name, err)
+			}
+
+			bearer.tokens = append(bearer.tokens, bearerToken{
+				hash: secretHash(token.Token),
+				principal: &principal{
+					name:  token.Name,
+					scope: token.AuthScope,
+				},
+			})
+		}
+
+		methods = append(methods, bearer)
+	}
+
+	if len(authConfig.Users) > 0 {
+		basic := &basicAuth{
+			users: make(map[string]basicUser),
+		}
+
+		for _, user := range authConfig.Users {
+			if user.Username == "" || user.Password == "" {
+				return nil, errors.New("users must have a username and a password")
+			}
+
+			if _, exists := basic.users[user.Username]; exists {
+				return nil, fmt.Errorf("duplicate user %q", user.Username)
+			}
+
+			if err := user.AuthScope.validate(); err != nil {
+				return nil, fmt.Errorf("invalid scope for user %q: %w", user.Username, err)
+			}
+
+			basic.users[user.Username] = basicUser{
+				passwordHash: secretHash(user.Password),
+				principal: &principal{
+					name:  user.Username,
+					scope: user.AuthScope,
+				},
+			}
+		}
+
+		methods = append(methods, basic)
+	}
+
+	return methods, nil
+}
+
+// SetMethods replaces the credentials after a reload.
+func (a *auth) SetMethods(methods []authMethod) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.methods = methods
+}
+
+// Middleware rejects requests without valid credentials and stores
+// the principal in the context, so that the handlers can check the
+// scope of the records.
+func (a *auth) Middleware(handler echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		a.lock.RLock()
+		methods := a.methods
+		a.lock.RUnlock()
+
+		if len(methods) == 0 {
+			return handler(c)
+		}
+
+		for _, method := range methods {
+			p, err := method.Authenticate(c.Request())
+			if err != nil {
+				return rejectRequest(c, methods, "invalid_credentials")
+			}
+
+			if p != nil {
+				c.Set(principalKey, p)
+				return handler(c)
+			}
+		}
+
+		// credentials of an unsupported kind are not just missing
+		if c.Request().Header.Get(echo.HeaderAuthorization) != "" {
+			return rejectRequest(c, methods, "invalid_credentials")
+		}
+
+		return rejectRequest(c, methods, "missing_credentials")
+	}
+}
+
+func rejectRequest(c echo.Context, methods []authMethod, reason string) error {
+	authRejectedRequests.WithLabelValues(reason).Inc()
+
+	for _, method := range methods {
+		c.Response().Header().Add(echo.HeaderWWWAuthenticate, method.Challenge())
+	}
+
+	return c.String(http.StatusUnauthorized, "Missing or invalid credentials.")
+}
+
+// authorizePayload makes sure that the authenticated client is allowed
+// to write all records of the payload.
+func authorizePayload(c echo.Context, payload Payload) error {
+	p, ok := c.Get(principalKey).(*principal)
+	if !ok {
+		return nil
+	}
+
+	for _, record := range payload.Records {
+		if err := p.Allows(record, payload.Tag); err != nil {
+			authRejectedRequests.WithLabelValues("forbidden").Inc()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeQuery makes sure that the authenticated client is allowed to
+// read records and limits the query to the client's namespaces.
+func authorizeQuery(c echo.Context, query *recordQuery) error {
+	p, ok := c.Get(principalKey).(*principal)
+	if !ok {
+		return nil
+	}
+
+	if !p.scope.Read {
+		authRejectedRequests.WithLabelValues("forbidden").Inc()
+		return &scopeError{principal: p.name}
+	}
+
+	query.Namespaces = p.scope.Namespaces
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of a counter.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatalf("Failed to read metric: %v", err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
+func testAuthMethods(t *testing.T) []authMethod {
+	methods, err := loadAuthMethods(&Config{
+		InlineAuth: &AuthConfig{
+			Tokens: []TokenConfig{{Name: "promtail", Token: "s3cr3t"}},
+			Users:  []UserConfig{{Username: "fluent-bit", Password: "hunter2"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load credentials: %v", err)
+	}
+
+	return methods
+}
+
+// authTestRequest sends a request through the middleware and returns
+// the response, with the principal's name as the body.
+func authTestRequest(a *auth, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", nil)
+	if setup != nil {
+		setup(req)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	handler := a.Middleware(func(c echo.Context) error {
+		name := "anonymous"
+		if p, ok := c.Get(principalKey).(*principal); ok {
+			name = p.name
+		}
+
+		return c.String(http.StatusOK, name)
+	})
+
+	if err := handler(c); err != nil {
+		rec.Code = http.StatusInternalServerError
+	}
+
+	return rec
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	testcases := []struct {
+		name      string
+		setup     func(req *http.Request)
+		principal string
+		reason    string
+	}{
+		{
+			name:      "valid bearer token",
+			setup:     func(req *http.Request) { req.Header.Set("Authorization", "Bearer s3cr3t") },
+			principal: "promtail",
+		},
+		{
+			name:      "lowercase bearer scheme",
+			setup:     func(req *http.Request) { req.Header.Set("Authorization", "bearer  s3cr3t ") },
+			principal: "promtail",
+		},
+		{
+			name:   "invalid bearer token",
+			setup:  func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") },
+			reason: "invalid_credentials",
+		},
+		{
+			name:      "valid basic auth",
+			setup:     func(req *http.Request) { req.SetBasicAuth("fluent-bit", "hunter2") },
+			principal: "fluent-bit",
+		},
+		{
+			name:   "wrong password",
+			setup:  func(req *http.Request) { req.SetBasicAuth("fluent-bit", "hunter3") },
+			reason: "invalid_credentials",
+		},
+		{
+			name:   "unknown user",
+			setup:  func(req *http.Request) { req.SetBasicAuth("promtail", "s3cr3t") },
+			reason: "invalid_credentials",
+		},
+		{
+			name:   "unsupported scheme",
+			setup:  func(req *http.Request) { req.Header.Set("Authorization", `Digest username="fluent-bit"`) },
+			reason: "invalid_credentials",
+		},
+		{
+			name:   "missing credentials",
+			reason: "missing_credentials",
+		},
+	}
+
+	a := &auth{methods: testAuthMethods(t)}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			var rejected prometheus.Counter
+			before := 0.0
+
+			if testcase.reason != "" {
+				rejected = authRejectedRequests.WithLabelValues(testcase.reason)
+				before = counterValue(t, rejected)
+			}
+
+			rec := authTestRequest(a, testcase.setup)
+
+			if testcase.reason == "" {
+				if rec.Code != http.StatusOK || rec.Body.String() != testcase.principal {
+					t.Fatalf("Expected %s to be authenticated, got %d (%s).", testcase.principal, rec.Code, rec.Body.String())
+				}
+
+				if challenges := rec.Header().Values(echo.HeaderWWWAuthenticate); len(challenges) > 0 {
+					t.Errorf("Expected no challenges, got %v.", challenges)
+				}
+
+				return
+			}
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status %d, got %d.", http.StatusUnauthorized, rec.Code)
+			}
+
+			expected := []string{`Bearer realm="bunker"`, `Basic realm="bunker"`}
+			if challenges := rec.Header().Values(echo.HeaderWWWAuthenticate); !reflect.DeepEqual(challenges, expected) {
+				t.Errorf("Expected challenges %v, got %v.", expected, challenges)
+			}
+
+			if after := counterValue(t, rejected); after != before+1 {
+				t.Errorf("Expected %s counter to be incremented, got %v -> %v.", testcase.reason, before, after)
+			}
+		})
+	}
+}
+
+func TestAuthSetMethods(t *testing.T) {
+	a := &auth{}
+
+	if rec := authTestRequest(a, nil); rec.Code != http.StatusOK || rec.Body.String() != "anonymous" {
+		t.Fatalf("Expected requests to be allowed without credentials, got %d.", rec.Code)
+	}
+
+	a.SetMethods(testAuthMethods(t))
+
+	if rec := authTestRequest(a, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected requests to be rejected after a reload, got %d.", rec.Code)
+	}
+
+	basic := func(req *http.Request) { req.SetBasicAuth("fluent-bit", "hunter2") }
+	if rec := authTestRequest(a, basic); rec.Code != http.StatusOK {
+		t.Fatalf("Expected valid credentials to be accepted, got %d.", rec.Code)
+	}
+
+	a.SetMethods(nil)
+
+	if rec := authTestRequest(a, nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected requests to be allowed after removing all credentials, got %d.", rec.Code)
+	}
+}
+
+func TestLoadAuthMethodsValidation(t *testing.T) {
+	testcases := map[string]AuthConfig{
+		"empty token":      {Tokens: []TokenConfig{{Name: "a"}}},
+		"duplicate token":  {Tokens: []TokenConfig{{Name: "a", Token: "x"}, {Name: "b", Token: "x"}}},
+		"missing password": {Users: []UserConfig{{Username: "a"}}},
+		"duplicate user":   {Users: []UserConfig{{Username: "a", Password: "x"}, {Username: "a", Password: "y"}}},
+		"empty pattern":    {Tokens: []TokenConfig{{Name: "a", Token: "x", AuthScope: AuthScope{Namespaces: []string{""}}}}},
+		"invalid pattern":  {Users: []UserConfig{{Username: "a", Password: "x", AuthScope: AuthScope{Tags: []string{"[a"}}}}},
+	}
+
+	for name, authConfig := range testcases {
+		authConfig := authConfig
+
+		if _, err := loadAuthMethods(&Config{InlineAuth: &authConfig}); err == nil {
+			t.Errorf("Expected an error for %s, got nil.", name)
+		}
+	}
+}
+
+func TestPrincipalAllows(t *testing.T) {
+	p := &principal{
+		name: "fluent-bit",
+		scope: AuthScope{
+			Namespaces: []string{"app-*", "default"},
+			Tags:       []string{"kube.*"},
+		},
+	}
+
+	testcases := []struct {
+		namespace string
+		tag       string
+		field     string
+	}{
+		{namespace: "app-web", tag: "kube.var.log"},
+		{namespace: "default", tag: "kube.x"},
+		{namespace: "kube-system", tag: "kube.x", field: "namespace"},
+		{namespace: "", tag: "kube.x", field: "namespace"},
+		{namespace: "default", tag: "syslog", field: "tag"},
+		{namespace: "default", tag: "", field: "tag"},
+	}
+
+	for _, testcase := range testcases {
+		record, err := newRecord(map[string]interface{}{
+			"log":        "hello",
+			"kubernetes": map[string]string{"namespace_name": testcase.namespace},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create record: %v", err)
+		}
+
+		err = p.Allows(record, testcase.tag)
+
+		if testcase.field == "" {
+			if err != nil {
+				t.Errorf("Expected %s/%s to be allowed, got %v.", testcase.namespace, testcase.tag, err)
+			}
+
+			continue
+		}
+
+		if scopeErr, ok := err.(*scopeError); !ok || scopeErr.field != testcase.field {
+			t.Errorf("Expected %s/%s to be rejected because of the %s, got %v.", testcase.namespace, testcase.tag, testcase.field, err)
+		}
+	}
+
+	// without patterns, everything is allowed
+	unrestricted := &principal{name: "admin"}
+	record, _ := newRecord(map[string]interface{}{"log": "hello"})
+
+	if err := unrestricted.Allows(record, "anything"); err != nil {
+		t.Errorf("Expected unrestricted principal to be allowed, got %v.", err)
+	}
+}
+
+func TestAuthorizePayload(t *testing.T) {
+	allowed, _ := newRecord(map[string]interface{}{"kubernetes": map[string]string{"namespace_name": "app-web"}})
+	forbidden, _ := newRecord(map[string]interface{}{"kubernetes": map[string]string{"namespace_name": "kube-system"}})
+
+	payload := Payload{Tag: "kube.x", Records: []*Record{allowed, forbidden}}
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/ingest", nil), httptest.NewRecorder())
+
+	// unauthenticated requests are only possible without credentials
+	if err := authorizePayload(c, payload); err != nil {
+		t.Fatalf("Expected payload to be allowed without a principal, got %v.", err)
+	}
+
+	c.Set(principalKey, &principal{name: "team", scope: AuthScope{Namespaces: []string{"app-*"}}})
+
+	counter := authRejectedRequests.WithLabelValues("forbidden")
+	before := counterValue(t, counter)
+
+	if err := authorizePayload(c, payload); err == nil {
+		t.Fatal("Expected payload to be forbidden, got nil.")
+	}
+
+	if after := counterValue(t, counter); after != before+1 {
+		t.Errorf("Expected forbidden counter to be incremented, got %v -> %v.", before, after)
+	}
+
+	payload.Records = payload.Records[:1]
+
+	if err := authorizePayload(c, payload); err != nil {
+		t.Errorf("Expected payload to be allowed, got %v.", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// fsyncNever leaves it to the operating system to persist data.
+	fsyncNever = "never"
+
+	// fsyncBatch syncs the file after every flush.
+	fsyncBatch = "batch"
+
+	// fsyncInterval syncs the file once per flush interval.
+	fsyncInterval = "interval"
+)
+
+// FlushPolicy controls how long encoded records are buffered in
+// memory before they are written to the file.
+type FlushPolicy struct {
+	// Interval is the maximum time records are kept in the buffer.
+	Interval time.Duration
+
+	// Size is the buffer size in bytes, 0 disables buffering.
+	Size int
+
+	// Fsync is one of never, batch or interval.
+	Fsync string
+}
+
+func validateFlushPolicy(policy FlushPolicy) error {
+	if policy.Size < 0 {
+		return fmt.Errorf("flush size must not be negative")
+	}
+
+	if policy.Interval < 0 {
+		return fmt.Errorf("flush interval must not be negative")
+	}
+
+	switch policy.Fsync {
+	case fsyncNever, fsyncBatch:
+	case fsyncInterval:
+		if policy.Interval == 0 {
+			return fmt.Errorf("fsync policy %q requires a flush interval", fsyncInterval)
+		}
+	default:
+		return fmt.Errorf("invalid fsync policy %q, must be one of never, batch or interval", policy.Fsync)
+	}
+
+	return nil
+}
+
+// fileBuffer collects writes in memory and writes them to the file
+// once the buffer is full or Flush() is called.
+type fileBuffer struct {
+	file   *os.File
+	policy FlushPolicy
+	buffer bytes.Buffer
+}
+
+func newFileBuffer(file *os.File, policy FlushPolicy) *fileBuffer {
+	return &fileBuffer{
+		file:   file,
+		policy: policy,
+	}
+}
+
+func (b *fileBuffer) Write(data []byte) (int, error) {
+	// without buffering, every write is a batch of its own
+	if b.policy.Size == 0 {
+		n, err := b.file.Write(data)
+		if err == nil && b.policy.Fsync == fsyncBatch {
+			err = b.sync()
+		}
+
+		return n, err
+	}
+
+	b.buffer.Write(data)
+
+	if b.buffer.Len() >= b.policy.Size {
+		if err := b.Flush(); err != nil {
+			return len(data), err
+		}
+	}
+
+	return len(data), nil
+}
+
+// Buffered returns the number of bytes not yet written to the file.
+func (b *fileBuffer) Buffered() int {
+	return b.buffer.Len()
+}
+
+// Flush writes the buffered data to the file. If that fails, the
+// buffer is discarded, so that a full disk does not make it grow
+// indefinitely.
+func (b *fileBuffer) Flush() error {
+	if b.buffer.Len() == 0 {
+		return nil
+	}
+
+	_, err := b.file.Write(b.buffer.Bytes())
+	b.buffer.Reset()
+
+	flushes.Inc()
+
+	if err != nil {
+		return err
+	}
+
+	if b.policy.Fsync == fsyncBatch {
+		return b.sync()
+	}
+
+	return nil
+}
+
+// FlushInterval is called once per flush interval.
+func (b *fileBuffer) FlushInterval() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+
+	if b.policy.Fsync == fsyncInterval {
+		return b.sync()
+	}
+
+	return nil
+}
+
+// Close flushes the buffer and, unless fsync is disabled, syncs the
+// file. It does not close the file.
+func (b *fileBuffer) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+
+	if b.policy.Fsync != fsyncNever {
+		return b.sync()
+	}
+
+	return nil
+}
+
+func (b *fileBuffer) sync() error {
+	start := time.Now()
+	err := b.file.Sync()
+	fsyncDuration.Observe(time.Since(start).Seconds())
+
+	return err
+}
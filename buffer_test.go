@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func BenchmarkWriterFlushPolicy(b *testing.B) {
+	policies := []FlushPolicy{
+		{Size: 0, Fsync: fsyncNever},
+		{Size: 4096, Fsync: fsyncNever},
+		{Size: 65536, Fsync: fsyncNever},
+		{Size: 65536, Interval: time.Second, Fsync: fsyncInterval},
+	}
+
+	for _, policy := range policies {
+		b.Run(fmt.Sprintf("size=%d/fsync=%s", policy.Size, policy.Fsync), func(b *testing.B) {
+			options := WriterOptions{
+				Format:          formatJSON,
+				Compression:     compressionNone,
+				CompressionMode: compressionModeStream,
+				Flush:           policy,
+			}
+
+			w, err := NewWriter(filepath.Join(b.TempDir(), "records.json"), options, nil, nil)
+			if err != nil {
+				b.Fatalf("Failed to create writer: %v", err)
+			}
+
+			record := testRecord(b, "default", "GET /healthz HTTP/1.1 200 OK")
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := w.Write(record, nil); err != nil {
+					b.Fatalf("Failed to write record: %v", err)
+				}
+			}
+
+			if err := w.Close(); err != nil {
+				b.Fatalf("Failed to close writer: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	// compressionModeStream compresses records while they are written.
+	compressionModeStream = "stream"
+
+	// compressionModeDeferred writes plain files and compresses them
+	// once they are rotated or their writer expires.
+	compressionModeDeferred = "deferred"
+
+	// archiveSuffix marks files that are currently being compressed.
+	archiveSuffix = ".compressing"
+)
+
+func validateCompression(compression string, mode string) error {
+	switch compression {
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		return fmt.Errorf("invalid compression %q, must be one of none, gzip or zstd", compression)
+	}
+
+	switch mode {
+	case compressionModeStream, compressionModeDeferred:
+	default:
+		return fmt.Errorf("invalid compression mode %q, must be one of stream or deferred", mode)
+	}
+
+	return nil
+}
+
+func compressionExtension(compression string) string {
+	switch compression {
+	case compressionGzip:
+		return ".gz"
+	case compressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// compressionByFilename returns the compression of a file based on its
+// extension and the filename without the compression extension.
+func compressionByFilename(filename string) (string, string) {
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		ext := compressionExtension(compression)
+
+		if strings.HasSuffix(filename, ext) {
+			return compression, strings.TrimSuffix(filename, ext)
+		}
+	}
+
+	return compressionNone, filename
+}
+
+// newCompressor wraps the given writer. Each compressor produces a
+// complete gzip member or zstd frame once closed, so that appending
+// to an existing file results in a valid concatenated stream.
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+
+	case compressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// newDecompressor returns a reader that transparently handles
+// concatenated gzip members or zstd frames.
+func newDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionGzip:
+		return gzip.NewReader(r)
+
+	case compressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return zstdReadCloser{decoder}, nil
+
+	case compressionNone:
+		return nopReadCloser{r}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error {
+	return nil
+}
+
+// openFile opens a file for reading and decompresses it based on
+// its file extension.
+func openFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, _ := compressionByFilename(filename)
+
+	reader, err := newDecompressor(f, compression)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", filename, err)
+	}
+
+	return &fileReader{
+		ReadCloser: reader,
+		file:       f,
+	}, nil
+}
+
+type fileReader struct {
+	io.ReadCloser
+
+	file *os.File
+}
+
+func (r *fileReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
+
+// archiver compresses plain files in the background, used for the
+// deferred compression mode.
+type archiver struct {
+	logger logrus.FieldLogger
+	files  chan archiveJob
+	alive  chan struct{}
+
+	// jobs are the pending files that have been queued, closed once
+	// they have been handled.
+	lock sync.Mutex
+	jobs map[string]chan struct{}
+}
+
+// archiveJob is a file waiting to be compressed. Routes can use
+// different compressions, so each file carries its own.
+type archiveJob struct {
+	pending     string
+	compression string
+}
+
+func newArchiver(logger logrus.FieldLogger) *archiver {
+	return &archiver{
+		logger: logger,
+		files:  make(chan archiveJob, 1000),
+		alive:  make(chan struct{}),
+		jobs:   make(map[string]chan struct{}),
+	}
+}
+
+// Run is meant to run as a separate goroutine and compresses
+// queued files until Close() is called.
+func (a *archiver) Run() {
+	defer close(a.alive)
+
+	for job := range a.files {
+		if err := a.archive(job); err != nil {
+			a.logger.Errorf("Failed to compress %s: %v", job.pending, err)
+		}
+
+		a.lock.Lock()
+		close(a.jobs[job.pending])
+		delete(a.jobs, job.pending)
+		a.lock.Unlock()
+	}
+}
+
+// Add queues a plain file for compression. The file is renamed right
+// away, so that a new writer for the same path can safely create a
+// new file while the old one is still being compressed. If the same
+// file is still waiting to be compressed from a previous writer, Add
+// waits for that to finish first.
+func (a *archiver) Add(filename string, compression string) {
+	pending := filename + archiveSuffix
+
+	a.Wait(filename)
+
+	// a previous job failed and left its file behind, which must not be
+	// overwritten; the plain file is compressed after the next restart
+	if _, err := os.Stat(pending); err == nil {
+		a.logger.Errorf("Not compressing %s, as %s still exists.", filename, pending)
+		return
+	}
+
+	if err := os.Rename(filename, pending); err != nil {
+		a.logger.Errorf("Failed to prepare %s for compression: %v", filename, err)
+		return
+	}
+
+	a.queue(archiveJob{pending, compression})
+}
+
+// Wait blocks until the given plain file is not waiting to be compressed
+// anymore.
+func (a *archiver) Wait(filename string) {
+	a.lock.Lock()
+	done, queued := a.jobs[filename+archiveSuffix]
+	a.lock.Unlock()
+
+	if queued {
+		<-done
+	}
+}
+
+// queue hands the job to the archiver goroutine, unless the same file
+// has already been queued.
+func (a *archiver) queue(job archiveJob) {
+	a.lock.Lock()
+	if _, queued := a.jobs[job.pending]; queued {
+		a.lock.Unlock()
+		return
+	}
+	a.jobs[job.pending] = make(chan struct{})
+	a.lock.Unlock()
+
+	a.files <- job
+}
+
+// Resume queues a file that was renamed for compression, but never
+// finished, for example because the process crashed.
+func (a *archiver) Resume(pending string, compression string) {
+	// the target must not be repaired while it is being appended to
+	a.lock.Lock()
+	_, queued := a.jobs[pending]
+	a.lock.Unlock()
+
+	if queued {
+		return
+	}
+
+	target := strings.TrimSuffix(pending, archiveSuffix) + compressionExtension(compression)
+
+	if err := repairStream(target, compression); err != nil {
+		a.logger.Errorf("Failed to repair %s: %v", target, err)
+	}
+
+	a.queue(archiveJob{pending, compression})
+}
+
+// Close waits for all queued files to be compressed.
+func (a *archiver) Close() {
+	close(a.files)
+	<-a.alive
+}
+
+func (a *archiver) archive(job archiveJob) error {
+	pending := job.pending
+	plain := strings.TrimSuffix(pending, archiveSuffix)
+	target := plain + compressionExtension(job.compression)
+
+	a.logger.Debugf("Compressing %s into %s ...", plain, target)
+
+	src, err := os.Open(pending)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for appending: %w", target, err)
+	}
+	defer dst.Close()
+
+	compressor, err := newCompressor(dst, job.compression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(compressor, src); err != nil {
+		compressor.Close()
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(pending)
+}
+
+const (
+	zstdFrameMagic     = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50
+)
+
+// repairStream truncates a compressed file after its last complete
+// gzip member or zstd frame. Incomplete members are left behind if the
+// process is not shut down cleanly and would make the whole file
+// unreadable once new members are appended.
+func repairStream(filename string, compression string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	reader := &countingReader{reader: bufio.NewReader(f)}
+
+	var valid int64
+
+	switch compression {
+	case compressionGzip:
+		valid = gzipStreamLength(reader)
+
+	case compressionZstd:
+		valid = zstdStreamLength(reader)
+
+	default:
+		return nil
+	}
+
+	// do not mistake read errors for damaged data
+	if reader.err != nil {
+		return reader.err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if valid == info.Size() {
+		return nil
+	}
+
+	return f.Truncate(valid)
+}
+
+// gzipStreamLength returns the length of all complete members.
+func gzipStreamLength(r *countingReader) int64 {
+	valid := int64(0)
+	decompressor := new(gzip.Reader)
+
+	for {
+		if err := decompressor.Reset(r); err != nil {
+			return valid
+		}
+
+		decompressor.Multistream(false)
+
+		if _, err := io.Copy(ioutil.Discard, decompressor); err != nil {
+			return valid
+		}
+
+		valid = r.n
+	}
+}
+
+// zstdStreamLength returns the length of all complete frames. Only the
+// frame structure is checked, not the compressed data.
+func zstdStreamLength(r *countingReader) int64 {
+	valid := int64(0)
+	buf := make([]byte, 4)
+
+	skip := func(n int64) bool {
+		_, err := io.CopyN(ioutil.Discard, r, n)
+		return err == nil
+	}
+
+	for {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return valid
+		}
+
+		magic := binary.LittleEndian.Uint32(buf)
+
+		switch {
+		case magic == zstdFrameMagic:
+			descriptor, err := r.ReadByte()
+			if err != nil {
+				return valid
+			}
+
+			header := int64([]int{0, 1, 2, 4}[descriptor&0x03]) // dictionary ID
+			singleSegment := descriptor&0x20 != 0
+
+			if !singleSegment {
+				header++ // window descriptor
+			}
+
+			switch fcs := descriptor >> 6; {
+			case fcs == 0 && singleSegment:
+				header++
+			case fcs > 0:
+				header += 1 << fcs
+			}
+
+			if !skip(header) {
+				return valid
+			}
+
+			for last := false; !last; {
+				if _, err := io.ReadFull(r, buf[:3]); err != nil {
+					return valid
+				}
+
+				blockHeader := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
+				last = blockHeader&0x01 != 0
+				size := int64(blockHeader >> 3)
+
+				switch (blockHeader >> 1) & 0x03 {
+				case 1: // RLE block
+					size = 1
+				case 3: // reserved
+					return valid
+				}
+
+				if !skip(size) {
+					return valid
+				}
+			}
+
+			if descriptor&0x04 != 0 && !skip(4) { // checksum
+				return valid
+			}
+
+		case magic&0xFFFFFFF0 == zstdSkippableMagic:
+			if _, err := io.ReadFull(r, buf[:4]); err != nil {
+				return valid
+			}
+
+			if !skip(int64(binary.LittleEndian.Uint32(buf))) {
+				return valid
+			}
+
+		default:
+			return valid
+		}
+
+		valid = r.n
+	}
+}
+
+// countingReader counts the bytes consumed from the underlying reader
+// and remembers read errors other than EOF.
+type countingReader struct {
+	reader *bufio.Reader
+	n      int64
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	r.remember(err)
+
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	r.remember(err)
+
+	return b, err
+}
+
+func (r *countingReader) remember(err error) {
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+}
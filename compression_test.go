@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiverKeepsPendingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "records.json")
+
+	if err := ioutil.WriteFile(filename, []byte("first\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	a := newArchiver(testLogger())
+
+	// the first file is not compressed yet, as the archiver is not running
+	a.Add(filename, compressionGzip)
+
+	// a new writer for the same path closes its file
+	if err := ioutil.WriteFile(filename, []byte("second\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	added := make(chan struct{})
+	go func() {
+		a.Add(filename, compressionGzip)
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("Expected Add to wait for the pending file to be compressed.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go a.Run()
+	<-added
+	a.Close()
+
+	f, err := openFile(filename + ".gz")
+	if err != nil {
+		t.Fatalf("Failed to open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Failed to read compressed file: %v", err)
+	}
+
+	if expected := "first\nsecond\n"; string(content) != expected {
+		t.Fatalf("Expected %q, got %q.", expected, string(content))
+	}
+
+	if _, err := os.Stat(filename + archiveSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected pending file to be removed, got %v.", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration file is a JSON (or YAML) object using the names of
+// the command line flags as keys, e.g.
+//
+//	{
+//	  "target": "/data/records",
+//	  "rotate-age": "1h",
+//	  "columns": ["date", "log"],
+//	  "filter-rules": {"rules": [{"namespace": "kube-*", "action": "exclude"}]}
+//	}
+//
+// Flags given on the command line take precedence over the file.
+
+// loadConfig parses the command line and the configuration file given
+// via -config. The returned flag set allows to compare configurations.
+func loadConfig(args []string, errorHandling flag.ErrorHandling) (*Config, *flag.FlagSet, error) {
+	config := &Config{}
+
+	flags := flag.NewFlagSet(os.Args[0], errorHandling)
+	defineFlags(flags, config)
+
+	if errorHandling != flag.ExitOnError {
+		flags.SetOutput(ioutil.Discard)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if config.ConfigFile == "" {
+		return config, flags, nil
+	}
+
+	if err := applyConfigFile(flags, config); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration file %s: %w", config.ConfigFile, err)
+	}
+
+	return config, flags, nil
+}
+
+func applyConfigFile(flags *flag.FlagSet, config *Config) error {
+	content, err := readConfigFile(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return err
+	}
+
+	// settings from the command line are not overwritten
+	explicit := make(map[string]struct{})
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = struct{}{}
+	})
+
+	for name, raw := range settings {
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+
+		if _, ok := explicit[name]; ok {
+			continue
+		}
+
+		if err := applySetting(flags, config, name, raw); err != nil {
+			return fmt.Errorf("invalid value for %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func applySetting(flags *flag.FlagSet, config *Config, name string, raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+
+	// filter rules, routes and credentials can be given inline instead
+	// of as a path
+	if len(raw) > 0 && raw[0] == '{' {
+		switch name {
+		case "filter-rules":
+			config.InlineFilterRules = &FilterRules{}
+			return decodeStrict(raw, config.InlineFilterRules)
+
+		case "routes":
+			config.InlineRoutes = &Routes{}
+			return decodeStrict(raw, config.InlineRoutes)
+
+		case "auth":
+			config.InlineAuth = &AuthConfig{}
+			return decodeStrict(raw, config.InlineAuth)
+
+		default:
+			return fmt.Errorf("objects are not supported")
+		}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		return flags.Set(name, v)
+
+	case bool, float64:
+		// numbers are passed on as written, e.g. without an exponent
+		return flags.Set(name, string(raw))
+
+	case []interface{}:
+		items := make([]string, len(v))
+
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("lists must only contain strings")
+			}
+
+			items[i] = s
+		}
+
+		return flags.Set(name, strings.Join(items, ","))
+
+	default:
+		return fmt.Errorf("unsupported value %s", string(raw))
+	}
+}
+
+func decodeStrict(data []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(target)
+}
+
+// readConfigFile reads a JSON file or, if the filename ends in .yaml or
+// .yml, a YAML file. YAML is converted to JSON, so that both can be
+// decoded the same way, e.g. using decodeStrict.
+func readConfigFile(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		var value interface{}
+		if err := yaml.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+
+		value, err = yamlToJSON(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(value)
+
+	default:
+		return content, nil
+	}
+}
+
+// yamlToJSON converts the maps decoded by the YAML package, which can
+// have keys of any type, into maps with string keys.
+func yamlToJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("keys must be strings, got %v", key)
+			}
+
+			converted, err := yamlToJSON(item)
+			if err != nil {
+				return nil, err
+			}
+
+			m[name] = converted
+		}
+
+		return m, nil
+
+	case []interface{}:
+		items := make([]interface{}, len(v))
+
+		for i, item := range v {
+			converted, err := yamlToJSON(item)
+			if err != nil {
+				return nil, err
+			}
+
+			items[i] = converted
+		}
+
+		return items, nil
+
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFileFormats(t *testing.T) {
+	testcases := []struct {
+		filename string
+		content  string
+	}{
+		{
+			filename: "bunker.json",
+			content: `{
+				"target": "/data/records",
+				"rotate-age": "1h",
+				"flush-size": 1024,
+				"columns": ["date", "log"],
+				"filter-rules": {"rules": [{"name": "system", "namespace": "kube-*", "action": "exclude"}]}
+			}`,
+		},
+		{
+			filename: "bunker.yaml",
+			content: strings.Join([]string{
+				"target: /data/records",
+				"rotate-age: 1h",
+				"flush-size: 1024",
+				"columns: [date, log]",
+				"filter-rules:",
+				"  rules:",
+				"    - name: system",
+				"      namespace: kube-*",
+				"      action: exclude",
+			}, "\n"),
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.filename, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), testcase.filename)
+			if err := ioutil.WriteFile(filename, []byte(testcase.content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			config, _, err := loadConfig([]string{"-config", filename}, flag.ContinueOnError)
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+
+			if config.Target != "/data/records" {
+				t.Errorf("Expected target /data/records, got %q.", config.Target)
+			}
+
+			if config.Output.Rotation.MaxAge != time.Hour {
+				t.Errorf("Expected rotate-age 1h, got %v.", config.Output.Rotation.MaxAge)
+			}
+
+			if config.Output.Flush.Size != 1024 {
+				t.Errorf("Expected flush-size 1024, got %d.", config.Output.Flush.Size)
+			}
+
+			if expected := []string{"date", "log"}; !reflect.DeepEqual(config.Output.Columns, expected) {
+				t.Errorf("Expected columns %v, got %v.", expected, config.Output.Columns)
+			}
+
+			rules := config.InlineFilterRules
+			if rules == nil || len(rules.Rules) != 1 || rules.Rules[0].Namespace != "kube-*" {
+				t.Errorf("Expected one inline filter rule, got %+v.", rules)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileRejectsInvalidYAML(t *testing.T) {
+	testcases := map[string]string{
+		"unknown setting": "not-a-flag: true",
+		"non-string key":  "filter-rules:\n  1: foo",
+		"unknown field":   "filter-rules:\n  rules:\n    - nam: typo",
+		"syntax error":    "target: [",
+	}
+
+	for name, content := range testcases {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "bunker.yml")
+			if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			if _, _, err := loadConfig([]string{"-config", filename}, flag.ContinueOnError); err == nil {
+				t.Fatal("Expected an error, got nil.")
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	formatJSON    = "json"
+	formatRaw     = "raw"
+	formatLogfmt  = "logfmt"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+)
+
+// defaultCSVColumns are used if no columns are configured for CSV files.
+var defaultCSVColumns = []string{
+	"date",
+	"kubernetes.namespace_name",
+	"kubernetes.pod_name",
+	"kubernetes.container_name",
+	"log",
+}
+
+// recordEncoder converts records into lines of an output file.
+type recordEncoder interface {
+	// Header returns the data to write at the beginning of each file.
+	Header() []byte
+
+	// Encode appends the encoded record, including the trailing
+	// newline, to buf.
+	Encode(buf *bytes.Buffer, record *Record) error
+}
+
+func validateFormat(format string, columns []string) error {
+	// Parquet files are not line based and written by the parquetWriter.
+	if format == formatParquet {
+		if len(columns) > 0 {
+			return fmt.Errorf("the %s format does not support columns", formatParquet)
+		}
+
+		return nil
+	}
+
+	_, err := newRecordEncoder(format, columns)
+	return err
+}
+
+// newRecordEncoder returns the encoder for the given format. Columns
+// are paths to record fields, like "log" or "kubernetes.pod_name".
+func newRecordEncoder(format string, columns []string) (recordEncoder, error) {
+	for _, column := range columns {
+		if column == "" || strings.HasPrefix(column, ".") || strings.HasSuffix(column, ".") {
+			return nil, fmt.Errorf("invalid column %q", column)
+		}
+	}
+
+	switch format {
+	case formatJSON, "":
+		if len(columns) > 0 {
+			return nil, fmt.Errorf("the %s format does not support columns", formatJSON)
+		}
+
+		return jsonEncoder{}, nil
+
+	case formatRaw:
+		return rawEncoder{prefix: columns}, nil
+
+	case formatLogfmt:
+		return logfmtEncoder{columns: columns}, nil
+
+	case formatCSV:
+		if len(columns) == 0 {
+			columns = defaultCSVColumns
+		}
+
+		return csvEncoder{columns: columns}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// jsonEncoder writes the whole record as a single line of JSON.
+type jsonEncoder struct{}
+
+func (jsonEncoder) Header() []byte {
+	return nil
+}
+
+func (jsonEncoder) Encode(buf *bytes.Buffer, record *Record) error {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	return encoder.Encode(record)
+}
+
+// rawEncoder writes only the log line, optionally prefixed by the
+// values of some columns ("-" if empty). Multi-line logs are written
+// as-is.
+type rawEncoder struct {
+	prefix []string
+}
+
+func (rawEncoder) Header() []byte {
+	return nil
+}
+
+func (e rawEncoder) Encode(buf *bytes.Buffer, record *Record) error {
+	for _, column := range e.prefix {
+		value := columnValue(record, column)
+		if value == "" {
+			value = "-"
+		}
+
+		buf.WriteString(value)
+		buf.WriteByte(' ')
+	}
+
+	buf.WriteString(strings.TrimRight(record.Log, "\r\n"))
+	buf.WriteByte('\n')
+
+	return nil
+}
+
+// logfmtEncoder writes key=value pairs of the given columns, or of all
+// fields if no columns are configured. Nested objects are flattened.
+type logfmtEncoder struct {
+	columns []string
+}
+
+func (logfmtEncoder) Header() []byte {
+	return nil
+}
+
+func (e logfmtEncoder) Encode(buf *bytes.Buffer, record *Record) error {
+	pairs := make([][2]string, 0)
+
+	if len(e.columns) > 0 {
+		for _, column := range e.columns {
+			pairs = append(pairs, [2]string{column, columnValue(record, column)})
+		}
+	} else {
+		for _, name := range record.FieldNames() {
+			if name == "date" {
+				pairs = append(pairs, [2]string{name, columnValue(record, name)})
+				continue
+			}
+
+			raw, _ := record.Field(name)
+
+			flattened, err := flattenJSON(name, raw)
+			if err != nil {
+				return err
+			}
+
+			pairs = append(pairs, flattened...)
+		}
+	}
+
+	for i, pair := range pairs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(logfmtKey(pair[0]))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(pair[1]))
+	}
+
+	buf.WriteByte('\n')
+
+	return nil
+}
+
+// logfmtKey replaces characters that logfmt parsers do not accept in
+// keys, as keys cannot be quoted.
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f || r == utf8.RuneError {
+			return '_'
+		}
+
+		return r
+	}, key)
+}
+
+// logfmtValue quotes values if necessary.
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r > '~' {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
+
+// csvEncoder writes the given columns as comma-separated values, with
+// a header line at the beginning of each file.
+type csvEncoder struct {
+	columns []string
+}
+
+func (e csvEncoder) Header() []byte {
+	buf := bytes.Buffer{}
+
+	writer := csv.NewWriter(&buf)
+	writer.Write(e.columns)
+	writer.Flush()
+
+	return buf.Bytes()
+}
+
+func (e csvEncoder) Encode(buf *bytes.Buffer, record *Record) error {
+	values := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		values[i] = columnValue(record, column)
+	}
+
+	writer := csv.NewWriter(buf)
+	if err := writer.Write(values); err != nil {
+		return err
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// columnValue returns the value of the field at the given path, with
+// nested objects separated by dots. Strings are returned unquoted,
+// all other values as JSON.
+func columnValue(record *Record, column string) string {
+	// the date field can be any kind of timestamp
+	if column == "date" && !record.Date.IsZero() {
+		return record.Date.UTC().Format(time.RFC3339Nano)
+	}
+
+	names := strings.Split(column, ".")
+
+	raw, ok := record.Field(names[0])
+	if !ok {
+		return ""
+	}
+
+	for _, name := range names[1:] {
+		object := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return ""
+		}
+
+		raw, ok = object[name]
+		if !ok {
+			return ""
+		}
+	}
+
+	return jsonValueString(raw)
+}
+
+func jsonValueString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	if string(raw) == "null" {
+		return ""
+	}
+
+	compacted := bytes.Buffer{}
+	if err := json.Compact(&compacted, raw); err != nil {
+		return string(raw)
+	}
+
+	return compacted.String()
+}
+
+// flattenJSON returns key/value pairs for a JSON value, descending
+// into objects. Keys are sorted.
+func flattenJSON(prefix string, raw json.RawMessage) ([][2]string, error) {
+	object := map[string]json.RawMessage{}
+
+	if len(raw) == 0 || raw[0] != '{' {
+		return [][2]string{{prefix, jsonValueString(raw)}}, nil
+	}
+
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", prefix, err)
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([][2]string, 0, len(keys))
+
+	for _, key := range keys {
+		nested, err := flattenJSON(prefix+"."+key, object[key])
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, nested...)
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func encoderTestRecord(t *testing.T, data string) *Record {
+	record := &Record{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	return record
+}
+
+func encodeRecords(t *testing.T, encoder recordEncoder, records ...*Record) string {
+	buf := bytes.Buffer{}
+	buf.Write(encoder.Header())
+
+	for _, record := range records {
+		if err := encoder.Encode(&buf, record); err != nil {
+			t.Fatalf("Failed to encode record: %v", err)
+		}
+	}
+
+	return buf.String()
+}
+
+// parseLogfmt decodes a single logfmt line, as done by logfmt parsers:
+// keys are never quoted, values are quoted if they contain spaces,
+// quotes or other special characters.
+func parseLogfmt(line string) (map[string]string, error) {
+	pairs := make(map[string]string)
+
+	for line != "" {
+		eq := strings.IndexByte(line, '=')
+		if eq < 1 {
+			return nil, fmt.Errorf("missing key in %q", line)
+		}
+
+		key := line[:eq]
+		if strings.ContainsAny(key, " \"\\") {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+
+		line = line[eq+1:]
+
+		var value string
+
+		if strings.HasPrefix(line, `"`) {
+			end := 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated value for %q", key)
+			}
+
+			unquoted, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", key, err)
+			}
+
+			value = unquoted
+			line = line[end+1:]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+
+			value = line[:end]
+			line = line[end:]
+		}
+
+		if _, exists := pairs[key]; exists {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+
+		pairs[key] = value
+		line = strings.TrimPrefix(line, " ")
+	}
+
+	return pairs, nil
+}
+
+func TestLogfmtEncoderRoundTrip(t *testing.T) {
+	record := encoderTestRecord(t, `{
+		"date": "2020-01-01T12:00:00Z",
+		"log": "hello \"world\"\nsecond line",
+		"level": "info",
+		"count": 3,
+		"ok": true,
+		"empty": "",
+		"path": "C:\\temp",
+		"kubernetes": {"namespace_name": "default", "labels": {"app name": "web", "a=b": "c"}},
+		"weird key\"": "ünïcode",
+		"tab\tkey": "x=y"
+	}`)
+
+	testcases := []struct {
+		name     string
+		columns  []string
+		expected map[string]string
+	}{
+		{
+			name: "all fields",
+			expected: map[string]string{
+				"date":                       "2020-01-01T12:00:00Z",
+				"log":                        "hello \"world\"\nsecond line",
+				"level":                      "info",
+				"count":                      "3",
+				"ok":                         "true",
+				"empty":                      "",
+				"path":                       `C:\temp`,
+				"kubernetes.namespace_name":  "default",
+				"kubernetes.labels.app_name": "web",
+				"kubernetes.labels.a_b":      "c",
+				"weird_key_":                 "ünïcode",
+				"tab_key":                    "x=y",
+			},
+		},
+		{
+			name:    "columns",
+			columns: []string{"level", "kubernetes.namespace_name", "missing"},
+			expected: map[string]string{
+				"level":                     "info",
+				"kubernetes.namespace_name": "default",
+				"missing":                   "",
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			encoder, err := newRecordEncoder(formatLogfmt, testcase.columns)
+			if err != nil {
+				t.Fatalf("Failed to create encoder: %v", err)
+			}
+
+			encoded := encodeRecords(t, encoder, record)
+			if strings.Count(encoded, "\n") != 1 || !strings.HasSuffix(encoded, "\n") {
+				t.Fatalf("Expected a single line, got %q.", encoded)
+			}
+
+			pairs, err := parseLogfmt(strings.TrimSuffix(encoded, "\n"))
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", encoded, err)
+			}
+
+			if !reflect.DeepEqual(pairs, testcase.expected) {
+				t.Errorf("Expected %v, got %v.", testcase.expected, pairs)
+			}
+		})
+	}
+}
+
+func TestLogfmtKey(t *testing.T) {
+	testcases := map[string]string{
+		"level":           "level",
+		"kubernetes.host": "kubernetes.host",
+		"app name":        "app_name",
+		"a=b":             "a_b",
+		`say "hi"`:        "say__hi_",
+		`back\slash`:      "back_slash",
+		"new\nline":       "new_line",
+		"\xff":            "_",
+		"":                "_",
+		"ünïcode":         "ünïcode",
+	}
+
+	for key, expected := range testcases {
+		if sanitised := logfmtKey(key); sanitised != expected {
+			t.Errorf("Expected %q to become %q, got %q.", key, expected, sanitised)
+		}
+	}
+}
+
+func TestRawEncoderRoundTrip(t *testing.T) {
+	records := []*Record{
+		encoderTestRecord(t, `{"date":"2020-01-01T12:00:00Z","log":"first line\n","kubernetes":{"pod_name":"web-1"}}`),
+		encoderTestRecord(t, `{"date":"2020-01-01T12:00:01Z","log":"multi\nline\r\n"}`),
+	}
+
+	encoder, err := newRecordEncoder(formatRaw, []string{"date", "kubernetes.pod_name"})
+	if err != nil {
+		t.Fatalf("Failed to create encoder: %v", err)
+	}
+
+	expected := "2020-01-01T12:00:00Z web-1 first line\n" +
+		"2020-01-01T12:00:01Z - multi\nline\n"
+
+	if encoded := encodeRecords(t, encoder, records...); encoded != expected {
+		t.Fatalf("Expected %q, got %q.", expected, encoded)
+	}
+
+	// without columns, the log lines are written unchanged
+	encoder, _ = newRecordEncoder(formatRaw, nil)
+
+	if encoded := encodeRecords(t, encoder, records...); encoded != "first line\nmulti\nline\n" {
+		t.Fatalf("Expected only the log lines, got %q.", encoded)
+	}
+}
+
+func TestCSVEncoderRoundTrip(t *testing.T) {
+	records := []*Record{
+		encoderTestRecord(t, `{"date":"2020-01-01T12:00:00Z","log":"a, \"quoted\"\nmulti-line value","kubernetes":{"namespace_name":"default","pod_name":"web-1"}}`),
+		encoderTestRecord(t, `{"date":"2020-01-01T12:00:01Z","log":"plain","count":3,"nested":{"a":[1,2]}}`),
+	}
+
+	testcases := []struct {
+		name     string
+		columns  []string
+		expected [][]string
+	}{
+		{
+			name: "default columns",
+			expected: [][]string{
+				defaultCSVColumns,
+				{"2020-01-01T12:00:00Z", "default", "web-1", "", "a, \"quoted\"\nmulti-line value"},
+				{"2020-01-01T12:00:01Z", "", "", "", "plain"},
+			},
+		},
+		{
+			name:    "custom columns",
+			columns: []string{"count", "nested", "nested.a"},
+			expected: [][]string{
+				{"count", "nested", "nested.a"},
+				{"", "", ""},
+				{"3", `{"a":[1,2]}`, "[1,2]"},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			encoder, err := newRecordEncoder(formatCSV, testcase.columns)
+			if err != nil {
+				t.Fatalf("Failed to create encoder: %v", err)
+			}
+
+			rows, err := csv.NewReader(strings.NewReader(encodeRecords(t, encoder, records...))).ReadAll()
+			if err != nil {
+				t.Fatalf("Failed to parse CSV: %v", err)
+			}
+
+			if !reflect.DeepEqual(rows, testcase.expected) {
+				t.Errorf("Expected %q, got %q.", testcase.expected, rows)
+			}
+		})
+	}
+}
@@ -1,15 +1,250 @@
 package main
 
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+const (
+	actionInclude = "include"
+	actionExclude = "exclude"
+)
+
+// FilterRules is the structure of the file given via -filter-rules.
+type FilterRules struct {
+	// Default is the action taken when no rule matches.
+	Default string       `json:"default"`
+	Rules   []FilterRule `json:"rules"`
+}
+
+// FilterRule matches records and decides whether they are included
+// or excluded.
+type FilterRule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+
+	RecordMatch
+}
+
+// RecordMatch are the conditions to match records on, used by filter
+// rules and routes. All non-empty conditions must match. Names and
+// values are glob patterns, Log is a regular expression.
+type RecordMatch struct {
+	Namespace   string            `json:"namespace"`
+	Pod         string            `json:"pod"`
+	Container   string            `json:"container"`
+	Host        string            `json:"host"`
+	Tag         string            `json:"tag"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Log         string            `json:"log"`
+}
+
+// fallthroughRuleName is the rule name used in metrics for records that
+// did not match any rule, so it cannot be used for actual rules.
+const fallthroughRuleName = "default"
+
+// defaultFilterRule is always evaluated first and allows pods to opt
+// out of having their logs stored.
+var defaultFilterRule = FilterRule{
+	Name:   "annotation",
+	Action: actionExclude,
+	RecordMatch: RecordMatch{
+		Annotations: map[string]string{
+			"xrstf.de/bunker": "ignore",
+		},
+	},
+}
+
 type filter struct {
-	config *Config
+	config        *Config
+	rules         []*filterRule
+	defaultAction string
+}
+
+type filterRule struct {
+	FilterRule
+
+	matcher *recordMatcher
+}
+
+type recordMatcher struct {
+	RecordMatch
+
+	log *regexp.Regexp
 }
 
 func NewFilter(config *Config) (*filter, error) {
-	return &filter{
-		config: config,
+	rules := FilterRules{}
+
+	if config.FilterRules != "" {
+		var err error
+
+		rules, err = loadFilterRules(config.FilterRules)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.InlineFilterRules != nil {
+		rules = *config.InlineFilterRules
+	}
+
+	return newFilter(config, rules)
+}
+
+func newFilter(config *Config, rules FilterRules) (*filter, error) {
+	f := &filter{
+		config:        config,
+		rules:         make([]*filterRule, 0),
+		defaultAction: rules.Default,
+	}
+
+	if f.defaultAction == "" {
+		f.defaultAction = actionInclude
+	}
+
+	if f.defaultAction != actionInclude && f.defaultAction != actionExclude {
+		return nil, fmt.Errorf("invalid default action %q", f.defaultAction)
+	}
+
+	names := make(map[string]struct{})
+
+	for i, rule := range append([]FilterRule{defaultFilterRule}, rules.Rules...) {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		if rule.Name == fallthroughRuleName {
+			return nil, fmt.Errorf("rule name %q is reserved for records not matching any rule", rule.Name)
+		}
+
+		if _, exists := names[rule.Name]; exists {
+			return nil, fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		compiled, err := compileFilterRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", rule.Name, err)
+		}
+
+		f.rules = append(f.rules, compiled)
+	}
+
+	return f, nil
+}
+
+func loadFilterRules(filename string) (FilterRules, error) {
+	rules := FilterRules{}
+
+	content, err := readConfigFile(filename)
+	if err != nil {
+		return rules, fmt.Errorf("failed to read filter rules: %w", err)
+	}
+
+	if err := decodeStrict(content, &rules); err != nil {
+		return rules, fmt.Errorf("failed to parse filter rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+func compileFilterRule(rule FilterRule) (*filterRule, error) {
+	if rule.Action != actionInclude && rule.Action != actionExclude {
+		return nil, fmt.Errorf("invalid action %q", rule.Action)
+	}
+
+	matcher, err := compileRecordMatch(rule.RecordMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterRule{
+		FilterRule: rule,
+		matcher:    matcher,
 	}, nil
 }
 
-func (f *filter) IncludeRecord(record *Record) bool {
-	return record.Kubernetes.Annotations["xrstf.de/bunker"] != "ignore"
+func compileRecordMatch(match RecordMatch) (*recordMatcher, error) {
+	patterns := []string{match.Namespace, match.Pod, match.Container, match.Host, match.Tag}
+	for _, value := range match.Labels {
+		patterns = append(patterns, value)
+	}
+	for _, value := range match.Annotations {
+		patterns = append(patterns, value)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	compiled := &recordMatcher{
+		RecordMatch: match,
+	}
+
+	if match.Log != "" {
+		var err error
+
+		compiled.log, err = regexp.Compile(match.Log)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log expression: %w", err)
+		}
+	}
+
+	return compiled, nil
+}
+
+// IncludeRecord evaluates the rules in order and returns the action
+// of the first matching rule.
+func (f *filter) IncludeRecord(record *Record, tag string) bool {
+	for _, rule := range f.rules {
+		if rule.matcher.Matches(record, tag) {
+			filterRuleHits.WithLabelValues(rule.Name, rule.Action).Inc()
+			return rule.Action == actionInclude
+		}
+	}
+
+	filterRuleHits.WithLabelValues(fallthroughRuleName, f.defaultAction).Inc()
+
+	return f.defaultAction == actionInclude
+}
+
+func (r *recordMatcher) Matches(record *Record, tag string) bool {
+	meta := record.Kubernetes
+
+	return matchGlob(r.Namespace, meta.NamespaceName) &&
+		matchGlob(r.Pod, meta.PodName) &&
+		matchGlob(r.Container, meta.ContainerName) &&
+		matchGlob(r.Host, meta.Host) &&
+		matchGlob(r.Tag, tag) &&
+		matchMap(r.Labels, meta.Labels) &&
+		matchMap(r.Annotations, meta.Annotations) &&
+		(r.log == nil || r.log.MatchString(record.Log))
+}
+
+// matchGlob returns true if the pattern is empty or matches the value.
+func matchGlob(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	// patterns have been validated when compiling the rule
+	matched, _ := path.Match(pattern, value)
+
+	return matched
+}
+
+// matchMap returns true if all keys in patterns exist in values and
+// their values match.
+func matchMap(patterns map[string]string, values map[string]string) bool {
+	for key, pattern := range patterns {
+		value, ok := values[key]
+		if !ok || !matchGlob(pattern, value) {
+			return false
+		}
+	}
+
+	return true
 }
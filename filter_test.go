@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFilterRulesYAML(t *testing.T) {
+	content := strings.Join([]string{
+		"default: exclude",
+		"rules:",
+		"  - name: keep-web",
+		"    action: include",
+		"    namespace: web-*",
+		"    labels:",
+		"      app: '*'",
+	}, "\n")
+
+	filename := filepath.Join(t.TempDir(), "rules.yml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	rules, err := loadFilterRules(filename)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+
+	f, err := newFilter(testConfig(t), rules)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	testcases := map[string]bool{
+		`{"log":"a","kubernetes":{"namespace_name":"web-1","labels":{"app":"shop"}}}`: true,
+		`{"log":"b","kubernetes":{"namespace_name":"web-1"}}`:                         false,
+		`{"log":"c","kubernetes":{"namespace_name":"kube-system"}}`:                   false,
+	}
+
+	for input, expected := range testcases {
+		record := &Record{}
+		if err := record.UnmarshalJSON([]byte(input)); err != nil {
+			t.Fatalf("Failed to decode record: %v", err)
+		}
+
+		if included := f.IncludeRecord(record, ""); included != expected {
+			t.Errorf("Expected %s to be included=%v, got %v.", input, expected, included)
+		}
+	}
+}
+
+func TestFilterRejectsReservedRuleName(t *testing.T) {
+	rules := FilterRules{
+		Rules: []FilterRule{{Name: fallthroughRuleName, Action: actionExclude}},
+	}
+
+	if _, err := newFilter(testConfig(t), rules); err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("Expected reserved name error, got %v.", err)
+	}
+}
+
+func filterTestRecord(t *testing.T, input string) *Record {
+	record := &Record{}
+	if err := record.UnmarshalJSON([]byte(input)); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+
+	return record
+}
+
+func TestFilterRules(t *testing.T) {
+	rules := FilterRules{
+		Default: actionInclude,
+		Rules: []FilterRule{
+			{
+				Name:        "keep-errors",
+				Action:      actionInclude,
+				RecordMatch: RecordMatch{Namespace: "kube-*", Log: `(?i)\berror\b`},
+			},
+			{
+				Name:        "drop-kube",
+				Action:      actionExclude,
+				RecordMatch: RecordMatch{Namespace: "kube-*"},
+			},
+			{
+				Name:        "keep-all-kube",
+				Action:      actionInclude,
+				RecordMatch: RecordMatch{Namespace: "kube-*"},
+			},
+			{
+				Name:        "keep-annotated",
+				Action:      actionInclude,
+				RecordMatch: RecordMatch{Annotations: map[string]string{"xrstf.de/bunker": "*"}},
+			},
+		},
+	}
+
+	f, err := newFilter(testConfig(t), rules)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	testcases := []struct {
+		name     string
+		input    string
+		rule     string
+		action   string
+		included bool
+	}{
+		{
+			name:     "log expression matches",
+			input:    `{"log":"an ERROR occurred","kubernetes":{"namespace_name":"kube-system"}}`,
+			rule:     "keep-errors",
+			action:   actionInclude,
+			included: true,
+		},
+		{
+			name:     "first match wins",
+			input:    `{"log":"errors are fine","kubernetes":{"namespace_name":"kube-system"}}`,
+			rule:     "drop-kube",
+			action:   actionExclude,
+			included: false,
+		},
+		{
+			name:     "annotation rule comes first",
+			input:    `{"log":"hello","kubernetes":{"namespace_name":"web","annotations":{"xrstf.de/bunker":"ignore"}}}`,
+			rule:     defaultFilterRule.Name,
+			action:   actionExclude,
+			included: false,
+		},
+		{
+			name:     "other annotation values",
+			input:    `{"log":"hello","kubernetes":{"namespace_name":"web","annotations":{"xrstf.de/bunker":"keep"}}}`,
+			rule:     "keep-annotated",
+			action:   actionInclude,
+			included: true,
+		},
+		{
+			name:     "no rule matches",
+			input:    `{"log":"hello","kubernetes":{"namespace_name":"web"}}`,
+			rule:     fallthroughRuleName,
+			action:   actionInclude,
+			included: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			hits := filterRuleHits.WithLabelValues(testcase.rule, testcase.action)
+			before := counterValue(t, hits)
+
+			if included := f.IncludeRecord(filterTestRecord(t, testcase.input), ""); included != testcase.included {
+				t.Errorf("Expected included=%v, got %v.", testcase.included, included)
+			}
+
+			if after := counterValue(t, hits); after != before+1 {
+				t.Errorf("Expected rule %q to be hit once, got %v hits.", testcase.rule, after-before)
+			}
+		})
+	}
+
+	// rules that never matched do not get hits
+	if hits := counterValue(t, filterRuleHits.WithLabelValues("keep-all-kube", actionInclude)); hits != 0 {
+		t.Errorf("Expected the shadowed rule not to be hit, got %v hits.", hits)
+	}
+}
+
+func TestFilterRejectsInvalidLogExpression(t *testing.T) {
+	rules := FilterRules{
+		Rules: []FilterRule{{Name: "broken", Action: actionInclude, RecordMatch: RecordMatch{Log: "("}}},
+	}
+
+	if _, err := newFilter(testConfig(t), rules); err == nil || !strings.Contains(err.Error(), `"broken"`) {
+		t.Fatalf("Expected invalid rule error, got %v.", err)
+	}
+}
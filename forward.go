@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// This implements the server side of the Fluent Forward protocol (v1),
+// see https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+
+const (
+	forwardHandshakeTimeout = 10 * time.Second
+	forwardWriteTimeout     = 10 * time.Second
+
+	// forwardMaxDecompressedSize limits the size of compressed entries
+	// after decompressing them.
+	forwardMaxDecompressedSize = 64 * 1024 * 1024
+)
+
+var errDecompressedTooLarge = fmt.Errorf("decompressed entries exceed %d bytes", forwardMaxDecompressedSize)
+
+// ForwardOptions configure the Forward protocol listener. An empty
+// listen address disables it.
+type ForwardOptions struct {
+	Listen    string
+	SharedKey string
+}
+
+type forwardServer struct {
+	sink     *sink
+	options  ForwardOptions
+	hostname string
+	logger   logrus.FieldLogger
+	listener net.Listener
+
+	lock     sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+	alive    chan struct{}
+}
+
+func NewForwardServer(config *Config, sink *sink, logger logrus.FieldLogger) (*forwardServer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "bunker"
+	}
+
+	listener, err := net.Listen("tcp", config.Forward.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardServer{
+		sink:     sink,
+		options:  config.Forward,
+		hostname: hostname,
+		logger:   logger,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+		alive:    make(chan struct{}),
+	}, nil
+}
+
+// Run is meant to run as a separate goroutine and accepts new
+// connections until Close() is called.
+func (s *forwardServer) Run() {
+	defer close(s.alive)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+
+			s.logger.Errorf("Failed to accept forward connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting new connections and waits for all messages
+// currently being received to be processed and acknowledged.
+func (s *forwardServer) Close() {
+	s.lock.Lock()
+	s.closed = true
+
+	// closing only the reading side allows pending acks to be sent
+	for conn := range s.conns {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+	s.lock.Unlock()
+
+	s.listener.Close()
+	<-s.alive
+
+	s.handlers.Wait()
+}
+
+func (s *forwardServer) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closed
+}
+
+func (s *forwardServer) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	forwardConnections.Inc()
+
+	return true
+}
+
+func (s *forwardServer) untrack(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.conns, conn)
+	s.handlers.Done()
+	forwardConnections.Dec()
+}
+
+func (s *forwardServer) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	logger := s.logger.WithField("client", conn.RemoteAddr().String())
+	decoder := newMsgpackDecoder(bufio.NewReader(conn))
+
+	if s.options.SharedKey != "" {
+		if err := s.handshake(conn, decoder); err != nil {
+			logger.Warnf("Forward handshake failed: %v", err)
+			return
+		}
+	}
+
+	for {
+		message, err := decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				logger.Warnf("Failed to read forward message: %v", err)
+			}
+
+			return
+		}
+
+		// closing the connection without an ack tells the client to retry
+		if err := s.handleMessage(conn, message); err != nil {
+			logger.Warnf("Failed to process forward message: %v", err)
+			return
+		}
+	}
+}
+
+// handshake authenticates the client using the shared key. User
+// authentication is not supported.
+func (s *forwardServer) handshake(conn net.Conn, decoder *msgpackDecoder) error {
+	conn.SetDeadline(time.Now().Add(forwardHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	helo := []interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      []byte{},
+		"keepalive": true,
+	}}
+
+	if err := s.send(conn, helo); err != nil {
+		return err
+	}
+
+	message, err := decoder.Decode()
+	if err != nil {
+		return err
+	}
+
+	// ["PING", hostname, shared_key_salt, digest, username, password]
+	ping, ok := message.([]interface{})
+	if !ok || len(ping) < 4 || ping[0] != "PING" {
+		return errors.New("expected PING message")
+	}
+
+	hostname, _ := ping[1].(string)
+	salt, _ := ping[2].(string)
+	digest, _ := ping[3].(string)
+
+	expected := forwardDigest(salt, hostname, string(nonce), s.options.SharedKey)
+
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		s.send(conn, []interface{}{"PONG", false, "shared key mismatch", "", ""})
+		return fmt.Errorf("client %q sent an invalid shared key", hostname)
+	}
+
+	pong := []interface{}{"PONG", true, "", s.hostname, forwardDigest(salt, s.hostname, string(nonce), s.options.SharedKey)}
+
+	return s.send(conn, pong)
+}
+
+func forwardDigest(salt string, hostname string, nonce string, key string) string {
+	hash := sha512.Sum512([]byte(salt + hostname + nonce + key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *forwardServer) send(conn net.Conn, message interface{}) error {
+	encoded, err := encodeMsgpack(message)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	_, err = conn.Write(encoded)
+
+	return err
+}
+
+// handleMessage stores the records of a single message and acknowledges
+// it if the client asked for it.
+func (s *forwardServer) handleMessage(conn net.Conn, message interface{}) error {
+	tag, records, options, err := decodeForwardMessage(message)
+	if err != nil {
+		return err
+	}
+
+	err = ingestPayload(s.sink, Payload{
+		Tag:     tag,
+		Records: records,
+	})
+	if err != nil {
+		return err
+	}
+
+	if chunk, ok := options["chunk"]; ok {
+		return s.send(conn, map[string]interface{}{"ack": chunk})
+	}
+
+	return nil
+}
+
+// decodeForwardMessage supports all modes of the protocol:
+//
+//	Message:        [tag, time, record, options?]
+//	Forward:        [tag, [[time, record], ...], options?]
+//	PackedForward:  [tag, msgpack stream of [time, record], options?]
+//
+// CompressedPackedForward is PackedForward with the stream being
+// gzip compressed, as indicated by the options.
+func decodeForwardMessage(message interface{}) (string, []*Record, map[string]interface{}, error) {
+	array, ok := message.([]interface{})
+	if !ok || len(array) < 2 {
+		return "", nil, nil, errors.New("message is not an array")
+	}
+
+	tag, ok := array[0].(string)
+	if !ok {
+		return "", nil, nil, errors.New("tag is not a string")
+	}
+
+	options := map[string]interface{}{}
+	records := make([]*Record, 0)
+
+	switch entries := array[1].(type) {
+	case []interface{}:
+		if len(array) > 2 {
+			options, _ = array[2].(map[string]interface{})
+		}
+
+		for _, entry := range entries {
+			record, err := fluentEvent(entry)
+			if err != nil {
+				return "", nil, nil, err
+			}
+
+			records = append(records, record)
+		}
+
+	case string:
+		if len(array) > 2 {
+			options, _ = array[2].(map[string]interface{})
+		}
+
+		var stream io.Reader = strings.NewReader(entries)
+
+		if options["compressed"] == "gzip" {
+			reader, err := gzip.NewReader(stream)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("failed to decompress entries: %w", err)
+			}
+
+			stream = &limitedReader{
+				reader:    reader,
+				remaining: forwardMaxDecompressedSize,
+				err:       errDecompressedTooLarge,
+			}
+		}
+
+		var err error
+
+		records, err = decodeMsgpackEvents(stream)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+	default:
+		if len(array) < 3 {
+			return "", nil, nil, errors.New("message has no record")
+		}
+
+		if len(array) > 3 {
+			options, _ = array[3].(map[string]interface{})
+		}
+
+		record, err := fluentRecord(array[1], array[2])
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	if options == nil {
+		options = map[string]interface{}{}
+	}
+
+	return tag, records, options, nil
+}
+
+// limitedReader is like io.LimitedReader, but returns an error instead
+// of io.EOF once the limit is exceeded.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// only fail if there actually is more data
+		var probe [1]byte
+
+		n, err := r.reader.Read(probe[:])
+		if n > 0 {
+			return 0, r.err
+		}
+
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+
+	return n, err
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestForwardHandshakeRejectsDeepNesting(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	s := &forwardServer{
+		options:  ForwardOptions{SharedKey: "secret"},
+		hostname: "bunker",
+		logger:   logger,
+	}
+
+	go func() {
+		defer client.Close()
+
+		// read the HELO message, then send a PING that never ends
+		if _, err := newMsgpackDecoder(client).Decode(); err != nil {
+			return
+		}
+
+		client.Write(bytes.Repeat([]byte{0x91}, 1024*1024))
+	}()
+
+	err := s.handshake(server, newMsgpackDecoder(server))
+	if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Fatalf("Expected nesting error, got %v.", err)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	testcases := []struct {
+		name  string
+		input string
+		limit int64
+		valid bool
+	}{
+		{name: "below limit", input: "abc", limit: 4, valid: true},
+		{name: "exactly at limit", input: "abcd", limit: 4, valid: true},
+		{name: "above limit", input: "abcde", limit: 4, valid: false},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			reader := &limitedReader{
+				reader:    strings.NewReader(testcase.input),
+				remaining: testcase.limit,
+				err:       errDecompressedTooLarge,
+			}
+
+			data, err := ioutil.ReadAll(reader)
+
+			if testcase.valid {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v.", err)
+				}
+
+				if string(data) != testcase.input {
+					t.Fatalf("Expected %q, got %q.", testcase.input, string(data))
+				}
+			} else if err != errDecompressedTooLarge {
+				t.Fatalf("Expected %v, got %v.", errDecompressedTooLarge, err)
+			}
+		})
+	}
+}
+
+func TestDecodeCompressedForwardMessage(t *testing.T) {
+	// [1577836800, {"log": "hello"}]
+	event := []byte{0x92, 0xce, 0x5e, 0x0b, 0xe1, 0x00, 0x81, 0xa3, 'l', 'o', 'g', 0xa5, 'h', 'e', 'l', 'l', 'o'}
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(event)
+	writer.Write(event)
+	writer.Close()
+
+	message := []interface{}{"app", compressed.String(), map[string]interface{}{"compressed": "gzip"}}
+
+	tag, records, _, err := decodeForwardMessage(message)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+
+	if tag != "app" || len(records) != 2 || records[1].Log != "hello" {
+		t.Fatalf("Unexpected result: tag %q, %d records.", tag, len(records))
+	}
+
+	// the decoded events are fine, but the stream must not grow beyond the limit
+	reader := &limitedReader{
+		reader:    bytes.NewReader(bytes.Repeat(event, 3)),
+		remaining: int64(len(event) * 2),
+		err:       errDecompressedTooLarge,
+	}
+
+	if _, err := decodeMsgpackEvents(reader); err != errDecompressedTooLarge {
+		t.Fatalf("Expected %v, got %v.", errDecompressedTooLarge, err)
+	}
+}
+
+// forwardTestClient performs the client side of the shared key
+// handshake and returns the PONG message.
+func forwardTestClient(t *testing.T, conn net.Conn, decoder *msgpackDecoder, key string) []interface{} {
+	message, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Failed to read HELO: %v", err)
+	}
+
+	helo, ok := message.([]interface{})
+	if !ok || len(helo) != 2 || helo[0] != "HELO" {
+		t.Fatalf("Expected HELO message, got %v.", message)
+	}
+
+	nonce, _ := helo[1].(map[string]interface{})["nonce"].(string)
+	if len(nonce) != 16 {
+		t.Fatalf("Expected a 16 byte nonce, got %q.", nonce)
+	}
+
+	ping, err := encodeMsgpack([]interface{}{"PING", "client", "salt", forwardDigest("salt", "client", nonce, key), "", ""})
+	if err != nil {
+		t.Fatalf("Failed to encode PING: %v", err)
+	}
+
+	if _, err := conn.Write(ping); err != nil {
+		t.Fatalf("Failed to send PING: %v", err)
+	}
+
+	message, err = decoder.Decode()
+	if err != nil {
+		t.Fatalf("Failed to read PONG: %v", err)
+	}
+
+	pong, ok := message.([]interface{})
+	if !ok || len(pong) != 5 || pong[0] != "PONG" {
+		t.Fatalf("Expected PONG message, got %v.", message)
+	}
+
+	// the server proves that it knows the key as well
+	if pong[1] == true {
+		if expected := forwardDigest("salt", "bunker", nonce, key); pong[3] != "bunker" || pong[4] != expected {
+			t.Fatalf("Expected server digest %s, got %v.", expected, pong)
+		}
+	}
+
+	return pong
+}
+
+func forwardTestServer(t *testing.T, config *Config) (*forwardServer, net.Conn, *msgpackDecoder) {
+	server, client := net.Pipe()
+
+	s := &forwardServer{
+		sink:     testSink(t, config),
+		options:  ForwardOptions{SharedKey: "secret"},
+		hostname: "bunker",
+		logger:   testLogger(),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.track(server)
+	go s.handle(server)
+
+	return s, client, newMsgpackDecoder(client)
+}
+
+func TestForwardHandshakeRejectsInvalidKey(t *testing.T) {
+	s, client, decoder := forwardTestServer(t, testConfig(t))
+	defer client.Close()
+
+	if pong := forwardTestClient(t, client, decoder, "wrong"); pong[1] != false || pong[2] != "shared key mismatch" {
+		t.Fatalf("Expected the key to be rejected, got %v.", pong)
+	}
+
+	// the server closes the connection
+	if _, err := decoder.Decode(); err == nil {
+		t.Fatal("Expected the connection to be closed.")
+	}
+
+	s.handlers.Wait()
+}
+
+func TestForwardAcknowledgesChunks(t *testing.T) {
+	config := testConfig(t, "-pattern", "records.json")
+	s, client, decoder := forwardTestServer(t, config)
+	defer client.Close()
+
+	if pong := forwardTestClient(t, client, decoder, "secret"); pong[1] != true {
+		t.Fatalf("Expected the handshake to succeed, got %v.", pong)
+	}
+
+	testcases := []struct {
+		message interface{}
+		ack     string
+	}{
+		{
+			message: []interface{}{"app", 1577836800, map[string]interface{}{"log": "first"}, map[string]interface{}{"chunk": "chunk-1"}},
+			ack:     "chunk-1",
+		},
+		{
+			// messages without a chunk ID are not acknowledged
+			message: []interface{}{"app", 1577836800, map[string]interface{}{"log": "second"}},
+		},
+		{
+			message: []interface{}{"app", []interface{}{
+				[]interface{}{1577836800, map[string]interface{}{"log": "third"}},
+				[]interface{}{1577836800, map[string]interface{}{"log": "fourth"}},
+			}, map[string]interface{}{"chunk": "chunk-2"}},
+			ack: "chunk-2",
+		},
+	}
+
+	for _, testcase := range testcases {
+		encoded, err := encodeMsgpack(testcase.message)
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+
+		if _, err := client.Write(encoded); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+
+		if testcase.ack == "" {
+			continue
+		}
+
+		ack, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Failed to read ack: %v", err)
+		}
+
+		if expected := map[string]interface{}{"ack": testcase.ack}; !reflect.DeepEqual(ack, expected) {
+			t.Fatalf("Expected %v, got %v.", expected, ack)
+		}
+	}
+
+	client.Close()
+	s.handlers.Wait()
+
+	go s.sink.GarbageCollect()
+	go s.sink.ProcessQueue()
+	s.sink.Close()
+
+	content, err := ioutil.ReadFile(filepath.Join(config.Target, "records.json"))
+	if err != nil {
+		t.Fatalf("Failed to read records: %v", err)
+	}
+
+	for _, log := range []string{"first", "second", "third", "fourth"} {
+		if !strings.Contains(string(content), `"`+log+`"`) {
+			t.Errorf("Expected record %q to be stored, got %q.", log, content)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ingestBatchSize is the maximum number of records handed to the sink
+// at once while a request body is being decoded.
+const ingestBatchSize = 1000
+
+var (
+	errUnsupportedContentType = errors.New("unsupported content type")
+	errBodyTooLarge           = errors.New("request body too large")
+)
+
+// bodyLimitReader fails with errBodyTooLarge once more than limit bytes
+// have been read, instead of silently truncating the body like
+// io.LimitReader.
+type bodyLimitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func newBodyLimitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+
+	return &bodyLimitReader{reader: r, remaining: limit}
+}
+
+func (r *bodyLimitReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// read one byte more than allowed to notice oversized bodies
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+
+	if r.remaining < 0 {
+		return n + int(r.remaining), errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// readCloser combines a reader, e.g. a limited one, with the closer of
+// the underlying body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// requestBody returns the request body, decompressing it according
+// to its Content-Encoding. Reading fails with errBodyTooLarge if either
+// the compressed or the decompressed body is larger than limit bytes
+// (a limit of 0 disables this).
+func requestBody(req *http.Request, limit int64) (io.ReadCloser, error) {
+	raw := newBodyLimitReader(req.Body, limit)
+
+	if !strings.EqualFold(req.Header.Get(echo.HeaderContentEncoding), "gzip") {
+		return readCloser{raw, req.Body}, nil
+	}
+
+	decompressed, err := gzip.NewReader(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return readCloser{newBodyLimitReader(decompressed, limit), decompressed}, nil
+}
+
+// readRequestBody reads the complete, decompressed request body, which
+// must not be larger than limit bytes (see requestBody).
+func readRequestBody(req *http.Request, limit int64) ([]byte, error) {
+	body, err := requestBody(req, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// ingestPayload hands the payload to the sink and updates the metrics.
+func ingestPayload(sink *sink, payload Payload) error {
+	received, ingested, err := sink.AddPayload(payload)
+	recordsIngested.Add(float64(ingested))
+	recordsReceived.Add(float64(received))
+
+	return err
+}
+
+// ingestRequestPayload makes sure that the client is allowed to write
+// the payload and hands it to the sink.
+func ingestRequestPayload(c echo.Context, sink *sink, payload Payload) error {
+	if err := authorizePayload(c, payload); err != nil {
+		return err
+	}
+
+	return ingestPayload(sink, payload)
+}
+
+// payloadErrorResponse tells HTTP clients why their payload could not
+// be stored.
+func payloadErrorResponse(c echo.Context, config *Config, err error) error {
+	var scopeErr *scopeError
+	if errors.As(err, &scopeErr) {
+		return c.String(http.StatusForbidden, fmt.Sprintf("Forbidden: %v.", err))
+	}
+
+	if errors.Is(err, errQueueFull) {
+		c.Response().Header().Set("Retry-After", fmt.Sprintf("%.0f", config.Queue.RetryAfter.Seconds()))
+		return c.String(http.StatusServiceUnavailable, "Queue is full, try again later.")
+	}
+
+	log.Printf("Failed to store payload: %v", err)
+	return c.String(http.StatusInternalServerError, "Failed to store payload, check sink's logs.")
+}
+
+// bodyTooLargeResponse tells HTTP clients that their request body
+// exceeds -max-body-size.
+func bodyTooLargeResponse(c echo.Context, config *Config) error {
+	return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Body must not be larger than %d bytes.", config.MaxBodySize))
+}
+
+// recordReader decodes records one by one from a request body. Next
+// returns io.EOF once all records have been read.
+type recordReader interface {
+	Next() (*Record, error)
+}
+
+// newRecordReader chooses the decoder based on the Content-Type.
+func newRecordReader(contentType string, body io.Reader) (recordReader, error) {
+	switch {
+	case strings.Contains(contentType, "msgpack"):
+		return newMsgpackRecordReader(body), nil
+
+	case strings.Contains(contentType, "json"):
+		return newJSONRecordReader(body), nil
+
+	default:
+		return nil, errUnsupportedContentType
+	}
+}
+
+// readRecords reads up to limit records (or all records for a negative
+// limit). The error is io.EOF if the input has been read completely.
+func readRecords(reader recordReader, limit int) ([]*Record, error) {
+	records := make([]*Record, 0)
+
+	for limit < 0 || len(records) < limit {
+		record, err := reader.Next()
+		if err != nil {
+			return records, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// jsonRecordReader reads either a JSON array of records (fluent-bit's
+// "json" format) or a stream of JSON objects, separated by newlines
+// ("json_lines") or not ("json_stream").
+type jsonRecordReader struct {
+	reader  *bufio.Reader
+	decoder *json.Decoder
+	array   bool
+}
+
+func newJSONRecordReader(r io.Reader) *jsonRecordReader {
+	return &jsonRecordReader{
+		reader: bufio.NewReader(r),
+	}
+}
+
+func (r *jsonRecordReader) Next() (*Record, error) {
+	if r.decoder == nil {
+		if err := r.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.array && !r.decoder.More() {
+		// consume the closing bracket
+		if _, err := r.decoder.Token(); err != nil {
+			return nil, err
+		}
+
+		return nil, io.EOF
+	}
+
+	record := &Record{}
+	if err := r.decoder.Decode(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// start detects whether the body is an array by looking at the first
+// non-whitespace character.
+func (r *jsonRecordReader) start() error {
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+
+		r.reader.UnreadByte()
+		r.decoder = json.NewDecoder(r.reader)
+
+		if b == '[' {
+			r.array = true
+
+			// consume the opening bracket
+			if _, err := r.decoder.Token(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestJSONRecordReader(t *testing.T) {
+	testcases := []struct {
+		name  string
+		input string
+		logs  []string
+	}{
+		{name: "empty body", input: " \n", logs: []string{}},
+		{name: "array", input: `[{"log":"a"}, {"log":"b"}]`, logs: []string{"a", "b"}},
+		{name: "empty array", input: `[]`, logs: []string{}},
+		{name: "json_lines", input: "{\"log\":\"a\"}\n{\"log\":\"b\"}\n", logs: []string{"a", "b"}},
+		{name: "json_stream", input: `{"log":"a"}{"log":"b"}`, logs: []string{"a", "b"}},
+		{name: "leading whitespace", input: "\r\n\t [{\"log\":\"a\"}]", logs: []string{"a"}},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			records, err := readRecords(newJSONRecordReader(strings.NewReader(testcase.input)), -1)
+			if err != io.EOF {
+				t.Fatalf("Expected io.EOF, got %v.", err)
+			}
+
+			logs := make([]string, 0)
+			for _, record := range records {
+				logs = append(logs, record.Log)
+			}
+
+			if strings.Join(logs, ",") != strings.Join(testcase.logs, ",") {
+				t.Fatalf("Expected logs %v, got %v.", testcase.logs, logs)
+			}
+		})
+	}
+}
+
+func TestJSONRecordReaderInvalid(t *testing.T) {
+	for _, input := range []string{`[{"log":"a"}`, `{"log":"a"} {broken`, `"log"`} {
+		_, err := readRecords(newJSONRecordReader(strings.NewReader(input)), -1)
+		if err == nil || err == io.EOF {
+			t.Errorf("Expected an error for %q, got %v.", input, err)
+		}
+	}
+}
+
+func TestReadRecordsLimit(t *testing.T) {
+	input := strings.Repeat(`{"log":"a"}`+"\n", 5)
+	reader := newJSONRecordReader(strings.NewReader(input))
+
+	for _, expected := range []int{2, 2, 1} {
+		records, err := readRecords(reader, 2)
+		if len(records) != expected {
+			t.Fatalf("Expected a batch of %d records, got %d.", expected, len(records))
+		}
+
+		if expected < 2 && err != io.EOF {
+			t.Fatalf("Expected io.EOF after the last batch, got %v.", err)
+		}
+
+		if expected == 2 && err != nil {
+			t.Fatalf("Expected no error, got %v.", err)
+		}
+	}
+}
+
+func TestNewRecordReader(t *testing.T) {
+	// [1577836800, {"log": "hello"}]
+	msgpack := []byte{0x92, 0xce, 0x5e, 0x0b, 0xe1, 0x00, 0x81, 0xa3, 'l', 'o', 'g', 0xa5, 'h', 'e', 'l', 'l', 'o'}
+
+	testcases := []struct {
+		contentType string
+		body        []byte
+		valid       bool
+	}{
+		{contentType: "application/json", body: []byte(`{"log":"hello"}`), valid: true},
+		{contentType: "application/x-ndjson", body: []byte(`{"log":"hello"}`), valid: true},
+		{contentType: "application/json; charset=utf-8", body: []byte(`[{"log":"hello"}]`), valid: true},
+		{contentType: "application/msgpack", body: msgpack, valid: true},
+		{contentType: "text/plain", valid: false},
+	}
+
+	for _, testcase := range testcases {
+		reader, err := newRecordReader(testcase.contentType, bytes.NewReader(testcase.body))
+		if !testcase.valid {
+			if err != errUnsupportedContentType {
+				t.Errorf("Expected %q to be unsupported, got %v.", testcase.contentType, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to create reader for %q: %v", testcase.contentType, err)
+		}
+
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Failed to read record for %q: %v", testcase.contentType, err)
+		}
+
+		if record.Log != "hello" {
+			t.Errorf("Expected log %q for %q, got %q.", "hello", testcase.contentType, record.Log)
+		}
+	}
+}
+
+func TestPayloadErrorResponse(t *testing.T) {
+	testcases := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{
+			name:   "scope error",
+			err:    &scopeError{principal: "test", field: "namespace", value: "kube-system"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "wrapped scope error",
+			err:    fmt.Errorf("failed to authorize payload: %w", &scopeError{principal: "test"}),
+			status: http.StatusForbidden,
+		},
+		{
+			name:       "full queue",
+			err:        errQueueFull,
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "10",
+		},
+		{
+			name:       "wrapped full queue",
+			err:        fmt.Errorf("failed to queue payload: %w", errQueueFull),
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "10",
+		},
+		{
+			name:   "other error",
+			err:    errors.New("disk full"),
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	config := testConfig(t)
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/ingest", nil), rec)
+
+			if err := payloadErrorResponse(c, config, testcase.err); err != nil {
+				t.Fatalf("Failed to respond: %v", err)
+			}
+
+			if rec.Code != testcase.status {
+				t.Errorf("Expected status %d, got %d.", testcase.status, rec.Code)
+			}
+
+			if retryAfter := rec.Header().Get("Retry-After"); retryAfter != testcase.retryAfter {
+				t.Errorf("Expected Retry-After %q, got %q.", testcase.retryAfter, retryAfter)
+			}
+		})
+	}
+}
@@ -1,10 +1,78 @@
 package main
 
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
 type recordJob struct {
 	tag    string
+	path   string
+	route  *route
 	record *Record
+	queued time.Time
+	wal    *walSegment
+	result *writeResult
 }
 
 type closeWriterJob struct {
 	path string
 }
+
+// writeResult collects the outcome of writing all records of a payload,
+// used when writes are synchronous.
+type writeResult struct {
+	pending sync.WaitGroup
+	lock    sync.Mutex
+	failed  int
+	err     error
+}
+
+func newWriteResult(records int) *writeResult {
+	r := &writeResult{}
+	r.pending.Add(records)
+
+	return r
+}
+
+// Done reports that a single record has been handled.
+func (r *writeResult) Done(err error) {
+	if err != nil {
+		r.lock.Lock()
+		r.failed++
+		if r.err == nil {
+			r.err = err
+		}
+		r.lock.Unlock()
+	}
+
+	r.pending.Done()
+}
+
+// Wait waits for all records to be handled and returns the number
+// of failed records and the first error.
+func (r *writeResult) Wait() (int, error) {
+	r.pending.Wait()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.failed, r.err
+}
+
+// partialWriteError is returned if some records of a payload could not
+// be written.
+type partialWriteError struct {
+	failed int
+	total  int
+	err    error
+}
+
+func (e *partialWriteError) Error() string {
+	return fmt.Sprintf("%d of %d records could not be written: %v", e.failed, e.total, e.err)
+}
+
+func (e *partialWriteError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/labstack/echo"
+)
+
+// lokiMaxDecodedSize limits the size of a decompressed protobuf push
+// request if -max-body-size is disabled, as the snappy header can claim
+// arbitrary lengths.
+const lokiMaxDecodedSize = 64 * 1024 * 1024
+
+// lokiStream is a set of log lines sharing the same labels, as sent to
+// Loki's push API by Promtail or Grafana Agent.
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+	metadata  map[string]string
+}
+
+// makeLokiPushRequestHandler implements Loki's /loki/api/v1/push,
+// accepting both JSON and snappy compressed protobuf payloads.
+func makeLokiPushRequestHandler(config *Config, sink *sink) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		defer req.Body.Close()
+
+		body, err := readRequestBody(req, config.MaxBodySize)
+		if errors.Is(err, errBodyTooLarge) {
+			return bodyTooLargeResponse(c, config)
+		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Body could not be read")
+		}
+
+		var streams []lokiStream
+
+		if strings.Contains(req.Header.Get(echo.HeaderContentType), "json") {
+			streams, err = decodeLokiJSON(body)
+		} else {
+			streams, err = decodeLokiProtobuf(body, config.MaxBodySize)
+		}
+
+		if errors.Is(err, errBodyTooLarge) {
+			return bodyTooLargeResponse(c, config)
+		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid push request: %v", err))
+		}
+
+		payload := Payload{
+			Tag: req.Header.Get(config.TagHeader),
+		}
+
+		for _, stream := range streams {
+			for _, entry := range stream.entries {
+				// a single broken entry must not reject the whole push
+				record, err := lokiRecord(stream.labels, entry)
+				if err != nil {
+					invalidRecords.WithLabelValues("loki").Inc()
+					continue
+				}
+
+				payload.Records = append(payload.Records, record)
+			}
+		}
+
+		if err := ingestRequestPayload(c, sink, payload); err != nil {
+			return payloadErrorResponse(c, config, err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// lokiRecord maps the well-known labels onto the Kubernetes metadata,
+// so that records look like the ones sent by fluent-bit. All other
+// labels become Kubernetes labels.
+func lokiRecord(labels map[string]string, entry lokiEntry) (*Record, error) {
+	kubernetes := map[string]interface{}{}
+	other := map[string]string{}
+
+	for name, value := range labels {
+		switch name {
+		case "namespace":
+			kubernetes["namespace_name"] = value
+		case "pod":
+			kubernetes["pod_name"] = value
+		case "container":
+			kubernetes["container_name"] = value
+		case "host", "node_name":
+			kubernetes["host"] = value
+		default:
+			other[name] = value
+		}
+	}
+
+	if len(other) > 0 {
+		kubernetes["labels"] = other
+	}
+
+	fields := map[string]interface{}{
+		"date":       entry.timestamp.UTC().Format(time.RFC3339Nano),
+		"log":        entry.line,
+		"kubernetes": kubernetes,
+	}
+
+	if len(entry.metadata) > 0 {
+		fields["metadata"] = entry.metadata
+	}
+
+	return newRecord(fields)
+}
+
+// decodeLokiJSON decodes
+// {"streams": [{"stream": {labels}, "values": [["<ns>", "line", {metadata}], ...]}]}
+func decodeLokiJSON(body []byte) ([]lokiStream, error) {
+	request := struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}{}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	streams := make([]lokiStream, 0, len(request.Streams))
+
+	for _, s := range request.Streams {
+		stream := lokiStream{
+			labels: s.Stream,
+		}
+
+		for _, value := range s.Values {
+			if len(value) < 2 {
+				return nil, errors.New("value must contain a timestamp and a line")
+			}
+
+			var timestamp string
+			entry := lokiEntry{}
+
+			if err := json.Unmarshal(value[0], &timestamp); err != nil {
+				return nil, fmt.Errorf("invalid timestamp: %w", err)
+			}
+
+			nanos, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp: %w", err)
+			}
+
+			entry.timestamp = time.Unix(0, nanos)
+
+			if err := json.Unmarshal(value[1], &entry.line); err != nil {
+				return nil, fmt.Errorf("invalid line: %w", err)
+			}
+
+			if len(value) > 2 {
+				if err := json.Unmarshal(value[2], &entry.metadata); err != nil {
+					return nil, fmt.Errorf("invalid structured metadata: %w", err)
+				}
+			}
+
+			stream.entries = append(stream.entries, entry)
+		}
+
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+// decodeLokiProtobuf decodes a snappy compressed logproto.PushRequest,
+// which must not decompress to more than limit bytes (or
+// lokiMaxDecodedSize for a limit of 0).
+func decodeLokiProtobuf(body []byte, limit int64) ([]lokiStream, error) {
+	if limit <= 0 {
+		limit = lokiMaxDecodedSize
+	}
+
+	length, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if int64(length) > limit {
+		return nil, fmt.Errorf("%w (%d bytes decompressed, at most %d are allowed)", errBodyTooLarge, length, limit)
+	}
+
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	streams := make([]lokiStream, 0)
+	reader := newProtoReader(data)
+
+	// message PushRequest { repeated StreamAdapter streams = 1; }
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return streams, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if field != 1 || wireType != protoBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		message, err := reader.Bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := decodeLokiStream(message)
+		if err != nil {
+			return nil, err
+		}
+
+		streams = append(streams, stream)
+	}
+}
+
+//	message StreamAdapter {
+//	  string labels = 1;
+//	  repeated EntryAdapter entries = 2;
+//	}
+func decodeLokiStream(data []byte) (lokiStream, error) {
+	stream := lokiStream{}
+	reader := newProtoReader(data)
+
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return stream, nil
+		}
+
+		if err != nil {
+			return stream, err
+		}
+
+		if wireType != protoBytes || (field != 1 && field != 2) {
+			if err := reader.Skip(wireType); err != nil {
+				return stream, err
+			}
+
+			continue
+		}
+
+		value, err := reader.Bytes()
+		if err != nil {
+			return stream, err
+		}
+
+		if field == 1 {
+			stream.labels, err = parseLokiLabels(string(value))
+			if err != nil {
+				return stream, err
+			}
+		} else {
+			entry, err := decodeLokiEntry(value)
+			if err != nil {
+				return stream, err
+			}
+
+			stream.entries = append(stream.entries, entry)
+		}
+	}
+}
+
+//	message EntryAdapter {
+//	  google.protobuf.Timestamp timestamp = 1;
+//	  string line = 2;
+//	  repeated LabelPairAdapter structuredMetadata = 3;
+//	}
+func decodeLokiEntry(data []byte) (lokiEntry, error) {
+	entry := lokiEntry{}
+	reader := newProtoReader(data)
+
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return entry, nil
+		}
+
+		if err != nil {
+			return entry, err
+		}
+
+		if wireType != protoBytes || field < 1 || field > 3 {
+			if err := reader.Skip(wireType); err != nil {
+				return entry, err
+			}
+
+			continue
+		}
+
+		value, err := reader.Bytes()
+		if err != nil {
+			return entry, err
+		}
+
+		switch field {
+		case 1:
+			entry.timestamp, err = decodeProtoTimestamp(value)
+
+		case 2:
+			entry.line = string(value)
+
+		case 3:
+			var name, labelValue string
+
+			name, labelValue, err = decodeLokiLabelPair(value)
+			if err == nil {
+				if entry.metadata == nil {
+					entry.metadata = map[string]string{}
+				}
+
+				entry.metadata[name] = labelValue
+			}
+		}
+
+		if err != nil {
+			return entry, err
+		}
+	}
+}
+
+// message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+func decodeProtoTimestamp(data []byte) (time.Time, error) {
+	var seconds, nanos uint64
+
+	reader := newProtoReader(data)
+
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return time.Unix(int64(seconds), int64(int32(nanos))), nil
+		}
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		switch {
+		case field == 1 && wireType == protoVarint:
+			seconds, err = reader.Varint()
+		case field == 2 && wireType == protoVarint:
+			nanos, err = reader.Varint()
+		default:
+			err = reader.Skip(wireType)
+		}
+
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+}
+
+// message LabelPairAdapter { string name = 1; string value = 2; }
+func decodeLokiLabelPair(data []byte) (string, string, error) {
+	var name, value string
+
+	reader := newProtoReader(data)
+
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return name, value, nil
+		}
+
+		if err != nil {
+			return "", "", err
+		}
+
+		if wireType != protoBytes || (field != 1 && field != 2) {
+			if err := reader.Skip(wireType); err != nil {
+				return "", "", err
+			}
+
+			continue
+		}
+
+		s, err := reader.Bytes()
+		if err != nil {
+			return "", "", err
+		}
+
+		if field == 1 {
+			name = string(s)
+		} else {
+			value = string(s)
+		}
+	}
+}
+
+// parseLokiLabels parses labels in the Prometheus format, e.g.
+// {namespace="default", pod="foo"}.
+func parseLokiLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid labels %q", s)
+	}
+
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 || eq+1 >= len(rest) || rest[eq+1] != '"' {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+
+		name := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+
+		// find the closing quote, skipping escaped characters
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+
+		if end >= len(rest) {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+
+		value, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid label value for %q: %w", name, err)
+		}
+
+		labels[name] = value
+
+		rest = strings.TrimSpace(rest[end+1:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+
+	return labels, nil
+}
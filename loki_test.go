@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/labstack/echo"
+)
+
+func TestLokiProtobufDecodedSize(t *testing.T) {
+	// a snappy header claiming ~4 GB, followed by nothing
+	header := make([]byte, binary.MaxVarintLen64)
+	body := header[:binary.PutUvarint(header, 1<<32-1)]
+
+	if _, err := decodeLokiProtobuf(body, 0); !errors.Is(err, errBodyTooLarge) {
+		t.Fatalf("Expected size error, got %v.", err)
+	}
+
+	// PushRequest { streams: [{ labels: "{namespace=\"default\"}" }] }
+	labels := `{namespace="default"}`
+	stream := append([]byte{0x0a, byte(len(labels))}, labels...)
+	message := append([]byte{0x0a, byte(len(stream))}, stream...)
+
+	// the configured limit applies to the decompressed size
+	if _, err := decodeLokiProtobuf(snappy.Encode(nil, message), int64(len(message)-1)); !errors.Is(err, errBodyTooLarge) {
+		t.Fatalf("Expected size error, got %v.", err)
+	}
+
+	streams, err := decodeLokiProtobuf(snappy.Encode(nil, message), int64(len(message)))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	if len(streams) != 1 || streams[0].labels["namespace"] != "default" {
+		t.Fatalf("Expected one stream in the default namespace, got %v.", streams)
+	}
+}
+
+// lokiProtoBytes encodes a length-delimited protobuf field.
+func lokiProtoBytes(field int, value []byte) []byte {
+	data := binary.AppendUvarint(nil, uint64(field<<3|protoBytes))
+	data = binary.AppendUvarint(data, uint64(len(value)))
+
+	return append(data, value...)
+}
+
+func TestDecodeLokiProtobuf(t *testing.T) {
+	timestamp := []byte{0x08}
+	timestamp = binary.AppendUvarint(timestamp, 1577836800)
+	timestamp = append(timestamp, 0x10)
+	timestamp = binary.AppendUvarint(timestamp, 5)
+
+	metadata := append(lokiProtoBytes(1, []byte("trace_id")), lokiProtoBytes(2, []byte("abc"))...)
+
+	entry := lokiProtoBytes(1, timestamp)
+	entry = append(entry, lokiProtoBytes(2, []byte("hello"))...)
+	entry = append(entry, lokiProtoBytes(3, metadata)...)
+
+	stream := lokiProtoBytes(1, []byte(`{namespace="default", pod="web-1"}`))
+	stream = append(stream, lokiProtoBytes(2, entry)...)
+
+	streams, err := decodeLokiProtobuf(snappy.Encode(nil, lokiProtoBytes(1, stream)), 0)
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	if len(streams) != 1 || len(streams[0].entries) != 1 {
+		t.Fatalf("Expected one stream with one entry, got %+v.", streams)
+	}
+
+	if expected := map[string]string{"namespace": "default", "pod": "web-1"}; !reflect.DeepEqual(streams[0].labels, expected) {
+		t.Errorf("Expected labels %v, got %v.", expected, streams[0].labels)
+	}
+
+	decoded := streams[0].entries[0]
+
+	if !decoded.timestamp.Equal(time.Unix(1577836800, 5)) {
+		t.Errorf("Expected timestamp 1577836800.000000005, got %v.", decoded.timestamp)
+	}
+
+	if decoded.line != "hello" || decoded.metadata["trace_id"] != "abc" {
+		t.Errorf("Expected line and metadata, got %+v.", decoded)
+	}
+
+	if _, err := decodeLokiProtobuf([]byte("not snappy"), 0); err == nil {
+		t.Error("Expected an error for an invalid body, got nil.")
+	}
+}
+
+func TestDecodeLokiJSON(t *testing.T) {
+	body := `{"streams": [{
+		"stream": {"namespace": "default", "app": "web"},
+		"values": [
+			["1577836800000000005", "first"],
+			["1577836801000000000", "second", {"trace_id": "abc"}]
+		]
+	}]}`
+
+	streams, err := decodeLokiJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	if len(streams) != 1 || len(streams[0].entries) != 2 {
+		t.Fatalf("Expected one stream with two entries, got %+v.", streams)
+	}
+
+	entries := streams[0].entries
+
+	if entries[0].line != "first" || !entries[0].timestamp.Equal(time.Unix(1577836800, 5)) {
+		t.Errorf("Unexpected first entry %+v.", entries[0])
+	}
+
+	if entries[1].metadata["trace_id"] != "abc" {
+		t.Errorf("Expected structured metadata, got %v.", entries[1].metadata)
+	}
+
+	for _, invalid := range []string{
+		`{"streams": [{"values": [["1577836800000000000"]]}]}`,
+		`{"streams": [{"values": [["yesterday", "line"]]}]}`,
+		`{"streams": [{"values": [[1577836800000000000, "line"]]}]}`,
+	} {
+		if _, err := decodeLokiJSON([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %s, got nil.", invalid)
+		}
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected map[string]string
+	}{
+		{input: `{}`, expected: map[string]string{}},
+		{input: `{namespace="default"}`, expected: map[string]string{"namespace": "default"}},
+		{input: ` { a="1" , b="x,y" } `, expected: map[string]string{"a": "1", "b": "x,y"}},
+		{input: `{a="say \"hi\"", b="c\\d"}`, expected: map[string]string{"a": `say "hi"`, "b": `c\d`}},
+		{input: `namespace="default"`},
+		{input: `{namespace=default}`},
+		{input: `{namespace="default}`},
+	}
+
+	for _, testcase := range testcases {
+		labels, err := parseLokiLabels(testcase.input)
+
+		if testcase.expected == nil {
+			if err == nil {
+				t.Errorf("Expected an error for %s, got %v.", testcase.input, labels)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", testcase.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(labels, testcase.expected) {
+			t.Errorf("Expected %v for %s, got %v.", testcase.expected, testcase.input, labels)
+		}
+	}
+}
+
+func TestLokiRecord(t *testing.T) {
+	labels := map[string]string{
+		"namespace": "default",
+		"pod":       "web-1",
+		"container": "nginx",
+		"node_name": "node-1",
+		"app":       "web",
+	}
+
+	entry := lokiEntry{
+		timestamp: time.Unix(1577836800, 5),
+		line:      "hello",
+		metadata:  map[string]string{"trace_id": "abc"},
+	}
+
+	record, err := lokiRecord(labels, entry)
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	expected := KubernetesMetadata{
+		NamespaceName: "default",
+		PodName:       "web-1",
+		ContainerName: "nginx",
+		Host:          "node-1",
+		Labels:        map[string]string{"app": "web"},
+	}
+
+	if !reflect.DeepEqual(record.Kubernetes, expected) {
+		t.Errorf("Expected Kubernetes metadata %+v, got %+v.", expected, record.Kubernetes)
+	}
+
+	if record.Log != "hello" || !record.Date.Equal(entry.timestamp) {
+		t.Errorf("Expected log and date to be set, got %q and %v.", record.Log, record.Date)
+	}
+
+	if metadata, _ := record.Field("metadata"); string(metadata) != `{"trace_id":"abc"}` {
+		t.Errorf("Expected metadata to be stored, got %s.", metadata)
+	}
+}
+
+func TestLokiPushBodyLimit(t *testing.T) {
+	line := `{"streams":[{"stream":{"namespace":"default"},"values":[["1577880000000000000","hello"]]}]}`
+	padded := line + strings.Repeat(" ", 1000)
+
+	labels := `{namespace="default"}`
+	stream := append([]byte{0x0a, byte(len(labels))}, labels...)
+	message := append(lokiProtoBytes(1, stream), make([]byte, 1000)...)
+
+	// only the decompressed bodies exceed the limit of 500 bytes
+	if len(gzipTestBody(t, padded)) > 500 || len(snappy.Encode(nil, message)) > 500 {
+		t.Fatal("Expected compressed test bodies to be smaller than the limit.")
+	}
+
+	testcases := []struct {
+		name        string
+		body        string
+		contentType string
+		gzip        bool
+		status      int
+	}{
+		{
+			name:        "small JSON body",
+			body:        line,
+			contentType: "application/json",
+			status:      http.StatusNoContent,
+		},
+		{
+			name:        "large JSON body",
+			body:        padded,
+			contentType: "application/json",
+			status:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "large decompressed JSON body",
+			body:        padded,
+			contentType: "application/json",
+			gzip:        true,
+			status:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "large decompressed protobuf body",
+			body:        string(snappy.Encode(nil, message)),
+			contentType: "application/x-protobuf",
+			status:      http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			config := testConfig(t, "-max-body-size", "500")
+			s := testSink(t, config)
+
+			body := testcase.body
+			if testcase.gzip {
+				body = gzipTestBody(t, body)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, testcase.contentType)
+			if testcase.gzip {
+				req.Header.Set(echo.HeaderContentEncoding, "gzip")
+			}
+
+			rec := httptest.NewRecorder()
+
+			if err := makeLokiPushRequestHandler(config, s)(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("Handler failed: %v", err)
+			}
+
+			if rec.Code != testcase.status {
+				t.Errorf("Expected status %d, got %d (%s).", testcase.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
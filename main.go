@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,31 +19,74 @@ import (
 )
 
 type Config struct {
-	Target    string
-	Pattern   string
-	Listen    string
-	TagHeader string
-	Verbose   bool
+	ConfigFile     string
+	ReloadInterval time.Duration
+	Target         string
+	Pattern        string
+	Timezone       string
+	Listen         string
+	TagHeader      string
+	MaxBodySize    int64
+	FilterRules    string
+	Routes         string
+	Auth           string
+	TLS            TLSOptions
+	Output         WriterOptions
+	Retention      RetentionPolicy
+	TailBuffer     int
+	Workers        int
+	Queue          QueueOptions
+	Writers        WritersOptions
+	SyncWrites     bool
+	WAL            WALOptions
+	Forward        ForwardOptions
+	Syslog         SyslogOptions
+	Verbose        bool
+
+	// InlineFilterRules, InlineRoutes and InlineAuth are given directly
+	// in the configuration file instead of as separate files.
+	InlineFilterRules *FilterRules
+	InlineRoutes      *Routes
+	InlineAuth        *AuthConfig
+}
+
+type TLSOptions struct {
+	Certificate string
+	Key         string
+}
+
+func (o TLSOptions) Enabled() bool {
+	return o.Certificate != "" || o.Key != ""
 }
 
 func main() {
-	config := Config{}
+	config, flags, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %v", err)
+	}
 
-	flag.StringVar(&config.Target, "target", "records", "path to where incoming records should be written to")
-	flag.StringVar(&config.Pattern, "pattern", "%date%/%kubernetes_namespace_name%.json", "filename pattern to group records into files")
-	flag.StringVar(&config.Listen, "listen", "0.0.0.0:9095", "address and port to listen on")
-	flag.StringVar(&config.TagHeader, "tag-header", "Fluentbit-Tag", "name of the HTTP header carrying the fluent tag name")
-	flag.BoolVar(&config.Verbose, "verbose", false, "incrases logging verbosity")
-	flag.Parse()
+	logger := makeLogger(config)
 
-	logger := makeLogger(&config)
+	if config.TLS.Enabled() && (config.TLS.Certificate == "" || config.TLS.Key == "") {
+		logger.Fatal("Both -tls-cert and -tls-key are required to enable TLS.")
+	}
 
-	filter, err := NewFilter(&config)
+	filter, err := NewFilter(config)
 	if err != nil {
 		logger.Fatalf("Failed to create filter: %v", err)
 	}
 
-	sink, err := NewSink(&config, filter, logger)
+	router, err := NewRouter(config)
+	if err != nil {
+		logger.Fatalf("Failed to set up routes: %v", err)
+	}
+
+	auth, err := NewAuth(config)
+	if err != nil {
+		logger.Fatalf("Failed to set up authentication: %v", err)
+	}
+
+	sink, err := NewSink(config, filter, router, logger)
 	if err != nil {
 		logger.Fatalf("Failed to start log processor: %v", err)
 	}
@@ -53,20 +96,72 @@ func main() {
 		logger.Fatalf("Failed to register sink metrics collector: %v", err)
 	}
 
+	retention, err := NewRetention(config, router, sink, logger)
+	if err != nil {
+		logger.Fatalf("Failed to set up retention: %v", err)
+	}
+
+	reloader, err := NewReloader(config, flags, sink, retention, auth, logger)
+	if err != nil {
+		logger.Fatalf("Failed to set up configuration reloading: %v", err)
+	}
+
 	go sink.GarbageCollect()
 	go sink.ProcessQueue()
+	go retention.Run()
+	go reloader.Run()
+
+	if err := sink.ReplayWAL(); err != nil {
+		logger.Fatalf("Failed to replay write-ahead log: %v", err)
+	}
+
+	var forward *forwardServer
+
+	if config.Forward.Listen != "" {
+		forward, err = NewForwardServer(config, sink, logger)
+		if err != nil {
+			logger.Fatalf("Failed to start Forward listener: %v", err)
+		}
+
+		logger.Infof("Accepting Forward protocol on %s…", config.Forward.Listen)
+		go forward.Run()
+	}
+
+	var syslog *syslogServer
+
+	if config.Syslog.Enabled() {
+		syslog, err = NewSyslogServer(config, sink, logger)
+		if err != nil {
+			logger.Fatalf("Failed to start syslog listener: %v", err)
+		}
+
+		logger.Info("Accepting syslog messages…")
+		go syslog.Run()
+	}
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 
-	e.POST("/ingest", makeIngestRequestHandler(&config, sink), metricsMiddleware)
+	e.POST("/ingest", makeIngestRequestHandler(config, sink), metricsMiddleware, auth.Middleware)
+	e.POST("/loki/api/v1/push", makeLokiPushRequestHandler(config, sink), metricsMiddleware, auth.Middleware)
+	e.POST("/v1/logs", makeOTLPLogsRequestHandler(config, sink), metricsMiddleware, auth.Middleware)
+	e.GET("/query", makeQueryRequestHandler(config, sink), metricsMiddleware, auth.Middleware)
+	e.GET("/tail", makeTailRequestHandler(config, sink.Tail()), metricsMiddleware, auth.Middleware)
 	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
 	// Start server
 	go func() {
 		logger.Infof("Starting to listen on %s…", config.Listen)
-		if err := e.Start(config.Listen); err != nil && err.Error() != "http: Server closed" {
+
+		var err error
+		if config.TLS.Enabled() {
+			err = e.StartTLS(config.Listen, config.TLS.Certificate, config.TLS.Key)
+		} else {
+			err = e.Start(config.Listen)
+		}
+
+		if err != nil && err.Error() != "http: Server closed" {
 			logger.Fatalf("Could not start server: %v", err)
 		}
 	}()
@@ -77,21 +172,39 @@ func main() {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
 
-	shutdown(e, sink, logger)
+	shutdown(e, forward, syslog, sink, retention, reloader, logger)
 }
 
-func shutdown(server *echo.Echo, sink *sink, logger logrus.FieldLogger) {
+func shutdown(server *echo.Echo, forward *forwardServer, syslog *syslogServer, sink *sink, retention *retention, reloader *reloader, logger logrus.FieldLogger) {
 	logger.Info("Received signal, shutting down…")
 
+	// the routes must not change while shutting down
+	reloader.Close()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// disconnect tail clients, as the server would otherwise wait for them
+	sink.Tail().Close()
+
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Fatalf("Failed to shutdown HTTP server: %v", err)
 	}
 
 	logger.Info("HTTP server stopped.")
 
+	if forward != nil {
+		forward.Close()
+		logger.Info("Forward listener stopped.")
+	}
+
+	if syslog != nil {
+		syslog.Close()
+		logger.Info("Syslog listener stopped.")
+	}
+
+	retention.Close()
+
 	logger.Info("Shutting down log processor…")
 	sink.Close()
 	logger.Info("Processor closed, exiting.")
@@ -101,31 +214,46 @@ func makeIngestRequestHandler(config *Config, sink *sink) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		req := c.Request()
 
-		// check content type
-		contentType := req.Header.Get(echo.HeaderContentType)
-		if !strings.Contains(contentType, "json") {
-			return c.String(http.StatusNotAcceptable, "Invalid Content-Type, ensure you send JSON payloads.")
-		}
+		defer req.Body.Close()
 
-		payload := Payload{
-			Tag: req.Header.Get(config.TagHeader),
+		body, err := requestBody(req, config.MaxBodySize)
+		if errors.Is(err, errBodyTooLarge) {
+			return bodyTooLargeResponse(c, config)
 		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Body could not be decompressed")
+		}
+		defer body.Close()
 
-		// decode payload
-		defer req.Body.Close()
-		err := json.NewDecoder(req.Body).Decode(&payload.Records)
+		// decode payload based on its content type
+		reader, err := newRecordReader(req.Header.Get(echo.HeaderContentType), body)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Body could not be parsed as JSON")
+			return c.String(http.StatusNotAcceptable, "Invalid Content-Type, ensure you send JSON or MessagePack payloads.")
 		}
 
-		// process payload
-		received, ingested := sink.AddPayload(payload)
-		recordsIngested.Add(float64(ingested))
-		recordsReceived.Add(float64(received))
+		// hand records to the sink in batches while decoding
+		for done := false; !done; {
+			payload := Payload{
+				Tag: req.Header.Get(config.TagHeader),
+			}
 
-		if err != nil {
-			log.Printf("Failed to store payload: %v", err)
-			return c.String(http.StatusInternalServerError, "Failed to store payload, check sink's logs.")
+			payload.Records, err = readRecords(reader, ingestBatchSize)
+			if err == io.EOF {
+				done = true
+			} else if errors.Is(err, errBodyTooLarge) {
+				return bodyTooLargeResponse(c, config)
+			} else if err != nil {
+				return c.String(http.StatusBadRequest, "Body could not be parsed")
+			}
+
+			if len(payload.Records) == 0 {
+				continue
+			}
+
+			// process payload
+			if err := ingestRequestPayload(c, sink, payload); err != nil {
+				return payloadErrorResponse(c, config, err)
+			}
 		}
 
 		// done
@@ -133,6 +261,54 @@ func makeIngestRequestHandler(config *Config, sink *sink) echo.HandlerFunc {
 	}
 }
 
+func defineFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.ConfigFile, "config", "", "path to a JSON or YAML (.yaml/.yml) configuration file (command line flags take precedence)")
+	flags.DurationVar(&config.ReloadInterval, "reload-interval", 10*time.Second, "how often to check the configuration, filter rules and routes files for changes (0 disables)")
+	flags.StringVar(&config.Target, "target", "records", "path to where incoming records should be written to")
+	flags.StringVar(&config.Pattern, "pattern", "%date%/%kubernetes_namespace_name%.json", "filename pattern to group records into files")
+	flags.StringVar(&config.Timezone, "timezone", "UTC", "time zone for the date and time placeholders in the filename pattern")
+	flags.StringVar(&config.Listen, "listen", "0.0.0.0:9095", "address and port to listen on")
+	flags.StringVar(&config.TLS.Certificate, "tls-cert", "", "path to a TLS certificate to serve HTTPS with (requires -tls-key)")
+	flags.StringVar(&config.TLS.Key, "tls-key", "", "path to the private key of the TLS certificate")
+	flags.StringVar(&config.Auth, "auth", "", "path to a JSON or YAML file with tokens and users allowed to ingest records (disabled if empty)")
+	flags.StringVar(&config.TagHeader, "tag-header", "Fluentbit-Tag", "name of the HTTP header carrying the fluent tag name")
+	flags.Int64Var(&config.MaxBodySize, "max-body-size", 16*1024*1024, "maximum size of request bodies in bytes, before and after decompression (0 disables)")
+	flags.StringVar(&config.FilterRules, "filter-rules", "", "path to a JSON or YAML file with include/exclude rules")
+	flags.StringVar(&config.Routes, "routes", "", "path to a JSON or YAML file with output routes (defaults to a single route using -target, -pattern etc.)")
+	flags.StringVar(&config.Output.Format, "format", "json", "format of output files (json, raw, logfmt, csv or parquet)")
+	flags.Var((*stringList)(&config.Output.Columns), "columns", "comma-separated record fields to write for the raw, logfmt and csv formats")
+	flags.Int64Var(&config.Output.Rotation.MaxBytes, "rotate-size", 0, "rotate files once they reach this many bytes (0 disables)")
+	flags.IntVar(&config.Output.Rotation.MaxRecords, "rotate-records", 0, "rotate files once they contain this many records (0 disables)")
+	flags.DurationVar(&config.Output.Rotation.MaxAge, "rotate-age", 0, "rotate files once they are older than this (0 disables)")
+	flags.StringVar(&config.Output.Compression, "compression", "none", "compression for output files (none, gzip or zstd)")
+	flags.StringVar(&config.Output.CompressionMode, "compression-mode", "stream", "compress files while writing (stream) or once they are closed (deferred)")
+	flags.IntVar(&config.Output.Flush.Size, "flush-size", 64*1024, "number of bytes to buffer per file before writing them (0 disables buffering)")
+	flags.DurationVar(&config.Output.Flush.Interval, "flush-interval", 1*time.Second, "maximum time records are buffered before they are written (0 disables)")
+	flags.StringVar(&config.Output.Flush.Fsync, "fsync", "never", "when to sync files to disk (never, batch or interval)")
+	flags.DurationVar(&config.Retention.MaxAge, "retention-max-age", 0, "remove files older than this (0 disables)")
+	flags.Int64Var(&config.Retention.MaxSize, "retention-max-size", 0, "remove the oldest files once the target directory is larger than this many bytes (0 disables)")
+	flags.StringVar(&config.Retention.Archive, "retention-archive", "", "move files to this directory instead of deleting them")
+	flags.DurationVar(&config.Retention.Interval, "retention-interval", 10*time.Minute, "how often to enforce the retention policy")
+	flags.IntVar(&config.TailBuffer, "tail-buffer", 1000, "number of records to buffer per tail client before dropping records")
+	flags.IntVar(&config.Workers, "workers", 4, "number of goroutines writing records to disk")
+	flags.DurationVar(&config.Writers.TTL, "writer-ttl", 1*time.Minute, "close files after they have not been written to for this long")
+	flags.DurationVar(&config.Writers.GCInterval, "gc-interval", 5*time.Minute, "how often to close expired files")
+	flags.IntVar(&config.Writers.MaxOpen, "max-open-writers", 0, "maximum number of open files, closing the least recently used ones first (0 disables)")
+	flags.IntVar(&config.Queue.Size, "queue-size", 10000, "maximum number of records waiting to be written")
+	flags.StringVar(&config.Queue.Policy, "queue-policy", "block", "what to do when the queue is full (block, reject or drop-oldest)")
+	flags.DurationVar(&config.Queue.Timeout, "queue-timeout", 10*time.Second, "how long to wait for free queue capacity when using the block policy")
+	flags.DurationVar(&config.Queue.RetryAfter, "retry-after", 10*time.Second, "Retry-After duration sent to clients when the queue is full")
+	flags.BoolVar(&config.SyncWrites, "sync-writes", false, "wait until records have been written before acknowledging payloads")
+	flags.StringVar(&config.WAL.Directory, "wal-dir", "", "directory for the write-ahead log (disabled if empty)")
+	flags.Int64Var(&config.WAL.SegmentSize, "wal-segment-size", 64*1024*1024, "maximum size of a write-ahead log segment in bytes")
+	flags.BoolVar(&config.WAL.Sync, "wal-sync", true, "fsync the write-ahead log before acknowledging payloads")
+	flags.StringVar(&config.Forward.Listen, "forward-listen", "", "address and port to accept the Fluent Forward protocol on (disabled if empty)")
+	flags.StringVar(&config.Forward.SharedKey, "forward-shared-key", "", "shared key Forward clients must authenticate with (optional)")
+	flags.StringVar(&config.Syslog.UDP, "syslog-udp", "", "address and port to receive syslog messages via UDP on (disabled if empty)")
+	flags.StringVar(&config.Syslog.TCP, "syslog-tcp", "", "address and port to receive syslog messages via TCP on (disabled if empty)")
+	flags.BoolVar(&config.Verbose, "verbose", false, "incrases logging verbosity")
+}
+
 func makeLogger(config *Config) logrus.FieldLogger {
 	logger := logrus.New()
 	logger.SetLevel(logrus.InfoLevel)
@@ -143,3 +319,20 @@ func makeLogger(config *Config) logrus.FieldLogger {
 
 	return logger
 }
+
+// stringList is a flag.Value for comma-separated lists.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if value == "" {
+		*l = nil
+		return nil
+	}
+
+	*l = strings.Split(value, ",")
+	return nil
+}
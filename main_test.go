@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func ingestTestBody(records int, trailer string) string {
+	body := strings.Builder{}
+
+	for i := 0; i < records; i++ {
+		body.WriteString(`{"log":"hello","kubernetes":{"namespace_name":"default"}}` + "\n")
+	}
+
+	body.WriteString(trailer)
+
+	return body.String()
+}
+
+func gzipTestBody(t *testing.T, body string) string {
+	buf := bytes.Buffer{}
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+
+	return buf.String()
+}
+
+func TestIngestBatches(t *testing.T) {
+	// every record in ingestTestBody takes 58 bytes
+	const recordSize = 58
+
+	testcases := []struct {
+		name      string
+		args      []string
+		body      string
+		gzip      bool
+		principal *principal
+		status    int
+		queued    int
+	}{
+		{
+			name:   "valid body",
+			body:   ingestTestBody(2500, ""),
+			status: http.StatusOK,
+			queued: 2500,
+		},
+		{
+			name:   "gzip compressed body",
+			body:   ingestTestBody(2500, ""),
+			gzip:   true,
+			status: http.StatusOK,
+			queued: 2500,
+		},
+		{
+			name:   "parse error at the end",
+			body:   ingestTestBody(2500, "{broken"),
+			status: http.StatusBadRequest,
+			queued: 2 * ingestBatchSize,
+		},
+		{
+			name:      "forbidden record at the end",
+			body:      ingestTestBody(2500, `{"log":"hello","kubernetes":{"namespace_name":"kube-system"}}`),
+			principal: &principal{name: "test", scope: AuthScope{Namespaces: []string{"default"}}},
+			status:    http.StatusForbidden,
+			queued:    2 * ingestBatchSize,
+		},
+		{
+			name:   "body at the limit",
+			args:   []string{"-max-body-size", "5800"},
+			body:   ingestTestBody(100, ""),
+			status: http.StatusOK,
+			queued: 100,
+		},
+		{
+			name:   "body too large",
+			args:   []string{"-max-body-size", "5799"},
+			body:   ingestTestBody(100, ""),
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "decompressed body too large",
+			args:   []string{"-max-body-size", "10000"},
+			body:   ingestTestBody(2500, ""),
+			gzip:   true,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "too large after several batches",
+			args:   []string{"-max-body-size", "200000"},
+			body:   ingestTestBody(5000, ""),
+			status: http.StatusRequestEntityTooLarge,
+			queued: 200000 / recordSize / ingestBatchSize * ingestBatchSize,
+		},
+		{
+			name:   "no limit",
+			args:   []string{"-max-body-size", "0"},
+			body:   ingestTestBody(2500, ""),
+			gzip:   true,
+			status: http.StatusOK,
+			queued: 2500,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			config := testConfig(t, testcase.args...)
+			s := testSink(t, config)
+
+			body := testcase.body
+			if testcase.gzip {
+				body = gzipTestBody(t, body)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, "application/json")
+			if testcase.gzip {
+				req.Header.Set(echo.HeaderContentEncoding, "gzip")
+			}
+
+			rec := httptest.NewRecorder()
+
+			c := echo.New().NewContext(req, rec)
+			if testcase.principal != nil {
+				c.Set(principalKey, testcase.principal)
+			}
+
+			if err := makeIngestRequestHandler(config, s)(c); err != nil {
+				t.Fatalf("Handler failed: %v", err)
+			}
+
+			if rec.Code != testcase.status {
+				t.Errorf("Expected status %d, got %d.", testcase.status, rec.Code)
+			}
+
+			if queued := s.capacity.Pending(); queued != testcase.queued {
+				t.Errorf("Expected %d queued records, got %d.", testcase.queued, queued)
+			}
+		})
+	}
+}
@@ -23,6 +23,123 @@ var (
 		Name: "bunker_ingested_records_total",
 		Help: "The total number of ingested records",
 	})
+
+	rotations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_rotations_total",
+		Help: "The total number of rotated files",
+	})
+
+	targetBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bunker_target_bytes",
+		Help: "The total size of all files in the target directory",
+	})
+
+	retentionDeletedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_retention_deleted_files_total",
+		Help: "The total number of files deleted by the retention policy",
+	})
+
+	retentionDeletedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_retention_deleted_bytes_total",
+		Help: "The total size of files deleted by the retention policy",
+	})
+
+	retentionArchivedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_retention_archived_files_total",
+		Help: "The total number of files archived by the retention policy",
+	})
+
+	retentionArchivedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_retention_archived_bytes_total",
+		Help: "The total size of files archived by the retention policy",
+	})
+
+	tailSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bunker_tail_subscribers",
+		Help: "The number of currently connected tail clients",
+	})
+
+	tailDroppedRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_tail_dropped_records_total",
+		Help: "The total number of records not sent to tail clients because their buffer was full",
+	})
+
+	queueLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bunker_queue_latency_seconds",
+		Help:    "The time records spent waiting in the queue",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	queueRejectedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_queue_rejected_records_total",
+		Help: "The total number of records rejected because the queue was full",
+	}, []string{"reason"})
+
+	queueDroppedRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_queue_dropped_records_total",
+		Help: "The total number of queued records dropped to make room for new ones",
+	})
+
+	forwardConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bunker_forward_connections",
+		Help: "The number of currently open Forward protocol connections",
+	})
+
+	walSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bunker_wal_segments",
+		Help: "The number of write-ahead log segments on disk",
+	})
+
+	walReplayedRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_wal_replayed_records_total",
+		Help: "The total number of records replayed from the write-ahead log",
+	})
+
+	invalidRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_invalid_records_total",
+		Help: "The total number of received records dropped because they could not be converted, by input",
+	}, []string{"input"})
+
+	unroutedRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_unrouted_records_total",
+		Help: "The total number of records that did not match any route",
+	})
+
+	failedWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_failed_writes_total",
+		Help: "The total number of records that could not be written, by reason",
+	}, []string{"reason"})
+
+	evictedWriters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_evicted_writers_total",
+		Help: "The total number of file writers closed to stay below the maximum number of open files",
+	})
+
+	flushes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bunker_flushes_total",
+		Help: "The total number of times buffered records were written to files",
+	})
+
+	fsyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bunker_fsync_duration_seconds",
+		Help:    "The time it took to sync files to disk",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	authRejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_auth_rejected_requests_total",
+		Help: "The total number of requests rejected by authentication, by reason",
+	}, []string{"reason"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_config_reloads_total",
+		Help: "The total number of configuration reloads, by result",
+	}, []string{"result"})
+
+	filterRuleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bunker_filter_rule_hits_total",
+		Help: "The total number of records matched by each filter rule",
+	}, []string{"rule", "action"})
 )
 
 func metricsMiddleware(handler echo.HandlerFunc) echo.HandlerFunc {
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// This is a minimal MessagePack implementation, sufficient to read the
+// event streams sent by fluent-bit and fluentd. Strings and binary data are
+// both decoded as strings, maps always have string keys and the
+// timestamp extension types are decoded as time.Time.
+
+const (
+	// msgpackMaxLength limits the size of a single string, array or map,
+	// so that corrupt input cannot make us allocate huge amounts of memory.
+	msgpackMaxLength = 16 * 1024 * 1024
+
+	// msgpackPreallocLength is the largest string that is allocated
+	// before reading it. Longer strings grow with the data actually
+	// received, as their length cannot be trusted.
+	msgpackPreallocLength = 64 * 1024
+
+	// msgpackMaxDepth limits how deeply arrays and maps can be nested,
+	// so that corrupt input cannot exhaust the stack.
+	msgpackMaxDepth = 64
+
+	// msgpackExtEventTime is fluentd's EventTime, with nanosecond precision.
+	msgpackExtEventTime = 0
+
+	// msgpackExtTimestamp is the standard MessagePack timestamp.
+	msgpackExtTimestamp = -1
+)
+
+type msgpackDecoder struct {
+	reader *bufio.Reader
+	depth  int
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+
+	return &msgpackDecoder{
+		reader: reader,
+	}
+}
+
+// Decode reads the next value. It returns io.EOF if the input ends
+// before a new value, and io.ErrUnexpectedEOF if it ends within one.
+func (d *msgpackDecoder) Decode() (interface{}, error) {
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := d.decodeValue(b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return value, err
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decodeValue(b)
+}
+
+func (d *msgpackDecoder) decodeValue(b byte) (interface{}, error) {
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b & 0x0f))
+
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b & 0x0f))
+
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+
+	case 0xc2:
+		return false, nil
+
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xd9: // bin 8, str 8
+		n, err := d.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeString(int(n))
+
+	case 0xc5, 0xda: // bin 16, str 16
+		n, err := d.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeString(int(n))
+
+	case 0xc6, 0xdb: // bin 32, str 32
+		n, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeString(int(n))
+
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.readUint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeExt(int(n))
+
+	case 0xca:
+		bits, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(uint32(bits))), nil
+
+	case 0xcb:
+		bits, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(bits), nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		n, err := d.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+
+		return int64(n), nil
+
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.decodeExt(1 << (b - 0xd4))
+
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.readUint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeArray(int(n))
+
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.readUint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeMap(int(n))
+	}
+
+	return nil, fmt.Errorf("invalid type byte 0x%02x", b)
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.reader, buf[8-size:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	if n > msgpackMaxLength {
+		return nil, fmt.Errorf("value too large (%d bytes)", n)
+	}
+
+	if n <= msgpackPreallocLength {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(d.reader, buf); err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	}
+
+	buf := bytes.Buffer{}
+	if _, err := io.CopyN(&buf, d.reader, int64(n)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	buf, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(buf), nil
+}
+
+// enter is called before decoding the elements of an array or map and
+// must be followed by a call to leave.
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= msgpackMaxDepth {
+		return fmt.Errorf("values nested too deeply (more than %d levels)", msgpackMaxDepth)
+	}
+
+	d.depth++
+
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > msgpackMaxLength {
+		return nil, fmt.Errorf("array too large (%d elements)", n)
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	array := make([]interface{}, 0)
+
+	for i := 0; i < n; i++ {
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		array = append(array, value)
+	}
+
+	return array, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if n > msgpackMaxLength {
+		return nil, fmt.Errorf("map too large (%d elements)", n)
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	m := make(map[string]interface{})
+
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := key.(string)
+		if !ok {
+			name = fmt.Sprint(key)
+		}
+
+		m[name] = value
+	}
+
+	return m, nil
+}
+
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	typ, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch int8(typ) {
+	case msgpackExtEventTime:
+		if n != 8 {
+			return nil, fmt.Errorf("invalid EventTime length %d", n)
+		}
+
+		sec := binary.BigEndian.Uint32(data[:4])
+		nsec := binary.BigEndian.Uint32(data[4:])
+
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+
+	case msgpackExtTimestamp:
+		switch n {
+		case 4:
+			return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+
+		case 8:
+			value := binary.BigEndian.Uint64(data)
+			return time.Unix(int64(value&0x3ffffffff), int64(value>>34)).UTC(), nil
+
+		case 12:
+			nsec := binary.BigEndian.Uint32(data[:4])
+			sec := binary.BigEndian.Uint64(data[4:])
+			return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+		}
+
+		return nil, fmt.Errorf("invalid timestamp length %d", n)
+	}
+
+	return nil, fmt.Errorf("unsupported extension type %d", int8(typ))
+}
+
+// msgpackRecordReader reads a stream of fluent-bit events.
+type msgpackRecordReader struct {
+	decoder *msgpackDecoder
+}
+
+func newMsgpackRecordReader(r io.Reader) *msgpackRecordReader {
+	return &msgpackRecordReader{
+		decoder: newMsgpackDecoder(r),
+	}
+}
+
+func (r *msgpackRecordReader) Next() (*Record, error) {
+	event, err := r.decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	return fluentEvent(event)
+}
+
+// decodeMsgpackEvents reads all events from a stream.
+func decodeMsgpackEvents(r io.Reader) ([]*Record, error) {
+	records, err := readRecords(newMsgpackRecordReader(r), -1)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return records, err
+}
+
+// fluentEvent converts an event, which is either [timestamp, record]
+// or [[timestamp, metadata], record], into a record.
+func fluentEvent(event interface{}) (*Record, error) {
+	entry, ok := event.([]interface{})
+	if !ok || len(entry) != 2 {
+		return nil, errors.New("event is not a [timestamp, record] array")
+	}
+
+	timestamp := entry[0]
+
+	// fluent-bit 2.1+ adds metadata next to the timestamp
+	if header, ok := timestamp.([]interface{}); ok {
+		if len(header) == 0 {
+			return nil, errors.New("event header is empty")
+		}
+
+		timestamp = header[0]
+	}
+
+	return fluentRecord(timestamp, entry[1])
+}
+
+// fluentRecord creates a record from a timestamp and a map, storing
+// the timestamp in the "date" field like fluent-bit's JSON format
+// does, unless the map already contains a date.
+func fluentRecord(timestamp interface{}, fields interface{}) (*Record, error) {
+	m, ok := fields.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("record is not a map")
+	}
+
+	date, err := fluentTime(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := newRecord(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, exists := record.Field("date"); !exists {
+		micros := date.Round(time.Microsecond).UnixNano() / int64(time.Microsecond)
+		seconds := strconv.FormatFloat(float64(micros)/1e6, 'f', -1, 64)
+
+		if err := record.SetField("date", json.Number(seconds)); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+func fluentTime(timestamp interface{}) (time.Time, error) {
+	switch t := timestamp.(type) {
+	case time.Time:
+		return t, nil
+
+	case int64:
+		return time.Unix(t, 0).UTC(), nil
+
+	case uint64:
+		return time.Unix(int64(t), 0).UTC(), nil
+
+	case float64:
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp %v", timestamp)
+}
+
+// encodeMsgpack encodes the few types needed to respond to clients:
+// nil, bool, int, string, []byte, []interface{} and
+// map[string]interface{}.
+func encodeMsgpack(value interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	if err := appendMsgpack(&buf, value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func appendMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+
+	case int:
+		if v >= 0 && v <= 0x7f {
+			buf.WriteByte(byte(v))
+		} else {
+			buf.WriteByte(0xd3)
+			writeUint(buf, uint64(v), 8)
+		}
+
+	case string:
+		switch n := len(v); {
+		case n <= 31:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= 0xff:
+			buf.WriteByte(0xd9)
+			writeUint(buf, uint64(n), 1)
+		case n <= 0xffff:
+			buf.WriteByte(0xda)
+			writeUint(buf, uint64(n), 2)
+		default:
+			buf.WriteByte(0xdb)
+			writeUint(buf, uint64(n), 4)
+		}
+
+		buf.WriteString(v)
+
+	case []byte:
+		switch n := len(v); {
+		case n <= 0xff:
+			buf.WriteByte(0xc4)
+			writeUint(buf, uint64(n), 1)
+		case n <= 0xffff:
+			buf.WriteByte(0xc5)
+			writeUint(buf, uint64(n), 2)
+		default:
+			buf.WriteByte(0xc6)
+			writeUint(buf, uint64(n), 4)
+		}
+
+		buf.Write(v)
+
+	case []interface{}:
+		switch n := len(v); {
+		case n <= 15:
+			buf.WriteByte(0x90 | byte(n))
+		case n <= 0xffff:
+			buf.WriteByte(0xdc)
+			writeUint(buf, uint64(n), 2)
+		default:
+			buf.WriteByte(0xdd)
+			writeUint(buf, uint64(n), 4)
+		}
+
+		for _, item := range v {
+			if err := appendMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		switch n := len(v); {
+		case n <= 15:
+			buf.WriteByte(0x80 | byte(n))
+		case n <= 0xffff:
+			buf.WriteByte(0xde)
+			writeUint(buf, uint64(n), 2)
+		default:
+			buf.WriteByte(0xdf)
+			writeUint(buf, uint64(n), 4)
+		}
+
+		// sort keys to make the output deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			appendMsgpack(buf, key)
+
+			if err := appendMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("cannot encode %T", value)
+	}
+
+	return nil
+}
+
+func writeUint(buf *bytes.Buffer, value uint64, size int) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	buf.Write(b[8-size:])
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackDecodeEvent(t *testing.T) {
+	// [[EventTime, {}], {"log": "hello", "count": 3}]
+	input := []byte{
+		0x92,
+		0x92, 0xd7, 0x00, 0x5e, 0x0b, 0xe1, 0x00, 0x00, 0x00, 0x00, 0x64, 0x80,
+		0x82, 0xa3, 'l', 'o', 'g', 0xa5, 'h', 'e', 'l', 'l', 'o', 0xa5, 'c', 'o', 'u', 'n', 't', 0x03,
+	}
+
+	records, err := decodeMsgpackEvents(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("Failed to decode events: %v", err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d.", len(records))
+	}
+
+	record := records[0]
+
+	if record.Log != "hello" {
+		t.Errorf("Expected log %q, got %q.", "hello", record.Log)
+	}
+
+	// 100ns are rounded to the nearest microsecond
+	date, _ := record.Field("date")
+	if expected := "1577836800"; string(date) != expected {
+		t.Errorf("Expected date %s, got %s.", expected, date)
+	}
+}
+
+func TestMsgpackMaxDepth(t *testing.T) {
+	testcases := []struct {
+		name  string
+		depth int
+		valid bool
+	}{
+		{name: "within limit", depth: msgpackMaxDepth, valid: true},
+		{name: "too deep", depth: msgpackMaxDepth + 1, valid: false},
+		{name: "way too deep", depth: 20 * 1024 * 1024, valid: false},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			// [[[...[nil]...]]]
+			input := append(bytes.Repeat([]byte{0x91}, testcase.depth), 0xc0)
+
+			_, err := newMsgpackDecoder(bytes.NewReader(input)).Decode()
+
+			if testcase.valid && err != nil {
+				t.Fatalf("Expected value to be decoded, got %v.", err)
+			}
+
+			if !testcase.valid && (err == nil || !strings.Contains(err.Error(), "nested too deeply")) {
+				t.Fatalf("Expected nesting error, got %v.", err)
+			}
+		})
+	}
+}
+
+func TestMsgpackMaxDepthMaps(t *testing.T) {
+	// {"a": {"a": ... }}
+	input := bytes.Repeat([]byte{0x81, 0xa1, 'a'}, msgpackMaxDepth+1)
+	input = append(input, 0xc0)
+
+	if _, err := newMsgpackDecoder(bytes.NewReader(input)).Decode(); err == nil {
+		t.Fatal("Expected nesting error, got nil.")
+	}
+
+	// the depth must be reset after an error
+	decoder := newMsgpackDecoder(bytes.NewReader(append(input, 0x91, 0x91, 0xc0)))
+	if _, err := decoder.Decode(); err == nil {
+		t.Fatal("Expected nesting error, got nil.")
+	}
+
+	if decoder.depth != 0 {
+		t.Fatalf("Expected depth to be reset, got %d.", decoder.depth)
+	}
+}
+
+func TestMsgpackLongStrings(t *testing.T) {
+	// str 32 header for the given length
+	header := func(n int) []byte {
+		return []byte{0xdb, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	value := strings.Repeat("x", msgpackPreallocLength*3)
+
+	decoded, err := newMsgpackDecoder(bytes.NewReader(append(header(len(value)), value...))).Decode()
+	if err != nil {
+		t.Fatalf("Failed to decode long string: %v", err)
+	}
+
+	if decoded != value {
+		t.Fatalf("Expected long string to be decoded, got %d bytes.", len(decoded.(string)))
+	}
+
+	if _, err := newMsgpackDecoder(bytes.NewReader(header(msgpackMaxLength + 1))).Decode(); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Expected size error, got %v.", err)
+	}
+
+	// a header claiming the maximum length must not allocate it upfront
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	allocated := stats.TotalAlloc
+
+	_, err = newMsgpackDecoder(bytes.NewReader(append(header(msgpackMaxLength), "short"...))).Decode()
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, got %v.", err)
+	}
+
+	runtime.ReadMemStats(&stats)
+	if allocated := stats.TotalAlloc - allocated; allocated > msgpackMaxLength/16 {
+		t.Errorf("Expected truncated input not to allocate the claimed length, allocated %d bytes.", allocated)
+	}
+}
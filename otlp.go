@@ -0,0 +1,783 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// otlpMaxDepth limits how deeply arrays and key-value lists can be
+// nested in attributes and bodies.
+const otlpMaxDepth = 64
+
+var errOTLPTooDeep = fmt.Errorf("values nested too deeply (more than %d levels)", otlpMaxDepth)
+
+// otlpLogRecord is a single OpenTelemetry log record, together with
+// the attributes of the resource that emitted it.
+type otlpLogRecord struct {
+	resource       map[string]interface{}
+	scope          string
+	timestamp      uint64
+	observed       uint64
+	severityNumber int64
+	severityText   string
+	body           interface{}
+	attributes     map[string]interface{}
+	traceID        string
+	spanID         string
+}
+
+// makeOTLPLogsRequestHandler implements the OTLP/HTTP logs receiver
+// (/v1/logs), accepting both the protobuf and the JSON encoding.
+func makeOTLPLogsRequestHandler(config *Config, sink *sink) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		defer req.Body.Close()
+
+		useJSON := strings.Contains(req.Header.Get(echo.HeaderContentType), "json")
+
+		body, err := readRequestBody(req, config.MaxBodySize)
+		if errors.Is(err, errBodyTooLarge) {
+			message := fmt.Sprintf("Body must not be larger than %d bytes.", config.MaxBodySize)
+			return otlpErrorResponse(c, useJSON, http.StatusRequestEntityTooLarge, otlpResourceExhausted, message)
+		}
+		if err != nil {
+			return otlpErrorResponse(c, useJSON, http.StatusBadRequest, otlpInvalidArgument, "Body could not be read")
+		}
+
+		var logs []otlpLogRecord
+
+		if useJSON {
+			logs, err = decodeOTLPJSON(body)
+		} else {
+			logs, err = decodeOTLPProtobuf(body)
+		}
+
+		if err != nil {
+			return otlpErrorResponse(c, useJSON, http.StatusBadRequest, otlpInvalidArgument, fmt.Sprintf("Invalid export request: %v", err))
+		}
+
+		payload := Payload{
+			Tag: req.Header.Get(config.TagHeader),
+		}
+
+		// a single broken log record must not reject the whole request
+		for _, log := range logs {
+			record, err := otlpRecord(log)
+			if err != nil {
+				invalidRecords.WithLabelValues("otlp").Inc()
+				continue
+			}
+
+			payload.Records = append(payload.Records, record)
+		}
+
+		if err := ingestRequestPayload(c, sink, payload); err != nil {
+			return otlpPayloadErrorResponse(c, config, useJSON, err)
+		}
+
+		// an empty ExportLogsServiceResponse means full success
+		if useJSON {
+			return c.JSONBlob(http.StatusOK, []byte("{}"))
+		}
+
+		return c.Blob(http.StatusOK, "application/x-protobuf", nil)
+	}
+}
+
+// gRPC status codes used in error responses, see
+// https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+const (
+	otlpInvalidArgument   = 3
+	otlpPermissionDenied  = 7
+	otlpResourceExhausted = 8
+	otlpInternal          = 13
+	otlpUnavailable       = 14
+)
+
+// otlpErrorResponse sends a google.rpc.Status, as required by the OTLP
+// spec, in the same encoding as the request:
+//
+//	message Status { int32 code = 1; string message = 2; repeated Any details = 3; }
+func otlpErrorResponse(c echo.Context, useJSON bool, httpStatus int, code int, message string) error {
+	if useJSON {
+		return c.JSON(httpStatus, map[string]interface{}{
+			"code":    code,
+			"message": message,
+		})
+	}
+
+	status := appendProtoVarint(nil, 1, uint64(code))
+	status = appendProtoBytes(status, 2, []byte(message))
+
+	return c.Blob(httpStatus, "application/x-protobuf", status)
+}
+
+// otlpPayloadErrorResponse is payloadErrorResponse for OTLP clients.
+func otlpPayloadErrorResponse(c echo.Context, config *Config, useJSON bool, err error) error {
+	var scopeErr *scopeError
+	if errors.As(err, &scopeErr) {
+		return otlpErrorResponse(c, useJSON, http.StatusForbidden, otlpPermissionDenied, fmt.Sprintf("Forbidden: %v.", err))
+	}
+
+	if errors.Is(err, errQueueFull) {
+		c.Response().Header().Set("Retry-After", fmt.Sprintf("%.0f", config.Queue.RetryAfter.Seconds()))
+		return otlpErrorResponse(c, useJSON, http.StatusServiceUnavailable, otlpUnavailable, "Queue is full, try again later.")
+	}
+
+	log.Printf("Failed to store payload: %v", err)
+	return otlpErrorResponse(c, useJSON, http.StatusInternalServerError, otlpInternal, "Failed to store payload, check sink's logs.")
+}
+
+// otlpRecord maps the Kubernetes resource attributes (as set by the
+// collector's k8sattributes processor) onto the Kubernetes metadata,
+// so that -pattern and the filter work like for fluent-bit records.
+// A string body becomes the log, other bodies are kept in "body".
+func otlpRecord(log otlpLogRecord) (*Record, error) {
+	kubernetes := map[string]interface{}{}
+	labels := map[string]string{}
+	annotations := map[string]string{}
+	resource := map[string]interface{}{}
+
+	for name, value := range log.resource {
+		s, isString := value.(string)
+
+		switch {
+		case isString && name == "k8s.namespace.name":
+			kubernetes["namespace_name"] = s
+		case isString && name == "k8s.pod.name":
+			kubernetes["pod_name"] = s
+		case isString && name == "k8s.pod.uid":
+			kubernetes["pod_id"] = s
+		case isString && name == "k8s.container.name":
+			kubernetes["container_name"] = s
+		case isString && name == "k8s.node.name":
+			kubernetes["host"] = s
+		case isString && name == "container.id":
+			kubernetes["docker_id"] = s
+		case isString && strings.HasPrefix(name, "k8s.pod.labels."):
+			labels[strings.TrimPrefix(name, "k8s.pod.labels.")] = s
+		case isString && strings.HasPrefix(name, "k8s.pod.annotations."):
+			annotations[strings.TrimPrefix(name, "k8s.pod.annotations.")] = s
+		default:
+			resource[name] = value
+		}
+	}
+
+	if len(labels) > 0 {
+		kubernetes["labels"] = labels
+	}
+
+	if len(annotations) > 0 {
+		kubernetes["annotations"] = annotations
+	}
+
+	timestamp := log.timestamp
+	if timestamp == 0 {
+		timestamp = log.observed
+	}
+
+	date := time.Now()
+	if timestamp > 0 {
+		date = time.Unix(0, int64(timestamp))
+	}
+
+	fields := map[string]interface{}{
+		"date": date.UTC().Format(time.RFC3339Nano),
+	}
+
+	if len(kubernetes) > 0 {
+		fields["kubernetes"] = kubernetes
+	}
+
+	if body, ok := log.body.(string); ok {
+		fields["log"] = body
+	} else if log.body != nil {
+		fields["body"] = log.body
+	}
+
+	optional := map[string]interface{}{
+		"resource":   resource,
+		"attributes": log.attributes,
+		"scope":      log.scope,
+		"severity":   log.severityText,
+		"trace_id":   log.traceID,
+		"span_id":    log.spanID,
+	}
+
+	for name, value := range optional {
+		switch v := value.(type) {
+		case string:
+			if v != "" {
+				fields[name] = v
+			}
+		case map[string]interface{}:
+			if len(v) > 0 {
+				fields[name] = v
+			}
+		}
+	}
+
+	if log.severityNumber != 0 {
+		fields["severity_number"] = log.severityNumber
+	}
+
+	return newRecord(fields)
+}
+
+// decodeOTLPProtobuf decodes an ExportLogsServiceRequest:
+//
+//	message ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	message ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	message InstrumentationScope { string name = 1; }
+func decodeOTLPProtobuf(data []byte) ([]otlpLogRecord, error) {
+	logs := make([]otlpLogRecord, 0)
+
+	err := forEachProtoField(data, func(r *protoReader, field int, wireType int) error {
+		if field != 1 || wireType != protoBytes {
+			return r.Skip(wireType)
+		}
+
+		resourceLogs, err := r.Bytes()
+		if err != nil {
+			return err
+		}
+
+		resource := map[string]interface{}{}
+		scopeLogs := make([][]byte, 0)
+
+		// the resource can come after the scope logs, so collect those first
+		err = forEachProtoField(resourceLogs, func(r *protoReader, field int, wireType int) error {
+			if wireType != protoBytes || (field != 1 && field != 2) {
+				return r.Skip(wireType)
+			}
+
+			value, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+
+			if field == 2 {
+				scopeLogs = append(scopeLogs, value)
+				return nil
+			}
+
+			return forEachProtoField(value, func(r *protoReader, field int, wireType int) error {
+				if field != 1 || wireType != protoBytes {
+					return r.Skip(wireType)
+				}
+
+				return decodeOTLPKeyValue(r, resource, 0)
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range scopeLogs {
+			scoped, err := decodeOTLPScopeLogs(scope, resource)
+			if err != nil {
+				return err
+			}
+
+			logs = append(logs, scoped...)
+		}
+
+		return nil
+	})
+
+	return logs, err
+}
+
+func decodeOTLPScopeLogs(data []byte, resource map[string]interface{}) ([]otlpLogRecord, error) {
+	logs := make([]otlpLogRecord, 0)
+	scope := ""
+
+	err := forEachProtoField(data, func(r *protoReader, field int, wireType int) error {
+		if wireType != protoBytes || (field != 1 && field != 2) {
+			return r.Skip(wireType)
+		}
+
+		value, err := r.Bytes()
+		if err != nil {
+			return err
+		}
+
+		if field == 1 {
+			return forEachProtoField(value, func(r *protoReader, field int, wireType int) error {
+				if field != 1 || wireType != protoBytes {
+					return r.Skip(wireType)
+				}
+
+				name, err := r.Bytes()
+				scope = string(name)
+
+				return err
+			})
+		}
+
+		log, err := decodeOTLPLogRecord(value)
+		if err != nil {
+			return err
+		}
+
+		log.resource = resource
+		logs = append(logs, log)
+
+		return nil
+	})
+
+	for i := range logs {
+		logs[i].scope = scope
+	}
+
+	return logs, err
+}
+
+//	message LogRecord {
+//	  fixed64 time_unix_nano = 1;
+//	  SeverityNumber severity_number = 2;
+//	  string severity_text = 3;
+//	  AnyValue body = 5;
+//	  repeated KeyValue attributes = 6;
+//	  bytes trace_id = 9;
+//	  bytes span_id = 10;
+//	  fixed64 observed_time_unix_nano = 11;
+//	}
+func decodeOTLPLogRecord(data []byte) (otlpLogRecord, error) {
+	log := otlpLogRecord{
+		attributes: map[string]interface{}{},
+	}
+
+	err := forEachProtoField(data, func(r *protoReader, field int, wireType int) error {
+		var err error
+
+		switch {
+		case field == 1 && wireType == protoFixed64:
+			log.timestamp, err = r.Fixed64()
+
+		case field == 11 && wireType == protoFixed64:
+			log.observed, err = r.Fixed64()
+
+		case field == 2 && wireType == protoVarint:
+			var number uint64
+
+			number, err = r.Varint()
+			log.severityNumber = int64(number)
+
+		case field == 3 && wireType == protoBytes:
+			var text []byte
+
+			text, err = r.Bytes()
+			log.severityText = string(text)
+
+		case field == 5 && wireType == protoBytes:
+			var value []byte
+
+			value, err = r.Bytes()
+			if err == nil {
+				log.body, err = decodeOTLPAnyValue(value, 0)
+			}
+
+		case field == 6 && wireType == protoBytes:
+			err = decodeOTLPKeyValue(r, log.attributes, 0)
+
+		case (field == 9 || field == 10) && wireType == protoBytes:
+			var id []byte
+
+			id, err = r.Bytes()
+
+			if field == 9 {
+				log.traceID = hex.EncodeToString(id)
+			} else {
+				log.spanID = hex.EncodeToString(id)
+			}
+
+		default:
+			err = r.Skip(wireType)
+		}
+
+		return err
+	})
+
+	return log, err
+}
+
+// decodeOTLPKeyValue reads a KeyValue { string key = 1; AnyValue value = 2; }
+// and adds it to the map.
+func decodeOTLPKeyValue(r *protoReader, m map[string]interface{}, depth int) error {
+	data, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var (
+		key   string
+		value interface{}
+	)
+
+	err = forEachProtoField(data, func(r *protoReader, field int, wireType int) error {
+		if wireType != protoBytes || (field != 1 && field != 2) {
+			return r.Skip(wireType)
+		}
+
+		b, err := r.Bytes()
+		if err != nil {
+			return err
+		}
+
+		if field == 1 {
+			key = string(b)
+		} else {
+			value, err = decodeOTLPAnyValue(b, depth)
+		}
+
+		return err
+	})
+
+	m[key] = value
+
+	return err
+}
+
+//	message AnyValue {
+//	  oneof value {
+//	    string string_value = 1;
+//	    bool bool_value = 2;
+//	    int64 int_value = 3;
+//	    double double_value = 4;
+//	    ArrayValue array_value = 5;   // { repeated AnyValue values = 1; }
+//	    KeyValueList kvlist_value = 6; // { repeated KeyValue values = 1; }
+//	    bytes bytes_value = 7;
+//	  }
+//	}
+//
+// depth is the number of arrays and key-value lists the value is
+// nested in, at most otlpMaxDepth are allowed.
+func decodeOTLPAnyValue(data []byte, depth int) (interface{}, error) {
+	if depth > otlpMaxDepth {
+		return nil, errOTLPTooDeep
+	}
+
+	var value interface{}
+
+	err := forEachProtoField(data, func(r *protoReader, field int, wireType int) error {
+		switch {
+		case (field == 1 || field == 7) && wireType == protoBytes:
+			b, err := r.Bytes()
+			if field == 1 {
+				value = string(b)
+			} else {
+				value = b
+			}
+
+			return err
+
+		case (field == 2 || field == 3) && wireType == protoVarint:
+			n, err := r.Varint()
+			if field == 2 {
+				value = n != 0
+			} else {
+				value = int64(n)
+			}
+
+			return err
+
+		case field == 4 && wireType == protoFixed64:
+			bits, err := r.Fixed64()
+			value = otlpDouble(math.Float64frombits(bits))
+
+			return err
+
+		case field == 5 && wireType == protoBytes:
+			b, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+
+			array := make([]interface{}, 0)
+			value = array
+
+			return forEachProtoField(b, func(r *protoReader, field int, wireType int) error {
+				if field != 1 || wireType != protoBytes {
+					return r.Skip(wireType)
+				}
+
+				b, err := r.Bytes()
+				if err != nil {
+					return err
+				}
+
+				item, err := decodeOTLPAnyValue(b, depth+1)
+				array = append(array, item)
+				value = array
+
+				return err
+			})
+
+		case field == 6 && wireType == protoBytes:
+			b, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+
+			kvlist := map[string]interface{}{}
+			value = kvlist
+
+			return forEachProtoField(b, func(r *protoReader, field int, wireType int) error {
+				if field != 1 || wireType != protoBytes {
+					return r.Skip(wireType)
+				}
+
+				return decodeOTLPKeyValue(r, kvlist, depth+1)
+			})
+		}
+
+		return r.Skip(wireType)
+	})
+
+	return value, err
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+// otlpJSONAnyValue is an AnyValue in the JSON encoding, where 64 bit
+// integers are encoded as strings, bytes as base64 and doubles can be
+// numbers or the strings "NaN", "Infinity" and "-Infinity".
+type otlpJSONAnyValue struct {
+	StringValue *string            `json:"stringValue"`
+	BoolValue   *bool              `json:"boolValue"`
+	IntValue    json.RawMessage    `json:"intValue"`
+	DoubleValue json.RawMessage    `json:"doubleValue"`
+	BytesValue  *string            `json:"bytesValue"`
+	ArrayValue  *otlpJSONArray     `json:"arrayValue"`
+	KvlistValue *otlpJSONKeyValues `json:"kvlistValue"`
+}
+
+type otlpJSONArray struct {
+	Values []otlpJSONAnyValue `json:"values"`
+}
+
+type otlpJSONKeyValues struct {
+	Values []otlpJSONKeyValue `json:"values"`
+}
+
+func decodeOTLPJSON(data []byte) ([]otlpLogRecord, error) {
+	request := struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpJSONKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				LogRecords []struct {
+					TimeUnixNano         json.RawMessage    `json:"timeUnixNano"`
+					ObservedTimeUnixNano json.RawMessage    `json:"observedTimeUnixNano"`
+					SeverityNumber       int64              `json:"severityNumber"`
+					SeverityText         string             `json:"severityText"`
+					Body                 *otlpJSONAnyValue  `json:"body"`
+					Attributes           []otlpJSONKeyValue `json:"attributes"`
+					TraceID              string             `json:"traceId"`
+					SpanID               string             `json:"spanId"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}{}
+
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	logs := make([]otlpLogRecord, 0)
+
+	for _, resourceLogs := range request.ResourceLogs {
+		resource, err := otlpJSONMap(resourceLogs.Resource.Attributes, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, r := range scopeLogs.LogRecords {
+				log := otlpLogRecord{
+					resource:       resource,
+					scope:          scopeLogs.Scope.Name,
+					severityNumber: r.SeverityNumber,
+					severityText:   r.SeverityText,
+					traceID:        strings.ToLower(r.TraceID),
+					spanID:         strings.ToLower(r.SpanID),
+				}
+
+				timestamp, err := otlpJSONInt(r.TimeUnixNano)
+				if err != nil {
+					return nil, fmt.Errorf("invalid timeUnixNano: %w", err)
+				}
+
+				observed, err := otlpJSONInt(r.ObservedTimeUnixNano)
+				if err != nil {
+					return nil, fmt.Errorf("invalid observedTimeUnixNano: %w", err)
+				}
+
+				log.timestamp = uint64(timestamp)
+				log.observed = uint64(observed)
+
+				if r.Body != nil {
+					log.body, err = r.Body.value(0)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				log.attributes, err = otlpJSONMap(r.Attributes, 0)
+				if err != nil {
+					return nil, err
+				}
+
+				logs = append(logs, log)
+			}
+		}
+	}
+
+	return logs, nil
+}
+
+func otlpJSONMap(keyValues []otlpJSONKeyValue, depth int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+
+	for _, kv := range keyValues {
+		value, err := kv.Value.value(depth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %w", kv.Key, err)
+		}
+
+		m[kv.Key] = value
+	}
+
+	return m, nil
+}
+
+func (v *otlpJSONAnyValue) value(depth int) (interface{}, error) {
+	if depth > otlpMaxDepth {
+		return nil, errOTLPTooDeep
+	}
+
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue, nil
+
+	case v.BoolValue != nil:
+		return *v.BoolValue, nil
+
+	case v.IntValue != nil:
+		return otlpJSONInt(v.IntValue)
+
+	case v.DoubleValue != nil:
+		return otlpJSONDouble(v.DoubleValue)
+
+	case v.BytesValue != nil:
+		return base64.StdEncoding.DecodeString(*v.BytesValue)
+
+	case v.ArrayValue != nil:
+		array := make([]interface{}, 0, len(v.ArrayValue.Values))
+
+		for _, item := range v.ArrayValue.Values {
+			value, err := item.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			array = append(array, value)
+		}
+
+		return array, nil
+
+	case v.KvlistValue != nil:
+		return otlpJSONMap(v.KvlistValue.Values, depth+1)
+	}
+
+	return nil, nil
+}
+
+// otlpJSONDouble parses a double, which is usually a number, but can
+// also be a string, e.g. for NaN.
+func otlpJSONDouble(raw json.RawMessage) (interface{}, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+
+	s := strings.Trim(string(raw), `"`)
+
+	switch s {
+	case "NaN":
+		return otlpDouble(math.NaN()), nil
+	case "Infinity":
+		return otlpDouble(math.Inf(1)), nil
+	case "-Infinity":
+		return otlpDouble(math.Inf(-1)), nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid double %s", raw)
+	}
+
+	return otlpDouble(f), nil
+}
+
+// otlpDouble returns finite doubles as they are, and the other ones as
+// strings like the protobuf JSON mapping does, as JSON has no numbers
+// for them.
+func otlpDouble(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	return f
+}
+
+// otlpJSONInt parses a 64 bit integer, which is usually encoded as a
+// string, but may also be a number.
+func otlpJSONInt(raw json.RawMessage) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	s := strings.Trim(string(raw), `"`)
+	if s == "" {
+		return 0, nil
+	}
+
+	// uint64 timestamps might exceed int64 in theory
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return 0, err
+		}
+
+		n = int64(u)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// otlpNestedArray encodes an AnyValue with depth nested array values.
+func otlpNestedArray(depth int) []byte {
+	value := appendProtoBytes(nil, 1, []byte("hello"))
+
+	for i := 0; i < depth; i++ {
+		array := appendProtoBytes(nil, 1, value)
+		value = appendProtoBytes(nil, 5, array)
+	}
+
+	return value
+}
+
+func TestOTLPAnyValueMaxDepth(t *testing.T) {
+	if _, err := decodeOTLPAnyValue(otlpNestedArray(otlpMaxDepth), 0); err != nil {
+		t.Fatalf("Expected value to be decoded, got %v.", err)
+	}
+
+	if _, err := decodeOTLPAnyValue(otlpNestedArray(otlpMaxDepth+1), 0); err != errOTLPTooDeep {
+		t.Fatalf("Expected nesting error, got %v.", err)
+	}
+
+	value := `{"stringValue":"hello"}`
+	for i := 0; i <= otlpMaxDepth; i++ {
+		value = `{"arrayValue":{"values":[` + value + `]}}`
+	}
+
+	body := `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":` + value + `}]}]}]}`
+	if _, err := decodeOTLPJSON([]byte(body)); err != errOTLPTooDeep {
+		t.Fatalf("Expected nesting error, got %v.", err)
+	}
+}
+
+func TestOTLPDoubles(t *testing.T) {
+	double := make([]byte, 8)
+	binary.LittleEndian.PutUint64(double, math.Float64bits(math.NaN()))
+
+	value, err := decodeOTLPAnyValue(append([]byte{4<<3 | protoFixed64}, double...), 0)
+	if err != nil {
+		t.Fatalf("Failed to decode value: %v", err)
+	}
+
+	if value != "NaN" {
+		t.Errorf("Expected NaN to become a string, got %v.", value)
+	}
+
+	body := `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"attributes":[
+		{"key":"a","value":{"doubleValue":1.5}},
+		{"key":"b","value":{"doubleValue":"Infinity"}},
+		{"key":"c","value":{"doubleValue":"-Infinity"}},
+		{"key":"d","value":{"doubleValue":"NaN"}}
+	]}]}]}]}`
+
+	logs, err := decodeOTLPJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	record, err := otlpRecord(logs[0])
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	attributes, _ := record.Field("attributes")
+	if expected := `{"a":1.5,"b":"Infinity","c":"-Infinity","d":"NaN"}`; string(attributes) != expected {
+		t.Errorf("Expected attributes %s, got %s.", expected, attributes)
+	}
+}
+
+func TestOTLPErrorResponse(t *testing.T) {
+	testcases := []struct {
+		contentType string
+		decode      func(t *testing.T, body []byte) (int, string)
+	}{
+		{
+			contentType: "application/json",
+			decode: func(t *testing.T, body []byte) (int, string) {
+				status := struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				}{}
+
+				if err := json.Unmarshal(body, &status); err != nil {
+					t.Fatalf("Failed to decode status: %v", err)
+				}
+
+				return status.Code, status.Message
+			},
+		},
+		{
+			contentType: "application/x-protobuf",
+			decode: func(t *testing.T, body []byte) (int, string) {
+				var (
+					code    uint64
+					message []byte
+				)
+
+				err := forEachProtoField(body, func(r *protoReader, field int, wireType int) error {
+					var err error
+
+					switch field {
+					case 1:
+						code, err = r.Varint()
+					case 2:
+						message, err = r.Bytes()
+					default:
+						err = r.Skip(wireType)
+					}
+
+					return err
+				})
+				if err != nil {
+					t.Fatalf("Failed to decode status: %v", err)
+				}
+
+				return int(code), string(message)
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.contentType, func(t *testing.T) {
+			config := testConfig(t)
+			s := testSink(t, config)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader([]byte{0xff, 0xff}))
+			req.Header.Set(echo.HeaderContentType, testcase.contentType)
+			rec := httptest.NewRecorder()
+
+			if err := makeOTLPLogsRequestHandler(config, s)(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("Handler failed: %v", err)
+			}
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d.", http.StatusBadRequest, rec.Code)
+			}
+
+			code, message := testcase.decode(t, rec.Body.Bytes())
+			if code != otlpInvalidArgument || !strings.HasPrefix(message, "Invalid export request") {
+				t.Errorf("Expected INVALID_ARGUMENT status, got %d (%q).", code, message)
+			}
+		})
+	}
+}
+
+func TestOTLPBodyLimit(t *testing.T) {
+	request := `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":{"stringValue":"hello"}}]}]}]}`
+
+	testcases := []struct {
+		name   string
+		body   string
+		gzip   bool
+		status int
+	}{
+		{
+			name:   "small body",
+			body:   request,
+			status: http.StatusOK,
+		},
+		{
+			name:   "large body",
+			body:   request + strings.Repeat(" ", 1000),
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "large decompressed body",
+			body:   request + strings.Repeat(" ", 1000),
+			gzip:   true,
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			config := testConfig(t, "-max-body-size", "500")
+			s := testSink(t, config)
+
+			body := testcase.body
+			if testcase.gzip {
+				body = gzipTestBody(t, body)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, "application/json")
+			if testcase.gzip {
+				req.Header.Set(echo.HeaderContentEncoding, "gzip")
+			}
+
+			rec := httptest.NewRecorder()
+
+			if err := makeOTLPLogsRequestHandler(config, s)(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatalf("Handler failed: %v", err)
+			}
+
+			if rec.Code != testcase.status {
+				t.Fatalf("Expected status %d, got %d (%s).", testcase.status, rec.Code, rec.Body.String())
+			}
+
+			if testcase.status == http.StatusOK {
+				return
+			}
+
+			status := struct {
+				Code int `json:"code"`
+			}{}
+
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.Code != otlpResourceExhausted {
+				t.Errorf("Expected RESOURCE_EXHAUSTED status, got %s.", rec.Body.String())
+			}
+		})
+	}
+}
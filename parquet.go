@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// This is a minimal writer for the Parquet file format, see
+// https://github.com/apache/parquet-format. Records are buffered in
+// memory and written as row groups with one snappy compressed, plain
+// encoded data page per column. The file is only readable once the
+// footer has been written by Close().
+
+const (
+	parquetMagic = "PAR1"
+
+	// a row group is written once either limit is reached
+	parquetRowGroupRows  = 10000
+	parquetRowGroupBytes = 32 * 1024 * 1024
+)
+
+// physical types
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// repetition types
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+)
+
+// converted types
+const (
+	parquetUTF8            = 0
+	parquetMap             = 1
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+)
+
+const (
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetCodecSnappy   = 1
+	parquetDataPage      = 0
+)
+
+// parquetColumns are the flat columns, in schema order.
+var parquetColumns = []string{
+	"log",
+	"kubernetes_namespace_name",
+	"kubernetes_pod_name",
+	"kubernetes_pod_id",
+	"kubernetes_container_name",
+	"kubernetes_docker_id",
+	"kubernetes_host",
+}
+
+// parquetColumn collects the levels and plain encoded values of a
+// single leaf column for the current row group.
+type parquetColumn struct {
+	path        []string
+	physical    int
+	maxRepLevel int
+	maxDefLevel int
+
+	repLevels []int
+	defLevels []int
+	values    bytes.Buffer
+}
+
+func (c *parquetColumn) addNull(repLevel int) {
+	c.repLevels = append(c.repLevels, repLevel)
+	c.defLevels = append(c.defLevels, 0)
+}
+
+func (c *parquetColumn) addString(repLevel int, value string) {
+	c.repLevels = append(c.repLevels, repLevel)
+	c.defLevels = append(c.defLevels, c.maxDefLevel)
+
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(value)))
+	c.values.WriteString(value)
+}
+
+func (c *parquetColumn) addInt64(value int64) {
+	c.repLevels = append(c.repLevels, 0)
+	c.defLevels = append(c.defLevels, c.maxDefLevel)
+
+	binary.Write(&c.values, binary.LittleEndian, value)
+}
+
+func (c *parquetColumn) reset() {
+	c.repLevels = c.repLevels[:0]
+	c.defLevels = c.defLevels[:0]
+	c.values.Reset()
+}
+
+// parquetColumnChunk is the location of a written column chunk.
+type parquetColumnChunk struct {
+	column           *parquetColumn
+	numValues        int
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type parquetRowGroup struct {
+	chunks []parquetColumnChunk
+	rows   int
+	bytes  int64
+}
+
+// parquetWriter writes records into a new Parquet file.
+type parquetWriter struct {
+	out       io.Writer
+	offset    int64
+	date      *parquetColumn
+	strings   []*parquetColumn
+	labels    [2]*parquetColumn
+	annots    [2]*parquetColumn
+	fields    *parquetColumn
+	rows      int
+	buffered  int
+	rowGroups []parquetRowGroup
+}
+
+func newParquetWriter(out io.Writer) (*parquetWriter, error) {
+	w := &parquetWriter{
+		out: out,
+		date: &parquetColumn{
+			path:        []string{"date"},
+			physical:    parquetInt64,
+			maxDefLevel: 1,
+		},
+		fields: &parquetColumn{
+			path:        []string{"fields"},
+			physical:    parquetByteArray,
+			maxDefLevel: 1,
+		},
+	}
+
+	for _, name := range parquetColumns {
+		w.strings = append(w.strings, &parquetColumn{
+			path:        []string{name},
+			physical:    parquetByteArray,
+			maxDefLevel: 1,
+		})
+	}
+
+	w.labels = newParquetMapColumns("kubernetes_labels")
+	w.annots = newParquetMapColumns("kubernetes_annotations")
+
+	if err := w.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// newParquetMapColumns returns the key and value columns of a map of
+// strings, i.e.
+//
+//	optional group <name> (MAP) {
+//	  repeated group key_value {
+//	    required binary key (UTF8);
+//	    optional binary value (UTF8);
+//	  }
+//	}
+func newParquetMapColumns(name string) [2]*parquetColumn {
+	return [2]*parquetColumn{
+		{
+			path:        []string{name, "key_value", "key"},
+			physical:    parquetByteArray,
+			maxRepLevel: 1,
+			maxDefLevel: 2,
+		},
+		{
+			path:        []string{name, "key_value", "value"},
+			physical:    parquetByteArray,
+			maxRepLevel: 1,
+			maxDefLevel: 3,
+		},
+	}
+}
+
+// columns returns all leaf columns in schema order.
+func (w *parquetWriter) columns() []*parquetColumn {
+	columns := []*parquetColumn{w.date}
+	columns = append(columns, w.strings...)
+	columns = append(columns, w.labels[0], w.labels[1], w.annots[0], w.annots[1], w.fields)
+
+	return columns
+}
+
+// Write buffers the record and writes a row group once enough records
+// have been buffered.
+func (w *parquetWriter) Write(record *Record) error {
+	// encode first, so that no column is left incomplete
+	fields, err := extraFields(record)
+	if err != nil {
+		return &encodeError{err}
+	}
+
+	if record.Date.IsZero() {
+		w.date.addNull(0)
+	} else {
+		w.date.addInt64(record.Date.UnixNano() / 1000)
+	}
+
+	meta := record.Kubernetes
+	values := []string{record.Log, meta.NamespaceName, meta.PodName, meta.PodID, meta.ContainerName, meta.DockerID, meta.Host}
+
+	for i, value := range values {
+		if value == "" {
+			w.strings[i].addNull(0)
+		} else {
+			w.strings[i].addString(0, value)
+		}
+
+		w.buffered += len(value)
+	}
+
+	w.buffered += addParquetMap(w.labels, meta.Labels)
+	w.buffered += addParquetMap(w.annots, meta.Annotations)
+
+	if fields == nil {
+		w.fields.addNull(0)
+	} else {
+		w.fields.addString(0, string(fields))
+		w.buffered += len(fields)
+	}
+
+	w.rows++
+
+	if w.rows >= parquetRowGroupRows || w.buffered >= parquetRowGroupBytes {
+		return w.flush()
+	}
+
+	return nil
+}
+
+func addParquetMap(columns [2]*parquetColumn, values map[string]string) int {
+	if len(values) == 0 {
+		columns[0].addNull(0)
+		columns[1].addNull(0)
+
+		return 0
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	size := 0
+
+	for i, key := range keys {
+		repLevel := 1
+		if i == 0 {
+			repLevel = 0
+		}
+
+		columns[0].addString(repLevel, key)
+		columns[1].addString(repLevel, values[key])
+
+		size += len(key) + len(values[key])
+	}
+
+	return size
+}
+
+// extraFields encodes all fields that have no column of their own as
+// a JSON object, or returns nil if there are none.
+func extraFields(record *Record) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+
+	for _, name := range record.FieldNames() {
+		switch name {
+		case "date", "log", "kubernetes":
+			continue
+		}
+
+		fields[name], _ = record.Field(name)
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return encodeJSON(fields)
+}
+
+// flush writes the buffered records as a row group.
+func (w *parquetWriter) flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{
+		rows: w.rows,
+	}
+
+	for _, column := range w.columns() {
+		chunk, err := w.writeColumnChunk(column)
+		if err != nil {
+			return err
+		}
+
+		group.chunks = append(group.chunks, chunk)
+		group.bytes += chunk.uncompressedSize
+
+		column.reset()
+	}
+
+	w.rowGroups = append(w.rowGroups, group)
+	w.rows = 0
+	w.buffered = 0
+
+	return nil
+}
+
+func (w *parquetWriter) writeColumnChunk(column *parquetColumn) (parquetColumnChunk, error) {
+	page := bytes.Buffer{}
+
+	if column.maxRepLevel > 0 {
+		writeParquetLevels(&page, column.repLevels, column.maxRepLevel)
+	}
+
+	if column.maxDefLevel > 0 {
+		writeParquetLevels(&page, column.defLevels, column.maxDefLevel)
+	}
+
+	page.Write(column.values.Bytes())
+
+	compressed := snappy.Encode(nil, page.Bytes())
+
+	header := thriftCompactWriter{}
+	header.I32(1, parquetDataPage)
+	header.I32(2, int32(page.Len()))
+	header.I32(3, int32(len(compressed)))
+	header.BeginStruct(5)
+	header.I32(1, int32(len(column.defLevels)))
+	header.I32(2, parquetEncodingPlain)
+	header.I32(3, parquetEncodingRLE)
+	header.I32(4, parquetEncodingRLE)
+	header.EndStruct()
+	header.Stop()
+
+	chunk := parquetColumnChunk{
+		column:           column,
+		numValues:        len(column.defLevels),
+		offset:           w.offset,
+		uncompressedSize: int64(header.Len() + page.Len()),
+		compressedSize:   int64(header.Len() + len(compressed)),
+	}
+
+	if err := w.write(header.Bytes()); err != nil {
+		return chunk, err
+	}
+
+	return chunk, w.write(compressed)
+}
+
+// writeParquetLevels writes levels using the RLE/bit-packing hybrid
+// encoding, using only RLE runs, prefixed by their total length.
+func writeParquetLevels(buf *bytes.Buffer, levels []int, maxLevel int) {
+	width := 0
+	for maxLevel>>uint(width) > 0 {
+		width++
+	}
+
+	encoded := bytes.Buffer{}
+	varint := make([]byte, binary.MaxVarintLen64)
+
+	for start := 0; start < len(levels); {
+		end := start
+		for end < len(levels) && levels[end] == levels[start] {
+			end++
+		}
+
+		n := binary.PutUvarint(varint, uint64(end-start)<<1)
+		encoded.Write(varint[:n])
+
+		// the value is stored in as few bytes as the bit width allows
+		for i := 0; i < (width+7)/8; i++ {
+			encoded.WriteByte(byte(levels[start] >> uint(8*i)))
+		}
+
+		start = end
+	}
+
+	binary.Write(buf, binary.LittleEndian, uint32(encoded.Len()))
+	buf.Write(encoded.Bytes())
+}
+
+// Size returns the number of bytes written so far, plus the size of
+// the buffered records.
+func (w *parquetWriter) Size() int64 {
+	return w.offset + int64(w.buffered)
+}
+
+// Close writes the remaining records and the footer. It does not
+// close the underlying writer.
+func (w *parquetWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	footer := w.footer()
+
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(footer)))
+
+	if err := w.write(length); err != nil {
+		return err
+	}
+
+	return w.write([]byte(parquetMagic))
+}
+
+func (w *parquetWriter) write(data []byte) error {
+	n, err := w.out.Write(data)
+	w.offset += int64(n)
+
+	return err
+}
+
+// footer encodes the FileMetaData.
+func (w *parquetWriter) footer() []byte {
+	meta := thriftCompactWriter{}
+
+	rows := 0
+	for _, group := range w.rowGroups {
+		rows += group.rows
+	}
+
+	meta.I32(1, 1)
+
+	// the schema is flattened in depth-first order
+	schema := thriftCompactWriter{}
+	elements := 0
+
+	schemaElement := func(name string, physical int, repetition int, converted int, children int) {
+		schema.BeginListStruct()
+		if physical >= 0 {
+			schema.I32(1, int32(physical))
+		}
+		if repetition >= 0 {
+			schema.I32(3, int32(repetition))
+		}
+		schema.String(4, name)
+		if children > 0 {
+			schema.I32(5, int32(children))
+		}
+		if converted >= 0 {
+			schema.I32(6, int32(converted))
+		}
+		schema.EndStruct()
+
+		elements++
+	}
+
+	schemaElement("schema", -1, -1, -1, 2+len(parquetColumns)+2)
+	schemaElement("date", parquetInt64, parquetOptional, parquetTimestampMicros, 0)
+
+	for _, name := range parquetColumns {
+		schemaElement(name, parquetByteArray, parquetOptional, parquetUTF8, 0)
+	}
+
+	for _, name := range []string{"kubernetes_labels", "kubernetes_annotations"} {
+		schemaElement(name, -1, parquetOptional, parquetMap, 1)
+		schemaElement("key_value", -1, parquetRepeated, -1, 2)
+		schemaElement("key", parquetByteArray, parquetRequired, parquetUTF8, 0)
+		schemaElement("value", parquetByteArray, parquetOptional, parquetUTF8, 0)
+	}
+
+	schemaElement("fields", parquetByteArray, parquetOptional, parquetJSON, 0)
+
+	meta.BeginList(2, thriftStruct, elements)
+	meta.Raw(schema.Bytes())
+
+	meta.I64(3, int64(rows))
+
+	meta.BeginList(4, thriftStruct, len(w.rowGroups))
+	for _, group := range w.rowGroups {
+		meta.BeginListStruct()
+		meta.BeginList(1, thriftStruct, len(group.chunks))
+
+		for _, chunk := range group.chunks {
+			meta.BeginListStruct()
+			meta.I64(2, chunk.offset)
+			meta.BeginStruct(3)
+			meta.I32(1, int32(chunk.column.physical))
+			meta.BeginList(2, thriftI32, 2)
+			meta.RawI32(parquetEncodingPlain)
+			meta.RawI32(parquetEncodingRLE)
+			meta.BeginList(3, thriftBinary, len(chunk.column.path))
+			for _, element := range chunk.column.path {
+				meta.RawString(element)
+			}
+			meta.I32(4, parquetCodecSnappy)
+			meta.I64(5, int64(chunk.numValues))
+			meta.I64(6, chunk.uncompressedSize)
+			meta.I64(7, chunk.compressedSize)
+			meta.I64(9, chunk.offset)
+			meta.EndStruct()
+			meta.EndStruct()
+		}
+
+		meta.I64(2, group.bytes)
+		meta.I64(3, int64(group.rows))
+		meta.EndStruct()
+	}
+
+	meta.String(6, "bunker")
+	meta.Stop()
+
+	return meta.Bytes()
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompactWriter encodes structs using the Thrift compact
+// protocol, which is used for all Parquet metadata.
+type thriftCompactWriter struct {
+	bytes.Buffer
+
+	lastField  int
+	fieldStack []int
+}
+
+func (t *thriftCompactWriter) field(id int, kind byte) {
+	delta := id - t.lastField
+
+	if delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta<<4) | kind)
+	} else {
+		t.WriteByte(kind)
+		t.varint(int64(id))
+	}
+
+	t.lastField = id
+}
+
+func (t *thriftCompactWriter) varint(value int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, value)
+
+	t.Write(buf[:n])
+}
+
+func (t *thriftCompactWriter) I32(id int, value int32) {
+	t.field(id, thriftI32)
+	t.RawI32(value)
+}
+
+func (t *thriftCompactWriter) I64(id int, value int64) {
+	t.field(id, thriftI64)
+	t.varint(value)
+}
+
+func (t *thriftCompactWriter) String(id int, value string) {
+	t.field(id, thriftBinary)
+	t.RawString(value)
+}
+
+// RawI32 writes a list element.
+func (t *thriftCompactWriter) RawI32(value int32) {
+	t.varint(int64(value))
+}
+
+// RawString writes a list element.
+func (t *thriftCompactWriter) RawString(value string) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(value)))
+
+	t.Write(buf[:n])
+	t.WriteString(value)
+}
+
+// Raw writes already encoded data, like list elements.
+func (t *thriftCompactWriter) Raw(data []byte) {
+	t.Write(data)
+}
+
+func (t *thriftCompactWriter) BeginList(id int, kind byte, size int) {
+	t.field(id, thriftList)
+
+	if size < 15 {
+		t.WriteByte(byte(size<<4) | kind)
+	} else {
+		t.WriteByte(0xf0 | kind)
+
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, uint64(size))
+		t.Write(buf[:n])
+	}
+}
+
+func (t *thriftCompactWriter) BeginStruct(id int) {
+	t.field(id, thriftStruct)
+	t.BeginListStruct()
+}
+
+// BeginListStruct starts a struct that is an element of a list.
+func (t *thriftCompactWriter) BeginListStruct() {
+	t.fieldStack = append(t.fieldStack, t.lastField)
+	t.lastField = 0
+}
+
+func (t *thriftCompactWriter) EndStruct() {
+	t.Stop()
+
+	t.lastField = t.fieldStack[len(t.fieldStack)-1]
+	t.fieldStack = t.fieldStack[:len(t.fieldStack)-1]
+}
+
+// Stop ends the top-level struct.
+func (t *thriftCompactWriter) Stop() {
+	t.WriteByte(0)
+}
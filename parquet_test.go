@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+var updateParquetFixture = flag.Bool("update-parquet-fixture", false, "rewrite testdata/records.parquet")
+
+// thriftCompactReader decodes Thrift compact structs into maps of field
+// IDs to values, which is enough to check the Parquet metadata.
+type thriftCompactReader struct {
+	data []byte
+	pos  int
+}
+
+type thriftFields map[int]interface{}
+
+func (r *thriftCompactReader) byte() byte {
+	b := r.data[r.pos]
+	r.pos++
+
+	return b
+}
+
+func (r *thriftCompactReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+
+	return value
+}
+
+func (r *thriftCompactReader) varint() int64 {
+	value, n := binary.Varint(r.data[r.pos:])
+	r.pos += n
+
+	return value
+}
+
+func (r *thriftCompactReader) value(kind byte) interface{} {
+	switch kind {
+	case 1, 2:
+		return kind == 1
+
+	case 3:
+		return int64(int8(r.byte()))
+
+	case 4, thriftI32, thriftI64:
+		return r.varint()
+
+	case thriftBinary:
+		n := int(r.uvarint())
+		value := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+
+		return value
+
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+
+		return list
+
+	case thriftStruct:
+		return r.Struct()
+	}
+
+	panic(fmt.Sprintf("unsupported Thrift type %d", kind))
+}
+
+func (r *thriftCompactReader) Struct() thriftFields {
+	fields := thriftFields{}
+	last := 0
+
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+
+		id := last + int(header>>4)
+		if header>>4 == 0 {
+			id = int(r.varint())
+		}
+
+		fields[id] = r.value(header & 0x0f)
+		last = id
+	}
+}
+
+// readParquetFooter checks the magic bytes and decodes the FileMetaData.
+func readParquetFooter(t *testing.T, data []byte) thriftFields {
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatalf("File does not start and end with %q.", parquetMagic)
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := data[len(data)-8-length : len(data)-8]
+
+	reader := &thriftCompactReader{data: footer}
+	meta := reader.Struct()
+
+	if reader.pos != len(footer) {
+		t.Fatalf("Footer has %d bytes, but only %d were decoded.", len(footer), reader.pos)
+	}
+
+	return meta
+}
+
+// readParquetStrings decodes the values of a required or optional
+// byte array column, with nil for null values.
+func readParquetStrings(t *testing.T, data []byte, chunk thriftFields) []interface{} {
+	meta := chunk[3].(thriftFields)
+	offset := int(meta[9].(int64))
+
+	reader := &thriftCompactReader{data: data, pos: offset}
+	header := reader.Struct()
+
+	page, err := snappy.Decode(nil, data[reader.pos:reader.pos+int(header[3].(int64))])
+	if err != nil {
+		t.Fatalf("Failed to decompress page: %v", err)
+	}
+
+	if len(page) != int(header[2].(int64)) {
+		t.Fatalf("Expected uncompressed page size %d, got %d.", header[2], len(page))
+	}
+
+	numValues := int(header[5].(thriftFields)[1].(int64))
+
+	// definition levels with a bit width of 1, only RLE runs
+	levelsLength := int(binary.LittleEndian.Uint32(page))
+	levels := &thriftCompactReader{data: page[4 : 4+levelsLength]}
+	defined := make([]bool, 0, numValues)
+
+	for levels.pos < len(levels.data) {
+		run := int(levels.uvarint() >> 1)
+		value := levels.byte()
+
+		for i := 0; i < run; i++ {
+			defined = append(defined, value == 1)
+		}
+	}
+
+	if len(defined) != numValues {
+		t.Fatalf("Expected %d definition levels, got %d.", numValues, len(defined))
+	}
+
+	values := page[4+levelsLength:]
+	result := make([]interface{}, 0, numValues)
+
+	for _, isDefined := range defined {
+		if !isDefined {
+			result = append(result, nil)
+			continue
+		}
+
+		n := int(binary.LittleEndian.Uint32(values))
+		result = append(result, string(values[4:4+n]))
+		values = values[4+n:]
+	}
+
+	if len(values) != 0 {
+		t.Fatalf("%d bytes left after decoding all values.", len(values))
+	}
+
+	return result
+}
+
+func testParquetRecords(t *testing.T) []*Record {
+	inputs := []string{
+		`{"date":"2020-01-01T12:00:00Z","log":"first","kubernetes":{"namespace_name":"default","labels":{"app":"web"}}}`,
+		`{"date":"2020-01-01T12:00:01Z","log":"second","stream":"stderr","kubernetes":{"namespace_name":"kube-system"}}`,
+		`{"log":"third"}`,
+	}
+
+	return decodeTestRecords(t, inputs)
+}
+
+func decodeTestRecords(t *testing.T, inputs []string) []*Record {
+	records := make([]*Record, 0)
+
+	for _, input := range inputs {
+		record := &Record{}
+		if err := json.Unmarshal([]byte(input), record); err != nil {
+			t.Fatalf("Failed to decode record: %v", err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestParquetWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+
+	w, err := newParquetWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	records := testParquetRecords(t)
+
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data := buf.Bytes()
+	meta := readParquetFooter(t, data)
+
+	if meta[1] != int64(1) {
+		t.Errorf("Expected version 1, got %v.", meta[1])
+	}
+
+	if meta[3] != int64(len(records)) {
+		t.Errorf("Expected %d rows, got %v.", len(records), meta[3])
+	}
+
+	names := make([]string, 0)
+	for _, element := range meta[2].([]interface{}) {
+		names = append(names, element.(thriftFields)[4].(string))
+	}
+
+	expectedNames := []string{
+		"schema", "date", "log",
+		"kubernetes_namespace_name", "kubernetes_pod_name", "kubernetes_pod_id",
+		"kubernetes_container_name", "kubernetes_docker_id", "kubernetes_host",
+		"kubernetes_labels", "key_value", "key", "value",
+		"kubernetes_annotations", "key_value", "key", "value",
+		"fields",
+	}
+
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Expected schema %v, got %v.", expectedNames, names)
+	}
+
+	// the root has all top-level columns as children
+	if children := meta[2].([]interface{})[0].(thriftFields)[5]; children != int64(11) {
+		t.Errorf("Expected 11 top-level columns, got %v.", children)
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("Expected 1 row group, got %d.", len(rowGroups))
+	}
+
+	chunks := rowGroups[0].(thriftFields)[1].([]interface{})
+	if len(chunks) != len(w.columns()) {
+		t.Fatalf("Expected %d column chunks, got %d.", len(w.columns()), len(chunks))
+	}
+
+	for i, column := range w.columns() {
+		path := chunks[i].(thriftFields)[3].(thriftFields)[3].([]interface{})
+		if fmt.Sprint(path) != fmt.Sprint(column.path) {
+			t.Errorf("Expected column %d to be %v, got %v.", i, column.path, path)
+		}
+	}
+
+	logs := readParquetStrings(t, data, chunks[1].(thriftFields))
+	if expected := []interface{}{"first", "second", "third"}; !reflect.DeepEqual(logs, expected) {
+		t.Errorf("Expected logs %v, got %v.", expected, logs)
+	}
+
+	namespaces := readParquetStrings(t, data, chunks[2].(thriftFields))
+	if expected := []interface{}{"default", "kube-system", nil}; !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("Expected namespaces %v, got %v.", expected, namespaces)
+	}
+
+	fields := readParquetStrings(t, data, chunks[len(chunks)-1].(thriftFields))
+	if expected := []interface{}{nil, `{"stream":"stderr"}`, nil}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected fields %v, got %v.", expected, fields)
+	}
+}
+
+func TestParquetFooterWrittenOnShutdown(t *testing.T) {
+	config := testConfig(t, "-format", "parquet", "-pattern", "%kubernetes_namespace_name%.parquet")
+	s := testSink(t, config)
+
+	records := testParquetRecords(t)[:2]
+
+	if _, _, err := s.AddPayload(Payload{Records: records}); err != nil {
+		t.Fatalf("Failed to add payload: %v", err)
+	}
+
+	go s.GarbageCollect()
+	go s.ProcessQueue()
+
+	s.Close()
+
+	for _, namespace := range []string{"default", "kube-system"} {
+		data, err := ioutil.ReadFile(filepath.Join(config.Target, namespace+".parquet"))
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+
+		if meta := readParquetFooter(t, data); meta[3] != int64(1) {
+			t.Errorf("Expected 1 row in %s, got %v.", namespace, meta[3])
+		}
+	}
+}
+
+// TestParquetFixture compares the output with a file that has been
+// read back using github.com/xitongsys/parquet-go, an independent
+// implementation of the format. Changes to the writer must be checked
+// the same way before updating the fixture with -update-parquet-fixture.
+func TestParquetFixture(t *testing.T) {
+	records := decodeTestRecords(t, []string{
+		`{"date":"2020-01-01T12:00:00.123456Z","log":"first","stream":"stdout","kubernetes":{"namespace_name":"default","pod_name":"web-0","pod_id":"4a3b2c1d","container_name":"nginx","docker_id":"e5f6a7b8","host":"node-1","labels":{"tier":"frontend","app":"web"},"annotations":{"xrstf.de/note":""}}}`,
+		`{"date":"2020-01-01T12:00:01Z","log":"grüße 🚀","extra":{"retries":[1,2]},"kubernetes":{"namespace_name":"kube-system","labels":{"k8s-app":"dns"}}}`,
+		`{"log":"third"}`,
+		`{"date":"1969-12-31T23:59:59Z","kubernetes":{"annotations":{"a":"1","b":"2","c":"3"}}}`,
+	})
+
+	buf := bytes.Buffer{}
+
+	w, err := newParquetWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	filename := filepath.Join("testdata", "records.parquet")
+
+	if *updateParquetFixture {
+		if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to update fixture: %v", err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("Output differs from %s.", filename)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pathTemplate is a parsed filename pattern. Placeholders have the form
+// %source|function|function=argument%, where the source is either one
+// of the named placeholders or a lookup like field:level.
+type pathTemplate struct {
+	parts    []templatePart
+	location *time.Location
+}
+
+// templatePart is either a literal piece of the pattern or a placeholder.
+type templatePart struct {
+	literal     string
+	placeholder *placeholder
+}
+
+type placeholder struct {
+	// name is the source as written in the pattern, e.g. "field:level"
+	name      string
+	lookup    string
+	key       string
+	functions []placeholderFunction
+}
+
+type placeholderFunction struct {
+	name     string
+	argument string
+	length   int
+}
+
+// placeholder lookups take a key, e.g. %annotation:example.com/team%
+const (
+	lookupField      = "field"
+	lookupLabel      = "label"
+	lookupAnnotation = "annotation"
+)
+
+var labelPlaceholderRegex = regexp.MustCompile(`^kubernetes_label_[a-z0-9_]+$`)
+
+func parsePathTemplate(pattern string, location *time.Location) (*pathTemplate, error) {
+	if pattern == "" {
+		return nil, errors.New("pattern must not be empty")
+	}
+
+	// names of all placeholders that do not depend on dynamic keys
+	known := (&Record{}).Placeholders("", time.UTC)
+
+	template := &pathTemplate{
+		location: location,
+	}
+
+	// the pattern with all placeholders replaced, to check for ".."
+	skeleton := strings.Builder{}
+	rest := pattern
+
+	for rest != "" {
+		start := strings.IndexByte(rest, '%')
+		if start < 0 {
+			template.addLiteral(rest)
+			skeleton.WriteString(rest)
+			break
+		}
+
+		end := strings.IndexByte(rest[start+1:], '%')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", pattern)
+		}
+
+		end += start + 1
+
+		template.addLiteral(rest[:start])
+		skeleton.WriteString(rest[:start])
+
+		// %% is a literal percent sign
+		if end == start+1 {
+			template.addLiteral("%")
+			skeleton.WriteString("%")
+		} else {
+			p, err := parsePlaceholder(rest[start+1:end], known)
+			if err != nil {
+				return nil, err
+			}
+
+			template.parts = append(template.parts, templatePart{placeholder: p})
+			skeleton.WriteString("x")
+		}
+
+		rest = rest[end+1:]
+	}
+
+	if path.IsAbs(filepath.ToSlash(pattern)) {
+		return nil, fmt.Errorf("pattern %q must be relative to the target directory", pattern)
+	}
+
+	for _, element := range strings.Split(filepath.ToSlash(skeleton.String()), "/") {
+		if element == ".." {
+			return nil, fmt.Errorf("pattern %q must not leave the target directory", pattern)
+		}
+	}
+
+	return template, nil
+}
+
+func (t *pathTemplate) addLiteral(literal string) {
+	if literal == "" {
+		return
+	}
+
+	// merge with a preceding literal, so that literals are always
+	// separated by placeholders
+	if n := len(t.parts); n > 0 && t.parts[n-1].placeholder == nil {
+		t.parts[n-1].literal += literal
+		return
+	}
+
+	t.parts = append(t.parts, templatePart{literal: literal})
+}
+
+func parsePlaceholder(s string, known map[string]string) (*placeholder, error) {
+	items := strings.Split(s, "|")
+
+	p := &placeholder{
+		name: items[0],
+	}
+
+	if colon := strings.IndexByte(p.name, ':'); colon >= 0 {
+		p.lookup = p.name[:colon]
+		p.key = p.name[colon+1:]
+
+		switch p.lookup {
+		case lookupField, lookupLabel, lookupAnnotation:
+		default:
+			return nil, fmt.Errorf("unknown placeholder %%%s%%", s)
+		}
+
+		if p.key == "" {
+			return nil, fmt.Errorf("placeholder %%%s%% has no key", s)
+		}
+	} else if _, ok := known[p.name]; !ok && !labelPlaceholderRegex.MatchString(p.name) {
+		return nil, fmt.Errorf("unknown placeholder %%%s%%", s)
+	}
+
+	for _, item := range items[1:] {
+		function := placeholderFunction{
+			name: item,
+		}
+
+		hasArgument := false
+
+		if eq := strings.IndexByte(item, '='); eq >= 0 {
+			function.name = item[:eq]
+			function.argument = item[eq+1:]
+			hasArgument = true
+		}
+
+		switch function.name {
+		case "lower", "hash":
+			if hasArgument {
+				return nil, fmt.Errorf("function %s in %%%s%% takes no argument", function.name, s)
+			}
+
+		case "default":
+			if function.argument == "" {
+				return nil, fmt.Errorf("function default in %%%s%% requires a value", s)
+			}
+
+		case "trunc":
+			length, err := strconv.Atoi(function.argument)
+			if err != nil || length < 1 {
+				return nil, fmt.Errorf("function trunc in %%%s%% requires a positive length", s)
+			}
+
+			function.length = length
+
+		default:
+			return nil, fmt.Errorf("unknown function %q in %%%s%%", function.name, s)
+		}
+
+		p.functions = append(p.functions, function)
+	}
+
+	return p, nil
+}
+
+// Render builds the filename for a record, relative to the target
+// directory.
+func (t *pathTemplate) Render(record *Record, tag string) string {
+	values := record.Placeholders(tag, t.location)
+	filename := strings.Builder{}
+
+	for _, part := range t.parts {
+		if part.placeholder == nil {
+			filename.WriteString(part.literal)
+		} else {
+			filename.WriteString(part.placeholder.Render(record, values))
+		}
+	}
+
+	return filename.String()
+}
+
+// Render applies the functions to the placeholder's value. Empty
+// values without a default are replaced by a fallback like NO_TAG.
+func (p *placeholder) Render(record *Record, values map[string]string) string {
+	value := p.value(record, values)
+
+	for _, function := range p.functions {
+		switch function.name {
+		case "lower":
+			value = strings.ToLower(value)
+
+		case "default":
+			if value == "" {
+				value = function.argument
+			}
+
+		case "trunc":
+			if len(value) > function.length {
+				value = value[:function.length]
+			}
+
+		case "hash":
+			hash := fnv.New32a()
+			hash.Write([]byte(value))
+			value = fmt.Sprintf("%08x", hash.Sum32())
+		}
+	}
+
+	if value == "" {
+		value = placeholderFallback(p.name)
+	}
+
+	return sanitisePathElement(value)
+}
+
+func (p *placeholder) value(record *Record, values map[string]string) string {
+	switch p.lookup {
+	case lookupField:
+		raw, ok := record.Field(p.key)
+		if !ok {
+			return ""
+		}
+
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+
+		// numbers and booleans are used as-is
+		if string(raw) == "null" || raw[0] == '{' || raw[0] == '[' {
+			return ""
+		}
+
+		return string(raw)
+
+	case lookupLabel:
+		return record.Kubernetes.Labels[p.key]
+
+	case lookupAnnotation:
+		return record.Kubernetes.Annotations[p.key]
+
+	default:
+		return values[p.name]
+	}
+}
+
+// Plain returns true if the placeholder's value is written to the
+// filename unmodified (apart from the fallback and sanitising), so
+// that it can be recovered from filenames.
+func (p *placeholder) Plain() bool {
+	return p.lookup == "" && len(p.functions) == 0
+}
+
+// Extension returns the extension of the pattern, if it ends with a
+// literal one.
+func (t *pathTemplate) Extension() string {
+	if len(t.parts) == 0 {
+		return ""
+	}
+
+	last := t.parts[len(t.parts)-1]
+	if last.placeholder != nil {
+		return ""
+	}
+
+	return path.Ext(filepath.ToSlash(last.literal))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	testcases := []struct {
+		pattern string
+		err     string
+	}{
+		// unknown tokens
+		{pattern: "", err: "must not be empty"},
+		{pattern: "%date/records.json", err: "unterminated placeholder"},
+		{pattern: "%nope%.json", err: "unknown placeholder %nope%"},
+		{pattern: "%kubernetes_label_App%.json", err: "unknown placeholder"},
+		{pattern: "%env:HOME%.json", err: "unknown placeholder %env:HOME%"},
+		{pattern: "%field:%.json", err: "has no key"},
+
+		// leaving the target directory
+		{pattern: "/var/log/%date%.json", err: "must be relative"},
+		{pattern: "../%date%.json", err: "must not leave the target directory"},
+		{pattern: "%date%/../../x.json", err: "must not leave the target directory"},
+		{pattern: "a/..", err: "must not leave the target directory"},
+
+		// invalid functions
+		{pattern: "%tag|upper%.json", err: `unknown function "upper"`},
+		{pattern: "%tag|lower=x%.json", err: "takes no argument"},
+		{pattern: "%tag|hash=1%.json", err: "takes no argument"},
+		{pattern: "%tag|default%.json", err: "requires a value"},
+		{pattern: "%tag|default=%.json", err: "requires a value"},
+		{pattern: "%tag|trunc%.json", err: "requires a positive length"},
+		{pattern: "%tag|trunc=0%.json", err: "requires a positive length"},
+		{pattern: "%tag|trunc=x%.json", err: "requires a positive length"},
+	}
+
+	for _, testcase := range testcases {
+		_, err := parsePathTemplate(testcase.pattern, time.UTC)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("Expected %q to fail with %q, got %v.", testcase.pattern, testcase.err, err)
+		}
+	}
+}
+
+func TestParsePathTemplateValid(t *testing.T) {
+	patterns := []string{
+		"%date%/%kubernetes_namespace_name%.json",
+		"%year%/%month%/%dayofmonth%/%hour%-%minute%.log",
+		"%kubernetes_label_app%/%annotation:example.com/team|default=none%.json",
+		"%field:level|lower|trunc=5%/%tag|hash%.json",
+		"100%%/%tag%.json",
+		"..%tag%/x..y.json",
+	}
+
+	for _, pattern := range patterns {
+		if _, err := parsePathTemplate(pattern, time.UTC); err != nil {
+			t.Errorf("Expected %q to be valid, got %v.", pattern, err)
+		}
+	}
+}
+
+func TestPathTemplateRender(t *testing.T) {
+	record := testRecord(t, "default", "hello")
+	record.Kubernetes.Labels = map[string]string{"app": "web"}
+	record.Kubernetes.Annotations = map[string]string{"example.com/team": "Platform"}
+
+	testcases := []struct {
+		pattern  string
+		tag      string
+		expected string
+	}{
+		{pattern: "%date%/%kubernetes_namespace_name%.json", expected: "2020-01-01/default.json"},
+		{pattern: "%year%/%month%/%dayofmonth%/%hour%.json", expected: "2020/01/01/12.json"},
+		{pattern: "%tag%.json", expected: "NO_TAG.json"},
+		{pattern: "%tag|default=untagged%.json", tag: "", expected: "untagged.json"},
+		{pattern: "%tag|trunc=4%.json", tag: "kube.var.log", expected: "kube.json"},
+		{pattern: "%tag|hash%.json", tag: "kube", expected: "d0bacc48.json"},
+		{pattern: "%kubernetes_label_app%.json", expected: "web.json"},
+		{pattern: "%label:app%.json", expected: "web.json"},
+		{pattern: "%annotation:example.com/team|lower%.json", expected: "platform.json"},
+		{pattern: "%field:log%.json", expected: "hello.json"},
+		{pattern: "%field:missing%.json", expected: "NO_FIELD_MISSING.json"},
+		{pattern: "100%%-%tag%.json", tag: "../x", expected: "100%-.._x.json"},
+		{pattern: "%tag%.json", tag: "..", expected: "__.json"},
+	}
+
+	for _, testcase := range testcases {
+		template, err := parsePathTemplate(testcase.pattern, time.UTC)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", testcase.pattern, err)
+		}
+
+		if filename := template.Render(record, testcase.tag); filename != testcase.expected {
+			t.Errorf("Expected %q to render as %q, got %q.", testcase.pattern, testcase.expected, filename)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// This is a minimal reader for the protobuf wire format, sufficient
+// to decode the few messages Bunker receives without generated code,
+// plus the two append functions needed to encode error responses.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+type protoReader struct {
+	data []byte
+	pos  int
+}
+
+func newProtoReader(data []byte) *protoReader {
+	return &protoReader{
+		data: data,
+	}
+}
+
+// Next returns the number and wire type of the next field, or io.EOF
+// at the end of the message.
+func (r *protoReader) Next() (int, int, error) {
+	if r.pos >= len(r.data) {
+		return 0, 0, io.EOF
+	}
+
+	key, err := r.Varint()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(key >> 3), int(key & 0x07), nil
+}
+
+func (r *protoReader) Varint() (uint64, error) {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+
+	r.pos += n
+
+	return value, nil
+}
+
+func (r *protoReader) Fixed64() (uint64, error) {
+	if len(r.data)-r.pos < 8 {
+		return 0, errProtoTruncated
+	}
+
+	value := binary.LittleEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+
+	return value, nil
+}
+
+func (r *protoReader) Fixed32() (uint32, error) {
+	if len(r.data)-r.pos < 4 {
+		return 0, errProtoTruncated
+	}
+
+	value := binary.LittleEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+
+	return value, nil
+}
+
+// Bytes returns a length-delimited field, which can be a string,
+// bytes or an embedded message.
+func (r *protoReader) Bytes() ([]byte, error) {
+	length, err := r.Varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(r.data)-r.pos) < length {
+		return nil, errProtoTruncated
+	}
+
+	value := r.data[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+
+	return value, nil
+}
+
+// Skip skips the value of an unknown field.
+func (r *protoReader) Skip(wireType int) error {
+	var err error
+
+	switch wireType {
+	case protoVarint:
+		_, err = r.Varint()
+	case protoFixed64:
+		_, err = r.Fixed64()
+	case protoBytes:
+		_, err = r.Bytes()
+	case protoFixed32:
+		_, err = r.Fixed32()
+	default:
+		err = fmt.Errorf("unsupported wire type %d", wireType)
+	}
+
+	return err
+}
+
+// forEachProtoField calls fn for every field of the message. fn must
+// consume the field's value, or call Skip for unknown fields.
+func forEachProtoField(data []byte, fn func(r *protoReader, field int, wireType int) error) error {
+	r := newProtoReader(data)
+
+	for {
+		field, wireType, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(r, field, wireType); err != nil {
+			return err
+		}
+	}
+}
+
+// appendProtoVarint appends a varint field to a message.
+func appendProtoVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|protoVarint))
+	return binary.AppendUvarint(buf, value)
+}
+
+// appendProtoBytes appends a length-delimited field to a message.
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|protoBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+
+	return append(buf, value...)
+}
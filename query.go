@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 10000
+
+	// cursorTrailer is the HTTP trailer containing the cursor for
+	// the next page of results.
+	cursorTrailer = "Bunker-Cursor"
+)
+
+// recordQuery describes which records a client is interested in.
+type recordQuery struct {
+	From      time.Time
+	To        time.Time
+	Namespace string
+	Pod       string
+	Container string
+	Contains  string
+	Regex     *regexp.Regexp
+
+	// Namespaces are the glob patterns the client is allowed to read,
+	// empty if there are no restrictions.
+	Namespaces []string
+}
+
+func parseRecordQuery(values url.Values) (*recordQuery, error) {
+	q := &recordQuery{
+		Namespace: values.Get("namespace"),
+		Pod:       values.Get("pod"),
+		Container: values.Get("container"),
+		Contains:  values.Get("contains"),
+	}
+
+	for _, pattern := range []string{q.Namespace, q.Pod, q.Container} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	var err error
+
+	if from := values.Get("from"); from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date: %w", err)
+		}
+	}
+
+	if to := values.Get("to"); to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date: %w", err)
+		}
+	}
+
+	if regex := values.Get("regex"); regex != "" {
+		q.Regex, err = regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+
+	return q, nil
+}
+
+// Matches checks the record against all conditions of the query.
+func (q *recordQuery) Matches(record *Record) bool {
+	meta := record.Kubernetes
+
+	return q.InRange(record.Date, record.Date) &&
+		matchGlob(q.Namespace, meta.NamespaceName) &&
+		matchAnyGlob(q.Namespaces, meta.NamespaceName) &&
+		matchGlob(q.Pod, meta.PodName) &&
+		matchGlob(q.Container, meta.ContainerName) &&
+		(q.Contains == "" || strings.Contains(record.Log, q.Contains)) &&
+		(q.Regex == nil || q.Regex.MatchString(record.Log))
+}
+
+// InRange checks whether the time range [start, end] overlaps with
+// the range of the query. The upper bound of the query is exclusive.
+func (q *recordQuery) InRange(start time.Time, end time.Time) bool {
+	return (q.From.IsZero() || !end.Before(q.From)) &&
+		(q.To.IsZero() || start.Before(q.To))
+}
+
+// queryCursor points to the next record to return.
+type queryCursor struct {
+	File string `json:"f"`
+	Line int    `json:"l"`
+}
+
+// queryCursorLine is the last line of a truncated result.
+type queryCursorLine struct {
+	Cursor string `json:"cursor"`
+}
+
+func parseQueryCursor(value string) (*queryCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &queryCursor{}
+	if err := json.Unmarshal(decoded, cursor); err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+func (c *queryCursor) String() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// patternMatcher recovers the placeholder values from filenames
+// created using a filename pattern.
+type patternMatcher struct {
+	regex    *regexp.Regexp
+	location *time.Location
+}
+
+// newPatternMatcher builds a regular expression from the pattern.
+// Only the values of plain placeholders can be recovered, all others
+// (lookups or placeholders using functions) just match anything.
+func newPatternMatcher(pattern *pathTemplate) (*patternMatcher, error) {
+	// rotated files have a segment number in front of the extension
+	ext := pattern.Extension()
+
+	seen := make(map[string]struct{})
+	expr := bytes.Buffer{}
+	expr.WriteString("^")
+
+	for i, part := range pattern.parts {
+		if part.placeholder == nil {
+			literal := filepath.ToSlash(part.literal)
+			if i == len(pattern.parts)-1 {
+				literal = strings.TrimSuffix(literal, ext)
+			}
+
+			expr.WriteString(regexp.QuoteMeta(literal))
+			continue
+		}
+
+		name := part.placeholder.name
+		if _, ok := seen[name]; ok || !part.placeholder.Plain() {
+			expr.WriteString(`[^/]*?`)
+		} else {
+			fmt.Fprintf(&expr, `(?P<%s>[^/]*?)`, name)
+			seen[name] = struct{}{}
+		}
+	}
+
+	expr.WriteString(`(?:\.(?P<segment>[0-9]+))?`)
+	expr.WriteString(regexp.QuoteMeta(ext))
+	expr.WriteString("$")
+
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pattern: %w", err)
+	}
+
+	return &patternMatcher{
+		regex:    regex,
+		location: pattern.location,
+	}, nil
+}
+
+// Match returns the placeholder values of the given filename, which
+// must be relative to the target directory. Compression extensions
+// are ignored.
+func (m *patternMatcher) Match(filename string) (map[string]string, bool) {
+	_, filename = compressionByFilename(filepath.ToSlash(filename))
+
+	match := m.regex.FindStringSubmatch(filename)
+	if match == nil {
+		return nil, false
+	}
+
+	values := make(map[string]string)
+	for i, name := range m.regex.SubexpNames() {
+		if name != "" {
+			values[name] = match[i]
+		}
+	}
+
+	return values, true
+}
+
+// TimeRange returns the range of time covered by the file, based on
+// the date placeholders in its filename.
+func (m *patternMatcher) TimeRange(values map[string]string) (time.Time, time.Time, bool) {
+	var year, month, day int
+
+	if date, ok := values["date"]; ok {
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return t, t, false
+		}
+
+		year, month, day = t.Year(), int(t.Month()), t.Day()
+	} else {
+		var err error
+
+		year, err = strconv.Atoi(values["year"])
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+
+		month, err = strconv.Atoi(values["month"])
+		if err != nil {
+			start := time.Date(year, 1, 1, 0, 0, 0, 0, m.location)
+			return start, start.AddDate(1, 0, 0), true
+		}
+
+		day, err = strconv.Atoi(values["dayofmonth"])
+		if err != nil {
+			start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, m.location)
+			return start, start.AddDate(0, 1, 0), true
+		}
+	}
+
+	hour, err := strconv.Atoi(values["hour"])
+	if err != nil {
+		start := time.Date(year, time.Month(month), day, 0, 0, 0, 0, m.location)
+		return start, start.AddDate(0, 0, 1), true
+	}
+
+	start := time.Date(year, time.Month(month), day, hour, 0, 0, 0, m.location)
+
+	return start, start.Add(time.Hour), true
+}
+
+// queryFile is a file that might contain matching records.
+type queryFile struct {
+	path    string
+	base    string
+	segment int
+}
+
+// findQueryFiles lists all files in the target directory that could
+// contain matching records, in the order they should be searched.
+func findQueryFiles(target string, matcher *patternMatcher, q *recordQuery) ([]queryFile, error) {
+	files := make([]queryFile, 0)
+
+	err := filepath.Walk(target, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(target, filename)
+		if err != nil {
+			return err
+		}
+
+		values, ok := matcher.Match(rel)
+		if !ok {
+			return nil
+		}
+
+		if start, end, ok := matcher.TimeRange(values); ok && !q.InRange(start, end.Add(-time.Nanosecond)) {
+			return nil
+		}
+
+		if !matchPlaceholder(q.Namespace, values, "kubernetes_namespace_name") ||
+			!matchAnyPlaceholder(q.Namespaces, values, "kubernetes_namespace_name") ||
+			!matchPlaceholder(q.Pod, values, "kubernetes_pod_name") ||
+			!matchPlaceholder(q.Container, values, "kubernetes_container_name") {
+			return nil
+		}
+
+		files = append(files, newQueryFile(rel, values))
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Before(files[j])
+	})
+
+	return files, err
+}
+
+func newQueryFile(filename string, values map[string]string) queryFile {
+	filename = filepath.ToSlash(filename)
+	segment, _ := strconv.Atoi(values["segment"])
+	_, plain := compressionByFilename(filename)
+
+	return queryFile{
+		path:    filename,
+		base:    segmentBase(plain, values["segment"]),
+		segment: segment,
+	}
+}
+
+// Before orders files by name and rotation, with plain files after
+// compressed ones, as those contain the newer records when using
+// deferred compression.
+func (f queryFile) Before(other queryFile) bool {
+	if f.base != other.base {
+		return f.base < other.base
+	}
+
+	if f.segment != other.segment {
+		return f.segment < other.segment
+	}
+
+	return f.path > other.path
+}
+
+// matchPlaceholder checks a placeholder value against a pattern, if
+// the placeholder is part of the filename.
+func matchPlaceholder(pattern string, values map[string]string, name string) bool {
+	value, ok := values[name]
+	if !ok || pattern == "" {
+		return true
+	}
+
+	if value == placeholderFallback(name) {
+		value = ""
+	}
+
+	return matchGlob(pattern, value)
+}
+
+// matchAnyPlaceholder is like matchPlaceholder, but the value has to
+// match any of the patterns, if there are any.
+func matchAnyPlaceholder(patterns []string, values map[string]string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matchPlaceholder(pattern, values, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// segmentBase removes the segment number from a filename.
+func segmentBase(filename string, segment string) string {
+	if segment == "" {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+
+	return strings.TrimSuffix(strings.TrimSuffix(filename, ext), "."+segment) + ext
+}
+
+func makeQueryRequestHandler(config *Config, sink *sink) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		values := c.QueryParams()
+
+		// the routes can change when the configuration is reloaded
+		_, router := sink.Routing()
+
+		route := router.Route(values.Get("route"))
+		if route == nil {
+			return c.String(http.StatusBadRequest, "Unknown route.")
+		}
+
+		if route.output.Format != formatJSON {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Route %q does not write JSON and cannot be queried.", route.name))
+		}
+
+		matcher := route.files
+
+		q, err := parseRecordQuery(values)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if err := authorizeQuery(c, q); err != nil {
+			return c.String(http.StatusForbidden, fmt.Sprintf("Forbidden: %v.", err))
+		}
+
+		cursor, err := parseQueryCursor(values.Get("cursor"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid cursor.")
+		}
+
+		limit := defaultQueryLimit
+		if l := values.Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 1 || limit > maxQueryLimit {
+				return c.String(http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d.", maxQueryLimit))
+			}
+		}
+
+		files, err := findQueryFiles(route.target, matcher, q)
+		if err != nil {
+			c.Logger().Errorf("Failed to list files: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to list files.")
+		}
+
+		response := c.Response()
+		response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		response.Header().Set("Trailer", cursorTrailer)
+		response.WriteHeader(http.StatusOK)
+
+		next, err := queryFiles(route.target, matcher, files, q, cursor, limit, response)
+		if err != nil {
+			c.Logger().Errorf("Failed to query records: %v", err)
+		}
+
+		if next != nil {
+			response.Header().Set(cursorTrailer, next.String())
+
+			// many clients do not expose trailers, so the cursor is also
+			// sent as the last line
+			line, _ := json.Marshal(queryCursorLine{Cursor: next.String()})
+			if _, err := response.Write(append(line, '\n')); err != nil {
+				c.Logger().Errorf("Failed to write cursor: %v", err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// queryFiles writes up to limit matching records to w and returns
+// a cursor pointing to the next record, if the limit was reached.
+func queryFiles(target string, matcher *patternMatcher, files []queryFile, q *recordQuery, cursor *queryCursor, limit int, w *echo.Response) (*queryCursor, error) {
+	found := 0
+
+	for _, file := range files {
+		skip := 0
+
+		if cursor != nil {
+			if file.path == cursor.File {
+				skip = cursor.Line
+			} else {
+				// the file from the cursor might have been compressed or
+				// removed in the meantime, so continue with the next one
+				values, _ := matcher.Match(cursor.File)
+				if !newQueryFile(cursor.File, values).Before(file) {
+					continue
+				}
+			}
+
+			cursor = nil
+		}
+
+		line, err := searchFile(filepath.Join(target, file.path), q, skip, limit-found, func(data []byte) error {
+			found++
+
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+
+			w.Flush()
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if found >= limit {
+			return &queryCursor{
+				File: file.path,
+				Line: line,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// searchFile calls emit for up to limit matching records in the file,
+// skipping the first skip lines. It returns the number of lines read.
+func searchFile(filename string, q *recordQuery, skip int, limit int, emit func([]byte) error) (int, error) {
+	f, err := openFile(filename)
+	if err != nil {
+		// files might have been compressed or removed in the meantime
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line := 0
+	found := 0
+
+	for found < limit {
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			// incomplete lines or compressed streams are still being written
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return line, nil
+			}
+
+			return line, err
+		}
+
+		line++
+
+		if line <= skip {
+			continue
+		}
+
+		record := Record{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+
+		if q.Matches(&record) {
+			found++
+
+			if err := emit(data); err != nil {
+				return line, err
+			}
+		}
+	}
+
+	return line, nil
+}
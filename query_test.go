@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// writeQueryRecords writes records with the given logs to a file in
+// the target directory.
+func writeQueryRecords(t *testing.T, config *Config, filename string, namespace string, logs ...string) {
+	filename = filepath.Join(config.Target, filename)
+	content := ""
+
+	for _, log := range logs {
+		content += fmt.Sprintf(`{"date":"2020-01-01T12:00:00Z","log":%q,"kubernetes":{"namespace_name":%q}}`, log, namespace) + "\n"
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write records: %v", err)
+	}
+}
+
+func TestQueryRequiresReadScope(t *testing.T) {
+	config := testConfig(t)
+	config.InlineAuth = &AuthConfig{
+		Users: []UserConfig{
+			{Username: "writer", Password: "secret"},
+			{Username: "reader", Password: "secret", AuthScope: AuthScope{Read: true}},
+			{Username: "team", Password: "secret", AuthScope: AuthScope{Read: true, Namespaces: []string{"default"}}},
+		},
+	}
+
+	for _, namespace := range []string{"default", "kube-system"} {
+		filename := filepath.Join(config.Target, "2020-01-01", namespace+".json")
+		record := `{"date":"2020-01-01T12:00:00Z","log":"hello","kubernetes":{"namespace_name":"` + namespace + `"}}` + "\n"
+
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+
+		if err := ioutil.WriteFile(filename, []byte(record), 0644); err != nil {
+			t.Fatalf("Failed to write records: %v", err)
+		}
+	}
+
+	auth, err := NewAuth(config)
+	if err != nil {
+		t.Fatalf("Failed to create auth: %v", err)
+	}
+
+	e := echo.New()
+	e.GET("/query", makeQueryRequestHandler(config, testSink(t, config)), auth.Middleware)
+
+	testcases := []struct {
+		username string
+		status   int
+		records  int
+	}{
+		{username: "", status: http.StatusUnauthorized},
+		{username: "writer", status: http.StatusForbidden},
+		{username: "reader", status: http.StatusOK, records: 2},
+		{username: "team", status: http.StatusOK, records: 1},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.username, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/query", nil)
+			if testcase.username != "" {
+				req.SetBasicAuth(testcase.username, "secret")
+			}
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != testcase.status {
+				t.Fatalf("Expected status %d, got %d.", testcase.status, rec.Code)
+			}
+
+			if testcase.status != http.StatusOK {
+				return
+			}
+
+			if records := strings.Count(rec.Body.String(), "\n"); records != testcase.records {
+				t.Errorf("Expected %d records, got %d: %s", testcase.records, records, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	config := testConfig(t)
+	writeQueryRecords(t, config, "2020-01-01/default.json", "default", "a", "b", "c")
+	writeQueryRecords(t, config, "2020-01-02/default.json", "default", "d", "e")
+
+	e := echo.New()
+	e.GET("/query", makeQueryRequestHandler(config, testSink(t, config)))
+
+	logs := []string{}
+	pages := 0
+	cursor := ""
+
+	for {
+		pages++
+		if pages > 10 {
+			t.Fatal("Expected the cursor to reach the end of the results.")
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/query?limit=2&cursor="+cursor, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d.", http.StatusOK, rec.Code)
+		}
+
+		cursor = ""
+
+		for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+			if cursor != "" {
+				t.Fatalf("Expected the cursor to be the last line, got %s.", line)
+			}
+
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("Failed to decode line %q: %v", line, err)
+			}
+
+			if next, ok := fields["cursor"]; ok {
+				cursor = next.(string)
+				continue
+			}
+
+			logs = append(logs, fields["log"].(string))
+		}
+
+		if trailer := rec.Result().Trailer.Get(cursorTrailer); trailer != cursor {
+			t.Fatalf("Expected the trailer to contain cursor %q, got %q.", cursor, trailer)
+		}
+
+		if cursor == "" {
+			break
+		}
+	}
+
+	if expected := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(logs, expected) {
+		t.Errorf("Expected records %v, got %v.", expected, logs)
+	}
+
+	if pages != 3 {
+		t.Errorf("Expected 3 pages, got %d.", pages)
+	}
+}
+
+func TestQueryFilesNamespaceScope(t *testing.T) {
+	config := testConfig(t)
+	for _, namespace := range []string{"default", "kube-public", "kube-system"} {
+		writeQueryRecords(t, config, "2020-01-01/"+namespace+".json", namespace, "hello")
+	}
+
+	_, router := testSink(t, config).Routing()
+	route := router.Route("")
+
+	testcases := []struct {
+		namespace string
+		scope     []string
+		expected  []string
+	}{
+		{
+			expected: []string{"2020-01-01/default.json", "2020-01-01/kube-public.json", "2020-01-01/kube-system.json"},
+		},
+		{
+			scope:    []string{"kube-*"},
+			expected: []string{"2020-01-01/kube-public.json", "2020-01-01/kube-system.json"},
+		},
+		{
+			scope:    []string{"default", "kube-system"},
+			expected: []string{"2020-01-01/default.json", "2020-01-01/kube-system.json"},
+		},
+		{
+			namespace: "kube-*",
+			scope:     []string{"default", "kube-system"},
+			expected:  []string{"2020-01-01/kube-system.json"},
+		},
+		{
+			scope:    []string{"web"},
+			expected: []string{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		q := &recordQuery{Namespace: testcase.namespace, Namespaces: testcase.scope}
+
+		files, err := findQueryFiles(route.target, route.files, q)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+
+		paths := []string{}
+		for _, file := range files {
+			paths = append(paths, file.path)
+		}
+		sort.Strings(paths)
+
+		if !reflect.DeepEqual(paths, testcase.expected) {
+			t.Errorf("Expected %v for namespace %q and scope %v, got %v.", testcase.expected, testcase.namespace, testcase.scope, paths)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// queuePolicyBlock waits for free capacity, up to a timeout.
+	queuePolicyBlock = "block"
+
+	// queuePolicyReject rejects payloads that do not fit.
+	queuePolicyReject = "reject"
+
+	// queuePolicyDropOldest makes room by discarding queued records.
+	queuePolicyDropOldest = "drop-oldest"
+)
+
+// QueueOptions control how many records can be waiting to be written
+// and what happens if more records are received.
+type QueueOptions struct {
+	Size       int
+	Policy     string
+	Timeout    time.Duration
+	RetryAfter time.Duration
+}
+
+// errQueueFull is returned when a payload could not be queued; clients
+// are expected to retry later.
+var errQueueFull = errors.New("job queue is full")
+
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case queuePolicyBlock, queuePolicyReject, queuePolicyDropOldest:
+		return nil
+	default:
+		return fmt.Errorf("invalid queue policy %q, must be one of block, reject or drop-oldest", policy)
+	}
+}
+
+// queueCapacity keeps track of the number of records waiting to be
+// written. A reservation always succeeds if the queue is empty, so
+// that payloads larger than the queue can make progress.
+type queueCapacity struct {
+	lock    sync.Mutex
+	size    int
+	pending int
+
+	// freed is closed whenever capacity is released and there
+	// are goroutines waiting for it.
+	freed chan struct{}
+}
+
+func newQueueCapacity(size int) *queueCapacity {
+	return &queueCapacity{
+		size: size,
+	}
+}
+
+func (q *queueCapacity) fits(n int) bool {
+	return q.pending == 0 || q.pending+n <= q.size
+}
+
+// TryReserve reserves capacity for n records, if available.
+func (q *queueCapacity) TryReserve(n int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.fits(n) {
+		return false
+	}
+
+	q.pending += n
+
+	return true
+}
+
+// Reserve waits up to the timeout for capacity for n records.
+func (q *queueCapacity) Reserve(n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		q.lock.Lock()
+
+		if q.fits(n) {
+			q.pending += n
+			q.lock.Unlock()
+
+			return true
+		}
+
+		if q.freed == nil {
+			q.freed = make(chan struct{})
+		}
+
+		freed := q.freed
+		q.lock.Unlock()
+
+		select {
+		case <-freed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// ForceReserve reserves capacity regardless of the current usage.
+func (q *queueCapacity) ForceReserve(n int) {
+	q.lock.Lock()
+	q.pending += n
+	q.lock.Unlock()
+}
+
+// Release frees capacity for n records.
+func (q *queueCapacity) Release(n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending -= n
+
+	if q.freed != nil {
+		close(q.freed)
+		q.freed = nil
+	}
+}
+
+// Pending returns the number of records currently queued.
+func (q *queueCapacity) Pending() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.pending
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -12,23 +17,256 @@ type Payload struct {
 	Records []*Record
 }
 
+// Record is a single log record. The typed fields are decoded views
+// on the original JSON object, which is kept as-is so that records
+// can be written to disk without losing any information. Use SetField
+// to modify a record, as changes to the typed fields are not encoded,
+// unless the record has been built from the typed fields alone.
 type Record struct {
-	Date       time.Time          `json:"date"`
-	Log        string             `json:"log"`
-	Kubernetes KubernetesMetadata `json:"kubernetes"`
+	Date       time.Time
+	Log        string
+	Kubernetes KubernetesMetadata
+	Syslog     SyslogMetadata
+
+	fields map[string]json.RawMessage
+}
+
+// newRecord creates a record from decoded values, for example from
+// a non-JSON input format.
+func newRecord(fields map[string]interface{}) (*Record, error) {
+	record := &Record{
+		fields: make(map[string]json.RawMessage, len(fields)),
+	}
+
+	for name, value := range fields {
+		if err := record.SetField(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	record := Record{
+		fields: fields,
+	}
+
+	for name, value := range fields {
+		if err := record.decodeField(name, value); err != nil {
+			return fmt.Errorf("invalid field %q: %w", name, err)
+		}
+	}
+
+	*r = record
+
+	return nil
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	fields := r.fields
+
+	// records that were only built from the typed fields have no
+	// original encoding
+	if fields == nil {
+		var err error
+
+		fields, err = r.typedFields()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		encoded, err := encodeJSON(name)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(encoded)
+		buf.WriteByte(':')
+		buf.Write(fields[name])
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
 }
 
-func (r *Record) StringReplacements(tag string) []string {
-	t := r.Date.UTC()
+// typedFields encodes the typed fields that are set.
+func (r Record) typedFields() (map[string]json.RawMessage, error) {
+	values := map[string]interface{}{
+		"log": r.Log,
+	}
+
+	if !r.Date.IsZero() {
+		values["date"] = r.Date
+	}
+
+	if !reflect.DeepEqual(r.Kubernetes, KubernetesMetadata{}) {
+		values["kubernetes"] = r.Kubernetes
+	}
 
-	replacements := make([]string, 0)
-	replacements = addReplacement(replacements, "year", t.Format("2006"))
-	replacements = addReplacement(replacements, "month", t.Format("01"))
-	replacements = addReplacement(replacements, "dayofmonth", t.Format("02"))
-	replacements = addReplacement(replacements, "date", t.Format("2006-01-02"))
-	replacements = addReplacement(replacements, "tag", tag)
+	if !reflect.DeepEqual(r.Syslog, SyslogMetadata{}) {
+		values["syslog"] = r.Syslog
+	}
+
+	fields := make(map[string]json.RawMessage, len(values))
+
+	for name, value := range values {
+		encoded, err := encodeJSON(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode field %q: %w", name, err)
+		}
+
+		fields[name] = encoded
+	}
+
+	return fields, nil
+}
+
+// Field returns the original JSON encoding of a top-level field.
+func (r *Record) Field(name string) (json.RawMessage, bool) {
+	value, ok := r.fields[name]
+	return value, ok
+}
+
+// FieldNames returns the sorted names of all top-level fields.
+func (r *Record) FieldNames() []string {
+	names := make([]string, 0, len(r.fields))
+	for name := range r.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	return append(replacements, r.Kubernetes.StringReplacements()...)
+	return names
+}
+
+// SetField encodes the given value and stores it as a top-level
+// field, updating the typed fields accordingly.
+func (r *Record) SetField(name string, value interface{}) error {
+	encoded, err := encodeJSON(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode field %q: %w", name, err)
+	}
+
+	if err := r.decodeField(name, encoded); err != nil {
+		return fmt.Errorf("invalid field %q: %w", name, err)
+	}
+
+	if r.fields == nil {
+		r.fields = make(map[string]json.RawMessage)
+	}
+
+	r.fields[name] = encoded
+
+	return nil
+}
+
+func (r *Record) decodeField(name string, value json.RawMessage) error {
+	switch name {
+	case "date":
+		date, err := decodeDate(value)
+		if err != nil {
+			return err
+		}
+
+		r.Date = date
+
+	case "log":
+		r.Log = ""
+		return json.Unmarshal(value, &r.Log)
+
+	case "kubernetes":
+		r.Kubernetes = KubernetesMetadata{}
+		return json.Unmarshal(value, &r.Kubernetes)
+
+	case "syslog":
+		r.Syslog = SyslogMetadata{}
+		return json.Unmarshal(value, &r.Syslog)
+	}
+
+	return nil
+}
+
+// decodeDate parses either an ISO8601 string or a floating point
+// UNIX timestamp, the date formats supported by fluent-bit.
+func decodeDate(value json.RawMessage) (time.Time, error) {
+	var date time.Time
+
+	if bytes.Equal(value, []byte("null")) {
+		return date, nil
+	}
+
+	if len(value) > 0 && value[0] == '"' {
+		err := json.Unmarshal(value, &date)
+		return date, err
+	}
+
+	var timestamp float64
+	if err := json.Unmarshal(value, &timestamp); err != nil {
+		return date, err
+	}
+
+	// float64 cannot represent nanoseconds for current timestamps,
+	// so round to microseconds like fluent-bit does
+	micros := int64(math.Round(timestamp * 1e6))
+
+	return time.Unix(0, micros*int64(time.Microsecond)).UTC(), nil
+}
+
+// encodeJSON encodes a value without escaping HTML characters,
+// so that log lines are written to disk unmodified.
+func encodeJSON(value interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// Placeholders returns the raw values of all named placeholders for
+// filename patterns, with times in the given location.
+func (r *Record) Placeholders(tag string, location *time.Location) map[string]string {
+	t := r.Date.In(location)
+
+	values := map[string]string{
+		"year":       t.Format("2006"),
+		"month":      t.Format("01"),
+		"dayofmonth": t.Format("02"),
+		"date":       t.Format("2006-01-02"),
+		"hour":       t.Format("15"),
+		"minute":     t.Format("04"),
+		"tag":        tag,
+	}
+
+	r.Kubernetes.Placeholders(values)
+	r.Syslog.Placeholders(values)
+
+	return values
 }
 
 type KubernetesMetadata struct {
@@ -44,33 +282,40 @@ type KubernetesMetadata struct {
 
 var labelSanitiser = regexp.MustCompile(`[^a-z0-9_]`)
 
-func (m *KubernetesMetadata) StringReplacements() []string {
-	replacements := make([]string, 0)
-	replacements = addReplacement(replacements, "kubernetes_pod_name", m.PodName)
-	replacements = addReplacement(replacements, "kubernetes_namespace_name", m.NamespaceName)
-	replacements = addReplacement(replacements, "kubernetes_pod_id", m.PodID)
-	replacements = addReplacement(replacements, "kubernetes_host", m.Host)
-	replacements = addReplacement(replacements, "kubernetes_container_name", m.ContainerName)
-	replacements = addReplacement(replacements, "kubernetes_docker_id", m.DockerID)
+func (m *KubernetesMetadata) Placeholders(values map[string]string) {
+	values["kubernetes_pod_name"] = m.PodName
+	values["kubernetes_namespace_name"] = m.NamespaceName
+	values["kubernetes_pod_id"] = m.PodID
+	values["kubernetes_host"] = m.Host
+	values["kubernetes_container_name"] = m.ContainerName
+	values["kubernetes_docker_id"] = m.DockerID
 
 	for name, value := range m.Labels {
-		name = fmt.Sprintf("kubernetes_label_%s", labelSanitiser.ReplaceAllString(strings.ToLower(name), "_"))
-
-		replacements = addReplacement(replacements, name, value)
+		values[labelPlaceholder(name)] = value
 	}
+}
+
+// labelPlaceholder returns the placeholder name for a Kubernetes label.
+func labelPlaceholder(label string) string {
+	return fmt.Sprintf("kubernetes_label_%s", labelSanitiser.ReplaceAllString(strings.ToLower(label), "_"))
+}
 
-	return replacements
+// placeholderFallback returns the value used for empty placeholders.
+func placeholderFallback(name string) string {
+	return fmt.Sprintf("NO_%s", strings.ToUpper(name))
 }
 
 var fsSanitiser = regexp.MustCompile(`[^a-zA-Z0-9_,;. -]`)
 
-func addReplacement(list []string, name string, value string) []string {
-	if value == "" {
-		value = fmt.Sprintf("NO_%s", strings.ToUpper(name))
-	}
+// sanitisePathElement makes a placeholder value safe to be used in a
+// filename. Values consisting only of dots would otherwise allow
+// records to escape the target directory.
+func sanitisePathElement(value string) string {
+	value = fsSanitiser.ReplaceAllString(value, "_")
 
-	name = fmt.Sprintf("%%%s%%", name)
-	list = append(list, name, fsSanitiser.ReplaceAllString(value, "_"))
+	if strings.Trim(value, ".") == "" {
+		value = strings.Repeat("_", len(value))
+	}
 
-	return list
+	return value
 }
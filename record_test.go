@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// canonicalJSON re-encodes a JSON value with sorted keys, keeping
+// numbers as they were written.
+func canonicalJSON(t *testing.T, data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("Failed to decode %s: %v", string(data), err)
+	}
+
+	encoded, err := encodeJSON(value)
+	if err != nil {
+		t.Fatalf("Failed to encode value: %v", err)
+	}
+
+	return string(encoded)
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	testcases := []string{
+		`{}`,
+		`{"log":"hello"}`,
+		`{"date":"2020-01-01T12:00:00.123456Z","log":"hello","stream":"stdout","time":"2020-01-01T12:00:00.123456789Z"}`,
+		`{"date":1577880000.123456,"log":"<b>&amp;</b>","kubernetes":{"namespace_name":"default","namespace_labels":{"team":"a"},"labels":{"app":"web"}}}`,
+		`{"z":1,"a":2,"m":{"y":[1,2.50,1e3,-0],"b":null},"log":"é\n","nested":{"deep":{"deeper":[{"x":true},{"x":false}]}}}`,
+		`{"log":"x","huge":123456789012345678901234567890,"float":1.0000000000000001}`,
+	}
+
+	for _, input := range testcases {
+		t.Run(input, func(t *testing.T) {
+			record := &Record{}
+			if err := json.Unmarshal([]byte(input), record); err != nil {
+				t.Fatalf("Failed to decode record: %v", err)
+			}
+
+			encoded, err := json.Marshal(record)
+			if err != nil {
+				t.Fatalf("Failed to encode record: %v", err)
+			}
+
+			if expected, actual := canonicalJSON(t, []byte(input)), canonicalJSON(t, encoded); expected != actual {
+				t.Fatalf("Expected\n%s\ngot\n%s", expected, actual)
+			}
+
+			// encoding again yields the very same bytes
+			again := &Record{}
+			if err := json.Unmarshal(encoded, again); err != nil {
+				t.Fatalf("Failed to decode encoded record: %v", err)
+			}
+
+			reencoded, err := json.Marshal(again)
+			if err != nil {
+				t.Fatalf("Failed to encode record: %v", err)
+			}
+
+			if !bytes.Equal(encoded, reencoded) {
+				t.Fatalf("Expected\n%s\ngot\n%s", string(encoded), string(reencoded))
+			}
+		})
+	}
+}
+
+func TestRecordSortsKeys(t *testing.T) {
+	record := &Record{}
+	if err := json.Unmarshal([]byte(`{"z":1,"log":"hello","a":{"d":1,"c":2}}`), record); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+
+	// top-level keys are sorted, nested values are kept as-is
+	if expected := `{"a":{"d":1,"c":2},"log":"hello","z":1}`; string(encoded) != expected {
+		t.Fatalf("Expected %s, got %s.", expected, string(encoded))
+	}
+}
+
+func TestRecordFromTypedFields(t *testing.T) {
+	record := Record{
+		Date: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Log:  "hello",
+		Kubernetes: KubernetesMetadata{
+			NamespaceName: "default",
+		},
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+
+	decoded := &Record{}
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+
+	if !decoded.Date.Equal(record.Date) || decoded.Log != record.Log || decoded.Kubernetes.NamespaceName != "default" {
+		t.Fatalf("Typed fields were not encoded, got %s.", string(encoded))
+	}
+
+	if _, exists := decoded.Field("syslog"); exists {
+		t.Fatalf("Expected empty syslog metadata to be omitted, got %s.", string(encoded))
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadableSettings are the flags that only affect filter rules,
+// routes and credentials and can therefore be changed without a
+// restart.
+var reloadableSettings = map[string]struct{}{
+	"target":             {},
+	"pattern":            {},
+	"timezone":           {},
+	"filter-rules":       {},
+	"routes":             {},
+	"format":             {},
+	"columns":            {},
+	"rotate-size":        {},
+	"rotate-records":     {},
+	"rotate-age":         {},
+	"compression":        {},
+	"compression-mode":   {},
+	"flush-size":         {},
+	"fsync":              {},
+	"retention-max-age":  {},
+	"retention-max-size": {},
+	"retention-archive":  {},
+	"auth":               {},
+}
+
+// reloader reloads the filter rules and routes on SIGHUP or whenever
+// one of the configuration files changes.
+type reloader struct {
+	args       []string
+	flags      *flag.FlagSet
+	interval   time.Duration
+	sink       *sink
+	retention  *retention
+	auth       *auth
+	logger     logrus.FieldLogger
+	files      map[string]fileState
+	signals    chan os.Signal
+	killswitch chan struct{}
+	alive      chan struct{}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader creates a reloader for the running configuration, which
+// was loaded from the given flags.
+func NewReloader(config *Config, flags *flag.FlagSet, sink *sink, retention *retention, auth *auth, logger logrus.FieldLogger) (*reloader, error) {
+	if config.ReloadInterval < 0 {
+		return nil, fmt.Errorf("reload interval must not be negative")
+	}
+
+	r := &reloader{
+		args:       os.Args[1:],
+		flags:      flags,
+		interval:   config.ReloadInterval,
+		sink:       sink,
+		retention:  retention,
+		auth:       auth,
+		logger:     logger,
+		files:      watchedFiles(config),
+		signals:    make(chan os.Signal, 1),
+		killswitch: make(chan struct{}),
+		alive:      make(chan struct{}),
+	}
+
+	signal.Notify(r.signals, syscall.SIGHUP)
+
+	return r, nil
+}
+
+// watchedFiles returns the current state of all configuration files.
+// Files that do not exist are included as well, so that creating them
+// is noticed.
+func watchedFiles(config *Config) map[string]fileState {
+	files := make(map[string]fileState)
+
+	for _, filename := range []string{config.ConfigFile, config.FilterRules, config.Routes, config.Auth} {
+		if filename == "" {
+			continue
+		}
+
+		files[filename] = statFile(filename)
+	}
+
+	return files
+}
+
+func statFile(filename string) fileState {
+	state := fileState{}
+
+	if info, err := os.Stat(filename); err == nil {
+		state.modTime = info.ModTime()
+		state.size = info.Size()
+	}
+
+	return state
+}
+
+// Run is meant to run as a separate goroutine and reloads the
+// configuration until Close() is called.
+func (r *reloader) Run() {
+	defer close(r.alive)
+
+	// a nil channel disables watching the files
+	var poll <-chan time.Time
+
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.killswitch:
+			return
+
+		case <-r.signals:
+			r.logger.Info("Received SIGHUP, reloading configuration…")
+			r.reload()
+
+		case <-poll:
+			if r.changed() {
+				r.logger.Info("Configuration changed, reloading…")
+				r.reload()
+			}
+		}
+	}
+}
+
+// Close stops the reloader goroutine and waits for it to end.
+func (r *reloader) Close() {
+	signal.Stop(r.signals)
+	close(r.killswitch)
+	<-r.alive
+}
+
+func (r *reloader) changed() bool {
+	for filename, state := range r.files {
+		if statFile(filename) != state {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *reloader) reload() {
+	if err := r.apply(); err != nil {
+		r.logger.Errorf("Failed to reload configuration, keeping the previous one: %v", err)
+		configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+
+	r.logger.Info("Configuration reloaded.")
+	configReloads.WithLabelValues("success").Inc()
+}
+
+func (r *reloader) apply() error {
+	// do not retry a broken configuration until it changes again
+	for filename := range r.files {
+		r.files[filename] = statFile(filename)
+	}
+
+	config, flags, err := loadConfig(r.args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+
+	// the filter rules and routes might be read from other files now
+	r.files = watchedFiles(config)
+
+	filter, err := NewFilter(config)
+	if err != nil {
+		return fmt.Errorf("failed to create filter: %w", err)
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		return fmt.Errorf("failed to set up routes: %w", err)
+	}
+
+	if err := validateFlushPolicy(config.Output.Flush); err != nil {
+		return err
+	}
+
+	authMethods, err := loadAuthMethods(config)
+	if err != nil {
+		return fmt.Errorf("failed to set up authentication: %w", err)
+	}
+
+	r.warnAboutRestart(flags)
+
+	r.sink.Reload(filter, router)
+	r.retention.SetTargets(router)
+	r.auth.SetMethods(authMethods)
+
+	return nil
+}
+
+// warnAboutRestart logs all changed settings that cannot be reloaded.
+func (r *reloader) warnAboutRestart(flags *flag.FlagSet) {
+	r.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := reloadableSettings[f.Name]; ok {
+			return
+		}
+
+		if value := flags.Lookup(f.Name).Value.String(); value != f.Value.String() {
+			r.logger.Warnf("Changing -%s to %q requires a restart, still using %q.", f.Name, value, f.Value.String())
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy decides when files in the target directory are
+// removed. Zero values disable the respective limit.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxSize  int64
+	Archive  string
+	Interval time.Duration
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxSize > 0
+}
+
+type retention struct {
+	lock       sync.Mutex
+	targets    []retentionTarget
+	interval   time.Duration
+	sink       *sink
+	logger     logrus.FieldLogger
+	killswitch chan struct{}
+	alive      chan struct{}
+}
+
+// retentionTarget is a target directory and the policy of the routes
+// writing to it.
+type retentionTarget struct {
+	directory string
+	policy    RetentionPolicy
+}
+
+func NewRetention(config *Config, router *router, sink *sink, logger logrus.FieldLogger) (*retention, error) {
+	if config.Retention.Interval <= 0 {
+		return nil, fmt.Errorf("retention interval must be positive")
+	}
+
+	return &retention{
+		targets:    retentionTargets(router),
+		interval:   config.Retention.Interval,
+		sink:       sink,
+		logger:     logger,
+		killswitch: make(chan struct{}),
+		alive:      make(chan struct{}),
+	}, nil
+}
+
+func retentionTargets(router *router) []retentionTarget {
+	targets := make([]retentionTarget, 0)
+
+	for _, route := range router.Targets() {
+		targets = append(targets, retentionTarget{
+			directory: route.target,
+			policy:    route.retention,
+		})
+	}
+
+	return targets
+}
+
+// SetTargets replaces the target directories after the routes have
+// been reloaded.
+func (r *retention) SetTargets(router *router) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.targets = retentionTargets(router)
+}
+
+// validateArchive makes sure that archived files are not moved into
+// the target directory, where they would be subject to retention again.
+func validateArchive(target string, archive string) error {
+	if archive == "" {
+		return nil
+	}
+
+	if insideDirectory(target, archive) {
+		return fmt.Errorf("archive directory must not be inside the target directory")
+	}
+
+	return nil
+}
+
+// Run is meant to run as a separate goroutine and periodically
+// enforces the retention policy. This goroutine ends when you
+// call Close().
+func (r *retention) Run() {
+	defer close(r.alive)
+
+	for {
+		for _, err := range r.enforce() {
+			r.logger.Errorf("Failed to enforce retention policy: %v", err)
+		}
+
+		select {
+		case <-r.killswitch:
+			return
+
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// Close stops the retention goroutine and waits for it to end.
+func (r *retention) Close() {
+	close(r.killswitch)
+	<-r.alive
+}
+
+type retainedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// enforce applies the retention policy to all targets and returns the
+// errors of those that could not be processed.
+func (r *retention) enforce() []error {
+	r.logger.Debug("Enforcing retention policy...")
+
+	r.lock.Lock()
+	targets := r.targets
+	r.lock.Unlock()
+
+	total := int64(0)
+	errs := make([]error, 0)
+
+	// a broken target must not keep the others from being cleaned up
+	for _, target := range targets {
+		size, err := r.enforceTarget(target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list files in %s: %w", target.directory, err))
+			continue
+		}
+
+		total += size
+	}
+
+	targetBytes.Set(float64(total))
+
+	r.logger.Debug("Done enforcing retention policy.")
+
+	return errs
+}
+
+// enforceTarget applies the policy to a single target directory and
+// returns the remaining size of all its files.
+func (r *retention) enforceTarget(target retentionTarget) (int64, error) {
+	files, total, err := listFiles(target.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	policy := target.policy
+
+	if policy.Enabled() {
+		now := time.Now()
+
+		// oldest files first
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+
+		for _, file := range files {
+			expired := policy.MaxAge > 0 && now.Sub(file.modTime) > policy.MaxAge
+			tooLarge := policy.MaxSize > 0 && total > policy.MaxSize
+
+			if !expired && !tooLarge {
+				break
+			}
+
+			// whether a file is open is checked right before removing it,
+			// as writers come and go while the directory is processed
+			removed, err := r.sink.RemoveUnlessOpen(file.path, func() error {
+				return r.remove(target, file)
+			})
+			if err != nil {
+				r.logger.Errorf("Failed to remove %s: %v", file.path, err)
+				continue
+			}
+
+			if !removed {
+				continue
+			}
+
+			total -= file.size
+		}
+
+		removeEmptyDirectories(target.directory)
+	}
+
+	return total, nil
+}
+
+func listFiles(target string) ([]retainedFile, int64, error) {
+	files := make([]retainedFile, 0)
+	total := int64(0)
+
+	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		total += info.Size()
+
+		// files that are currently being compressed will be gone soon
+		if strings.HasSuffix(path, archiveSuffix) {
+			return nil
+		}
+
+		files = append(files, retainedFile{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+
+		return nil
+	})
+
+	return files, total, err
+}
+
+func (r *retention) remove(target retentionTarget, file retainedFile) error {
+	if target.policy.Archive == "" {
+		r.logger.Debugf("Deleting %s ...", file.path)
+
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+
+		retentionDeletedFiles.Inc()
+		retentionDeletedBytes.Add(float64(file.size))
+
+		return nil
+	}
+
+	rel, err := filepath.Rel(target.directory, file.path)
+	if err != nil {
+		return err
+	}
+
+	destination := filepath.Join(target.policy.Archive, rel)
+
+	r.logger.Debugf("Archiving %s to %s ...", file.path, destination)
+
+	if err := moveFile(file.path, destination); err != nil {
+		return err
+	}
+
+	retentionArchivedFiles.Inc()
+	retentionArchivedBytes.Add(float64(file.size))
+
+	return nil
+}
+
+// removeEmptyDirectories removes all empty directories below the
+// target directory, deepest first.
+func removeEmptyDirectories(target string) {
+	directories := make([]string, 0)
+
+	filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != target {
+			directories = append(directories, path)
+		}
+
+		return nil
+	})
+
+	// do not remove directories that might have just been created
+	// by a new writer
+	threshold := time.Now().Add(-time.Minute)
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		info, err := os.Stat(directories[i])
+		if err != nil || info.ModTime().After(threshold) {
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(directories[i])
+		if err == nil && len(entries) == 0 {
+			os.Remove(directories[i])
+		}
+	}
+}
+
+// moveFile renames a file, falling back to copying it if source and
+// destination are on different filesystems.
+func moveFile(source string, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(source, destination); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(destination)
+
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(destination)
+		return err
+	}
+
+	return os.Remove(source)
+}
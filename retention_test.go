@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// writeRetentionFiles creates files of the given size in bytes, last
+// modified the given time ago.
+func writeRetentionFiles(t *testing.T, dir string, files map[string]time.Duration, size int) {
+	for name, age := range files {
+		filename := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+
+		if err := ioutil.WriteFile(filename, []byte(strings.Repeat("x", size)), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", filename, err)
+		}
+
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time of %s: %v", filename, err)
+		}
+	}
+}
+
+// remainingFiles returns the files below dir, relative to it.
+func remainingFiles(t *testing.T, dir string) []string {
+	files := make([]string, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+func testRetention(s *sink, targets ...retentionTarget) *retention {
+	return &retention{
+		targets: targets,
+		sink:    s,
+		logger:  testLogger(),
+	}
+}
+
+func targetBytesValue(t *testing.T) float64 {
+	metric := &dto.Metric{}
+	if err := targetBytes.Write(metric); err != nil {
+		t.Fatalf("Failed to read metric: %v", err)
+	}
+
+	return metric.GetGauge().GetValue()
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	writeRetentionFiles(t, dir, map[string]time.Duration{
+		"2020-01-01/a.json": 3 * time.Hour,
+		"2020-01-01/b.json": 2 * time.Hour,
+		"2020-01-02/a.json": 30 * time.Minute,
+	}, 100)
+
+	r := testRetention(writersTestSink(0, time.Minute), retentionTarget{
+		directory: dir,
+		policy:    RetentionPolicy{MaxAge: time.Hour},
+	})
+
+	if errs := r.enforce(); len(errs) > 0 {
+		t.Fatalf("Failed to enforce retention: %v", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"2020-01-02/a.json"}) {
+		t.Fatalf("Expected only the recent file to be left, got %v.", files)
+	}
+
+	if size := targetBytesValue(t); size != 100 {
+		t.Errorf("Expected 100 bytes to be left, got %v.", size)
+	}
+}
+
+func TestRetentionMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	writeRetentionFiles(t, dir, map[string]time.Duration{
+		"a.json": 3 * time.Hour,
+		"b.json": 2 * time.Hour,
+		"c.json": time.Hour,
+	}, 100)
+
+	r := testRetention(writersTestSink(0, time.Minute), retentionTarget{
+		directory: dir,
+		policy:    RetentionPolicy{MaxSize: 250},
+	})
+
+	if errs := r.enforce(); len(errs) > 0 {
+		t.Fatalf("Failed to enforce retention: %v", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"b.json", "c.json"}) {
+		t.Fatalf("Expected the oldest file to be removed, got %v.", files)
+	}
+
+	if size := targetBytesValue(t); size != 200 {
+		t.Errorf("Expected 200 bytes to be left, got %v.", size)
+	}
+}
+
+func TestRetentionArchivesFiles(t *testing.T) {
+	dir := t.TempDir()
+	archive := t.TempDir()
+
+	writeRetentionFiles(t, dir, map[string]time.Duration{
+		"2020-01-01/a.json": 2 * time.Hour,
+		"2020-01-02/a.json": 0,
+	}, 100)
+
+	r := testRetention(writersTestSink(0, time.Minute), retentionTarget{
+		directory: dir,
+		policy:    RetentionPolicy{MaxAge: time.Hour, Archive: archive},
+	})
+
+	if errs := r.enforce(); len(errs) > 0 {
+		t.Fatalf("Failed to enforce retention: %v", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"2020-01-02/a.json"}) {
+		t.Errorf("Expected only the recent file to be left, got %v.", files)
+	}
+
+	if files := remainingFiles(t, archive); !reflect.DeepEqual(files, []string{"2020-01-01/a.json"}) {
+		t.Errorf("Expected the old file to be archived, got %v.", files)
+	}
+}
+
+func TestRetentionKeepsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeRetentionFiles(t, dir, map[string]time.Duration{
+		"open.json":    3 * time.Hour,
+		"closing.json": 3 * time.Hour,
+		"closed.json":  3 * time.Hour,
+	}, 100)
+
+	s := writersTestSink(0, time.Minute)
+
+	for _, name := range []string{"open.json", "closing.json"} {
+		if _, err := s.writerFor(filepath.Join(dir, name), WriterOptions{Format: formatJSON}); err != nil {
+			t.Fatalf("Failed to open writer: %v", err)
+		}
+	}
+
+	// a writer that is still being closed by another worker
+	s.lock.Lock()
+	closing := filepath.Join(dir, "closing.json")
+	s.startClosing(closing, s.writers[closing])
+	delete(s.writers, closing)
+	s.lock.Unlock()
+
+	r := testRetention(s, retentionTarget{
+		directory: dir,
+		policy:    RetentionPolicy{MaxAge: time.Hour},
+	})
+
+	if errs := r.enforce(); len(errs) > 0 {
+		t.Fatalf("Failed to enforce retention: %v", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"closing.json", "open.json"}) {
+		t.Fatalf("Expected open files to be kept, got %v.", files)
+	}
+
+	// once closed, the file can be removed
+	s.finishClosing(closing, s.closing[closing].writer)
+
+	if errs := r.enforce(); len(errs) > 0 {
+		t.Fatalf("Failed to enforce retention: %v", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"open.json"}) {
+		t.Fatalf("Expected the closed file to be removed, got %v.", files)
+	}
+}
+
+func TestRetentionContinuesAfterError(t *testing.T) {
+	broken := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(broken, nil, 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	dir := t.TempDir()
+	writeRetentionFiles(t, dir, map[string]time.Duration{
+		"old.json": 2 * time.Hour,
+		"new.json": 0,
+	}, 100)
+
+	policy := RetentionPolicy{MaxAge: time.Hour}
+
+	r := testRetention(writersTestSink(0, time.Minute),
+		// a directory below a file cannot be listed
+		retentionTarget{directory: filepath.Join(broken, "target"), policy: policy},
+		retentionTarget{directory: dir, policy: policy},
+	)
+
+	if errs := r.enforce(); len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v.", errs)
+	}
+
+	if files := remainingFiles(t, dir); !reflect.DeepEqual(files, []string{"new.json"}) {
+		t.Fatalf("Expected the second target to be cleaned up, got %v.", files)
+	}
+
+	if size := targetBytesValue(t); size != 100 {
+		t.Errorf("Expected 100 bytes to be left, got %v.", size)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultRouteName = "default"
+
+// Routes is the structure of the file given via -routes.
+type Routes struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig decides where matching records are written to. Empty
+// settings default to the respective command line flags.
+type RouteConfig struct {
+	Name            string         `json:"name"`
+	Match           RecordMatch    `json:"match"`
+	Target          string         `json:"target"`
+	Pattern         string         `json:"pattern"`
+	Format          string         `json:"format"`
+	Columns         []string       `json:"columns"`
+	Compression     string         `json:"compression"`
+	CompressionMode string         `json:"compression_mode"`
+	Rotation        RouteRotation  `json:"rotation"`
+	Retention       RouteRetention `json:"retention"`
+
+	// Continue delivers matching records to the following routes as
+	// well, instead of stopping at this route.
+	Continue bool `json:"continue"`
+}
+
+type RouteRotation struct {
+	MaxBytes   int64    `json:"max_bytes"`
+	MaxRecords int      `json:"max_records"`
+	MaxAge     duration `json:"max_age"`
+}
+
+type RouteRetention struct {
+	MaxAge  duration `json:"max_age"`
+	MaxSize int64    `json:"max_size"`
+	Archive string   `json:"archive"`
+}
+
+// duration is a time.Duration encoded as a string like "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1h\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+type route struct {
+	name      string
+	matcher   *recordMatcher
+	target    string
+	pattern   *pathTemplate
+	files     *patternMatcher
+	output    WriterOptions
+	retention RetentionPolicy
+	continues bool
+}
+
+// Path builds the final file path for a record.
+func (r *route) Path(record *Record, tag string) string {
+	return filepath.Join(r.target, r.pattern.Render(record, tag))
+}
+
+// router distributes records to the routes. Without a routes file,
+// there is a single route using the command line flags.
+type router struct {
+	routes []*route
+}
+
+func NewRouter(config *Config) (*router, error) {
+	routes := Routes{
+		Routes: []RouteConfig{{Name: defaultRouteName}},
+	}
+
+	if config.Routes != "" {
+		var err error
+
+		routes, err = loadRoutes(config.Routes)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.InlineRoutes != nil {
+		routes = *config.InlineRoutes
+	}
+
+	return newRouter(config, routes)
+}
+
+func newRouter(config *Config, routes Routes) (*router, error) {
+	if len(routes.Routes) == 0 {
+		return nil, errors.New("no routes defined")
+	}
+
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", config.Timezone, err)
+	}
+
+	r := &router{
+		routes: make([]*route, 0),
+	}
+
+	names := make(map[string]struct{})
+
+	for i, rc := range routes.Routes {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("route-%d", i)
+		}
+
+		if _, exists := names[rc.Name]; exists {
+			return nil, fmt.Errorf("duplicate route name %q", rc.Name)
+		}
+		names[rc.Name] = struct{}{}
+
+		compiled, err := compileRoute(config, rc, location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", rc.Name, err)
+		}
+
+		if err := r.checkTarget(compiled); err != nil {
+			return nil, err
+		}
+
+		r.routes = append(r.routes, compiled)
+	}
+
+	return r, nil
+}
+
+func loadRoutes(filename string) (Routes, error) {
+	routes := Routes{}
+
+	content, err := readConfigFile(filename)
+	if err != nil {
+		return routes, fmt.Errorf("failed to read routes: %w", err)
+	}
+
+	if err := decodeStrict(content, &routes); err != nil {
+		return routes, fmt.Errorf("failed to parse routes: %w", err)
+	}
+
+	return routes, nil
+}
+
+func compileRoute(config *Config, rc RouteConfig, location *time.Location) (*route, error) {
+	matcher, err := compileRecordMatch(rc.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &route{
+		name:      rc.Name,
+		matcher:   matcher,
+		target:    config.Target,
+		output:    config.Output,
+		retention: config.Retention,
+		continues: rc.Continue,
+	}
+
+	pattern := config.Pattern
+
+	if rc.Pattern != "" {
+		pattern = rc.Pattern
+	}
+
+	r.pattern, err = parsePathTemplate(pattern, location)
+	if err != nil {
+		return nil, err
+	}
+
+	r.files, err = newPatternMatcher(r.pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if rc.Format != "" {
+		r.output.Format = rc.Format
+		r.output.Columns = nil
+	}
+
+	if rc.Columns != nil {
+		r.output.Columns = rc.Columns
+	}
+
+	if r.output.Format == "" {
+		r.output.Format = formatJSON
+	}
+
+	if err := validateFormat(r.output.Format, r.output.Columns); err != nil {
+		return nil, err
+	}
+
+	if rc.Target != "" {
+		r.target = rc.Target
+	}
+
+	if rc.Compression != "" {
+		r.output.Compression = rc.Compression
+	}
+
+	if rc.CompressionMode != "" {
+		r.output.CompressionMode = rc.CompressionMode
+	}
+
+	if err := validateCompression(r.output.Compression, r.output.CompressionMode); err != nil {
+		return nil, err
+	}
+
+	// Parquet pages are compressed already, and the file cannot be read
+	// from a compressed stream.
+	if r.output.Format == formatParquet && r.output.Compression != compressionNone {
+		return nil, fmt.Errorf("the %s format cannot be combined with compression", formatParquet)
+	}
+
+	if rc.Rotation.MaxBytes > 0 {
+		r.output.Rotation.MaxBytes = rc.Rotation.MaxBytes
+	}
+
+	if rc.Rotation.MaxRecords > 0 {
+		r.output.Rotation.MaxRecords = rc.Rotation.MaxRecords
+	}
+
+	if rc.Rotation.MaxAge > 0 {
+		r.output.Rotation.MaxAge = time.Duration(rc.Rotation.MaxAge)
+	}
+
+	if rc.Retention.MaxAge > 0 {
+		r.retention.MaxAge = time.Duration(rc.Retention.MaxAge)
+	}
+
+	if rc.Retention.MaxSize > 0 {
+		r.retention.MaxSize = rc.Retention.MaxSize
+	}
+
+	if rc.Retention.Archive != "" {
+		r.retention.Archive = rc.Retention.Archive
+	}
+
+	if err := validateArchive(r.target, r.retention.Archive); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// checkTarget makes sure that routes writing to the same directory
+// agree on how it is managed. Compression and retention apply to all
+// files in a directory, regardless of the route that wrote them. Files
+// are shared by routes rendering the same path, so the output settings
+// must match as well.
+func (r *router) checkTarget(newRoute *route) error {
+	for _, existing := range r.routes {
+		same, err := sameDirectory(existing.target, newRoute.target)
+		if err != nil {
+			return err
+		}
+
+		if !same {
+			if nestedDirectory(existing.target, newRoute.target) {
+				return fmt.Errorf("routes %q and %q use nested target directories", existing.name, newRoute.name)
+			}
+
+			continue
+		}
+
+		if existing.output.Compression != newRoute.output.Compression ||
+			existing.output.CompressionMode != newRoute.output.CompressionMode ||
+			existing.retention != newRoute.retention {
+			return fmt.Errorf("routes %q and %q share a target directory, but use different compression or retention settings", existing.name, newRoute.name)
+		}
+
+		if !sameOutput(existing.output, newRoute.output) {
+			return fmt.Errorf("routes %q and %q share a target directory, but use different format, columns, rotation or flush settings", existing.name, newRoute.name)
+		}
+	}
+
+	return nil
+}
+
+func sameOutput(a WriterOptions, b WriterOptions) bool {
+	return a.Format == b.Format &&
+		strings.Join(a.Columns, ",") == strings.Join(b.Columns, ",") &&
+		a.Rotation == b.Rotation &&
+		a.Compression == b.Compression &&
+		a.CompressionMode == b.CompressionMode &&
+		a.Flush == b.Flush
+}
+
+func sameDirectory(a string, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return absA == absB, nil
+}
+
+// nestedDirectory returns true if either directory is inside the other.
+func nestedDirectory(a string, b string) bool {
+	return insideDirectory(a, b) || insideDirectory(b, a)
+}
+
+// insideDirectory returns true if dir is parent or one of its
+// subdirectories.
+func insideDirectory(parent string, dir string) bool {
+	absParent, err := filepath.Abs(parent)
+	if err != nil {
+		return false
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(absParent, absDir)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Match returns the routes a record is delivered to: the first
+// matching route and, as long as the matching routes continue, all
+// following matching routes.
+func (r *router) Match(record *Record, tag string) []*route {
+	matched := make([]*route, 0, 1)
+
+	for _, route := range r.routes {
+		if !route.matcher.Matches(record, tag) {
+			continue
+		}
+
+		matched = append(matched, route)
+
+		if !route.continues {
+			break
+		}
+	}
+
+	return matched
+}
+
+// Route returns the route with the given name, or the first route if
+// the name is empty.
+func (r *router) Route(name string) *route {
+	if name == "" {
+		return r.routes[0]
+	}
+
+	for _, route := range r.routes {
+		if route.name == name {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// archives returns true if files in the given target directory are
+// compressed once they are closed.
+func (r *router) archives(target string) bool {
+	for _, route := range r.routes {
+		if same, _ := sameDirectory(route.target, target); same && deferredCompression(route.output) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Targets returns the first route for each target directory.
+func (r *router) Targets() []*route {
+	targets := make([]*route, 0)
+
+	for i, route := range r.routes {
+		shared := false
+
+		for _, previous := range r.routes[:i] {
+			if same, _ := sameDirectory(previous.target, route.target); same {
+				shared = true
+				break
+			}
+		}
+
+		if !shared {
+			targets = append(targets, route)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutesSharingTarget(t *testing.T) {
+	testcases := []struct {
+		name  string
+		first RouteConfig
+		other RouteConfig
+		valid bool
+	}{
+		{
+			name:  "same settings",
+			other: RouteConfig{Name: "other", Pattern: "%kubernetes_pod_name%.json"},
+			valid: true,
+		},
+		{
+			name:  "different format",
+			other: RouteConfig{Name: "other", Format: formatLogfmt},
+		},
+		{
+			name:  "different columns",
+			first: RouteConfig{Format: formatCSV, Columns: []string{"date", "log"}},
+			other: RouteConfig{Name: "other", Format: formatCSV, Columns: []string{"log"}},
+		},
+		{
+			name:  "different rotation",
+			other: RouteConfig{Name: "other", Rotation: RouteRotation{MaxRecords: 10}},
+		},
+		{
+			name:  "different compression",
+			other: RouteConfig{Name: "other", Compression: compressionGzip},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			config := testConfig(t)
+
+			first := testcase.first
+			first.Name = "first"
+
+			routes := Routes{
+				Routes: []RouteConfig{first, testcase.other},
+			}
+
+			_, err := newRouter(config, routes)
+
+			if testcase.valid && err != nil {
+				t.Fatalf("Expected routes to be valid, got %v.", err)
+			}
+
+			if !testcase.valid && (err == nil || !strings.Contains(err.Error(), "share a target directory")) {
+				t.Fatalf("Expected conflicting routes to be rejected, got %v.", err)
+			}
+		})
+	}
+}
@@ -1,93 +1,521 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+// WritersOptions control how long files are kept open.
+type WritersOptions struct {
+	// TTL is how long a file is kept open after the last write.
+	TTL time.Duration
+
+	// GCInterval is how often files are checked for expiry.
+	GCInterval time.Duration
+
+	// MaxOpen limits the number of open files, 0 disables the limit.
+	MaxOpen int
+}
+
 type sink struct {
 	config       *Config
+	routingLock  sync.RWMutex
 	filter       *filter
+	router       *router
 	logger       logrus.FieldLogger
-	jobs         chan interface{}
+	queues       []chan recordJob
+	controls     []chan closeWriterJob
+	capacity     *queueCapacity
 	lock         sync.RWMutex
+	openLock     sync.RWMutex
 	writers      map[string]*writer
+	closing      map[string]*closingWriter
+	segments     map[string]*segment
+	segmentTTL   time.Duration
+	archiver     *archiver
+	wal          *wal
+	tail         *tailHub
 	workerAlive  chan struct{}
 	gcKillswitch chan struct{}
 	gcAlive      chan struct{}
 }
 
-func NewSink(config *Config, filter *filter, logger logrus.FieldLogger) (*sink, error) {
-	return &sink{
+func NewSink(config *Config, filter *filter, router *router, logger logrus.FieldLogger) (*sink, error) {
+	if config.Workers < 1 {
+		return nil, fmt.Errorf("number of workers must be at least 1")
+	}
+
+	if config.Queue.Size < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1")
+	}
+
+	if err := validateQueuePolicy(config.Queue.Policy); err != nil {
+		return nil, err
+	}
+
+	if err := validateFlushPolicy(config.Output.Flush); err != nil {
+		return nil, err
+	}
+
+	if config.Writers.TTL <= 0 {
+		return nil, fmt.Errorf("writer TTL must be positive")
+	}
+
+	if config.Writers.GCInterval <= 0 {
+		return nil, fmt.Errorf("garbage collection interval must be positive")
+	}
+
+	if config.Writers.MaxOpen < 0 {
+		return nil, fmt.Errorf("maximum number of open writers must not be negative")
+	}
+
+	// The capacity limits the total number of queued records, so each
+	// queue must be able to hold all of them. Control jobs are sent
+	// separately, so that they never wait for or get dropped with records.
+	queues := make([]chan recordJob, config.Workers)
+	controls := make([]chan closeWriterJob, config.Workers)
+	for i := range queues {
+		queues[i] = make(chan recordJob, config.Queue.Size)
+		controls[i] = make(chan closeWriterJob)
+	}
+
+	s := &sink{
 		config:       config,
 		filter:       filter,
+		router:       router,
 		logger:       logger,
-		jobs:         make(chan interface{}, 10000),
+		queues:       queues,
+		controls:     controls,
+		capacity:     newQueueCapacity(config.Queue.Size),
 		lock:         sync.RWMutex{},
 		writers:      make(map[string]*writer),
+		closing:      make(map[string]*closingWriter),
+		segments:     make(map[string]*segment),
+		segmentTTL:   routeSegmentTTL(router),
+		tail:         newTailHub(),
 		workerAlive:  make(chan struct{}),
 		gcKillswitch: make(chan struct{}),
 		gcAlive:      make(chan struct{}),
-	}, nil
+	}
+
+	if config.WAL.Directory != "" {
+		var err error
+
+		s.wal, err = NewWAL(config.WAL, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up write-ahead log: %w", err)
+		}
+	}
+
+	// the archiver is always started, as routes using deferred
+	// compression can be added by reloading the configuration
+	s.archiver = newArchiver(logger)
+	go s.archiver.Run()
+
+	s.resumeArchivingTargets(router, nil)
+
+	return s, nil
+}
+
+// resumeArchivingTargets compresses files that were left over by a
+// crash in all targets using deferred compression, unless the previous
+// router already took care of them.
+func (s *sink) resumeArchivingTargets(router *router, previous *router) {
+	for _, route := range router.Targets() {
+		if !deferredCompression(route.output) {
+			continue
+		}
+
+		if previous != nil && previous.archives(route.target) {
+			continue
+		}
+
+		s.resumeArchiving(route.target, route.output.Compression)
+	}
+}
+
+// Routing returns the current filter and router.
+func (s *sink) Routing() (*filter, *router) {
+	s.routingLock.RLock()
+	defer s.routingLock.RUnlock()
+
+	return s.filter, s.router
+}
+
+// Reload replaces the filter and router. Records that have already
+// been queued are written using the previous routes, all open files
+// are closed afterwards, so that new records are written using the
+// new output settings.
+func (s *sink) Reload(filter *filter, router *router) {
+	s.routingLock.Lock()
+	previous := s.router
+	s.filter = filter
+	s.router = router
+	s.routingLock.Unlock()
+
+	s.lock.Lock()
+	s.segmentTTL = routeSegmentTTL(router)
+	s.lock.Unlock()
+
+	s.resumeArchivingTargets(router, previous)
+	s.closeAllWriters()
+}
+
+func deferredCompression(options WriterOptions) bool {
+	return options.Compression != compressionNone && options.CompressionMode == compressionModeDeferred
+}
+
+// routeSegmentTTL returns how long to keep the rotation state of closed
+// files. Keeping it longer than necessary for some routes is harmless,
+// as files older than the maximum age are rotated on their next write.
+func routeSegmentTTL(router *router) time.Duration {
+	ttl := time.Duration(0)
+
+	for _, route := range router.routes {
+		routeTTL := route.output.Rotation.MaxAge
+		if routeTTL == 0 {
+			routeTTL = segmentTTL
+		}
+
+		if routeTTL > ttl {
+			ttl = routeTTL
+		}
+	}
+
+	return ttl
 }
 
 // ProcessQueue is meant to run as a separate goroutine
-// and processes the job queue, i.e. it writes records
+// and processes the job queues, i.e. it writes records
 // and handling close requests for expired file writers.
+// Each queue is processed by its own worker goroutine.
 func (s *sink) ProcessQueue() {
-	for job := range s.jobs {
-		switch j := job.(type) {
-		case recordJob:
-			s.handleRecord(j.record, j.tag)
+	wg := sync.WaitGroup{}
+
+	for i := range s.queues {
+		wg.Add(1)
+
+		go func(queue chan recordJob, control chan closeWriterJob) {
+			defer wg.Done()
+			s.processQueue(queue, control)
+		}(s.queues[i], s.controls[i])
+	}
+
+	wg.Wait()
+	close(s.workerAlive)
+}
+
+func (s *sink) processQueue(queue chan recordJob, control chan closeWriterJob) {
+	for {
+		select {
+		case j, ok := <-queue:
+			if !ok {
+				return
+			}
+
+			queueLatency.Observe(time.Since(j.queued).Seconds())
+			// clients waiting for the result must not be told about
+			// records that are still buffered
+			err := s.handleRecord(j.record, j.path, j.route.output, s.walCallback(j.wal), j.result != nil)
+			s.capacity.Release(1)
+
+			if j.result != nil {
+				j.result.Done(err)
+			}
 
-		case closeWriterJob:
+		case j := <-control:
 			s.closeWriter(j.path)
 		}
 	}
+}
 
-	close(s.workerAlive)
+// workerFor returns the index of the worker responsible for the given
+// file. All jobs for one file are handled by the same worker, so that
+// records are written in the order they were received and the file is
+// never opened twice.
+func (s *sink) workerFor(path string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+
+	return int(hash.Sum32() % uint32(len(s.queues)))
+}
+
+// queueFor returns the record queue of the worker responsible for the
+// given file.
+func (s *sink) queueFor(path string) chan recordJob {
+	return s.queues[s.workerFor(path)]
+}
+
+// controlFor returns the control channel of the worker responsible for
+// the given file.
+func (s *sink) controlFor(path string) chan closeWriterJob {
+	return s.controls[s.workerFor(path)]
 }
 
 // GarbageCollect is meant to run as a separate goroutine
 // and takes care of closing any expired, i.e. unused,
-// file writers. This goroutine ends when you call Close().
+// file writers and flushing buffered records. This goroutine
+// ends when you call Close().
 func (s *sink) GarbageCollect() {
 	defer close(s.gcAlive)
 
+	gc := time.NewTicker(s.config.Writers.GCInterval)
+	defer gc.Stop()
+
+	// a nil channel disables periodic flushing
+	var flush <-chan time.Time
+
+	if interval := s.config.Output.Flush.Interval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		flush = ticker.C
+	}
+
 	for {
 		select {
 		case <-s.gcKillswitch:
 			return
 
-		case <-time.After(5 * time.Minute):
+		case <-gc.C:
 			s.closeExpiredWriters()
+
+		case <-flush:
+			s.flushWriters()
 		}
 	}
 }
 
-func (s *sink) AddPayload(payload Payload) (int, int) {
+// AddPayload filters and routes the records and queues them for
+// writing. It returns the number of received and accepted records. If
+// the queue is full, errQueueFull is returned and no records have been
+// queued.
+func (s *sink) AddPayload(payload Payload) (int, int, error) {
 	s.logger.Debugf("Adding payload (len=%d) ...", len(payload.Records))
 
-	num := 0
+	records := make([]*Record, 0, len(payload.Records))
+	jobs := make([]recordJob, 0, len(payload.Records))
+
+	// the whole payload is handled using the same routes
+	filter, router := s.Routing()
 
 	for _, record := range payload.Records {
-		if s.filter == nil || s.filter.IncludeRecord(record) {
-			s.jobs <- recordJob{
+		if filter != nil && !filter.IncludeRecord(record, payload.Tag) {
+			continue
+		}
+
+		routes := router.Match(record, payload.Tag)
+		if len(routes) == 0 {
+			unroutedRecords.Inc()
+			continue
+		}
+
+		records = append(records, record)
+
+		for _, route := range routes {
+			jobs = append(jobs, recordJob{
 				tag:    payload.Tag,
+				path:   route.Path(record, payload.Tag),
+				route:  route,
 				record: record,
+			})
+		}
+	}
+
+	if err := s.reserve(len(jobs)); err != nil {
+		s.logger.Debugf("Rejected payload: %v", err)
+		return len(payload.Records), 0, err
+	}
+
+	var segment *walSegment
+
+	if s.wal != nil && len(jobs) > 0 {
+		var err error
+
+		// records delivered to several routes are marked as written
+		// once per route
+		segment, err = s.wal.Append(payload.Tag, records, len(jobs))
+		if err != nil {
+			s.capacity.Release(len(jobs))
+			return len(payload.Records), 0, fmt.Errorf("failed to write to write-ahead log: %w", err)
+		}
+	}
+
+	var result *writeResult
+
+	if s.config.SyncWrites {
+		result = newWriteResult(len(jobs))
+	}
+
+	now := time.Now()
+
+	for _, job := range jobs {
+		job.queued = now
+		job.wal = segment
+		job.result = result
+
+		s.queueFor(job.path) <- job
+	}
+
+	for _, record := range records {
+		s.tail.Publish(record)
+	}
+
+	if result != nil {
+		failed, err := result.Wait()
+
+		// dropped records can be retried like rejected ones
+		if errors.Is(err, errQueueFull) {
+			return len(payload.Records), len(records), err
+		}
+
+		if err != nil {
+			return len(payload.Records), len(records), &partialWriteError{
+				failed: failed,
+				total:  len(jobs),
+				err:    err,
 			}
-			num++
 		}
 	}
 
 	s.logger.Debug("Done adding payload.")
 
-	return len(payload.Records), num
+	return len(payload.Records), len(records), nil
+}
+
+// reserve makes room for n records in the queue, according to the
+// configured queue policy.
+func (s *sink) reserve(n int) error {
+	switch s.config.Queue.Policy {
+	case queuePolicyReject:
+		if !s.capacity.TryReserve(n) {
+			queueRejectedRecords.WithLabelValues("full").Add(float64(n))
+			return errQueueFull
+		}
+
+	case queuePolicyBlock:
+		if !s.capacity.Reserve(n, s.config.Queue.Timeout) {
+			queueRejectedRecords.WithLabelValues("timeout").Add(float64(n))
+			return errQueueFull
+		}
+
+	case queuePolicyDropOldest:
+		for !s.capacity.TryReserve(n) {
+			if !s.dropOldest() {
+				s.capacity.ForceReserve(n)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// dropOldest discards the oldest record of the longest queue. It
+// returns false if no record could be dropped.
+func (s *sink) dropOldest() bool {
+	longest := s.queues[0]
+	for _, queue := range s.queues {
+		if len(queue) > len(longest) {
+			longest = queue
+		}
+	}
+
+	// control jobs are not part of the queues, so only records are
+	// ever dropped
+	select {
+	case j := <-longest:
+		s.capacity.Release(1)
+		queueDroppedRecords.Inc()
+
+		if done := s.walCallback(j.wal); done != nil {
+			done()
+		}
+
+		if j.result != nil {
+			j.result.Done(errQueueFull)
+		}
+
+		return true
+
+	default:
+		return false
+	}
+}
+
+// ReplayWAL queues all records from the write-ahead log that have not
+// been written before the last shutdown. The queue must be processed
+// concurrently.
+func (s *sink) ReplayWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	records, err := s.wal.Recover()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, router := s.Routing()
+
+	for _, r := range records {
+		routes := router.Match(r.record, r.tag)
+
+		// the routes might have changed since the record was logged
+		if len(routes) == 0 {
+			unroutedRecords.Inc()
+			s.wal.Done(r.segment, 1)
+			continue
+		}
+
+		s.wal.Expect(r.segment, len(routes)-1)
+
+		for _, route := range routes {
+			path := route.Path(r.record, r.tag)
+
+			s.capacity.ForceReserve(1)
+			s.queueFor(path) <- recordJob{
+				tag:    r.tag,
+				path:   path,
+				route:  route,
+				record: r.record,
+				queued: now,
+				wal:    r.segment,
+			}
+		}
+	}
+
+	walReplayedRecords.Add(float64(len(records)))
+
+	return nil
+}
+
+// walCallback returns the callback to mark a record as written in the
+// write-ahead log, if enabled.
+func (s *sink) walCallback(segment *walSegment) func() {
+	if segment == nil {
+		return nil
+	}
+
+	return func() {
+		s.wal.Done(segment, 1)
+	}
+}
+
+// Tail returns the hub distributing newly ingested records.
+func (s *sink) Tail() *tailHub {
+	return s.tail
 }
 
 // Close stops the garbage collection and the queue processor
@@ -98,41 +526,198 @@ func (s *sink) Close() {
 	close(s.gcKillswitch)
 	<-s.gcAlive
 
-	// close all writers
-	s.closeAllWriters()
-
 	// stop accepting new jobs and wait until all have been processed
-	close(s.jobs)
+	for _, queue := range s.queues {
+		close(queue)
+	}
 	<-s.workerAlive
-}
 
-func (s *sink) handleRecord(record *Record, tag string) {
-	var err error
+	// close all writers, including those opened for the records that
+	// were still queued
+	s.closeRemainingWriters()
 
-	// build final file path
-	replacer := strings.NewReplacer(record.StringReplacements(tag)...)
-	path := filepath.Join(s.config.Target, replacer.Replace(s.config.Pattern))
+	// wait for all closed files to be compressed
+	s.archiver.Close()
 
-	// attempt to find an existing writer
-	s.lock.Lock()
+	// all records have been written now
+	if s.wal != nil {
+		s.wal.Close()
+	}
+}
 
-	writer, ok := s.writers[path]
-	if !ok {
-		writer, err = NewWriter(path)
+func (s *sink) handleRecord(record *Record, path string, options WriterOptions, done func(), flush bool) error {
+	for {
+		writer, err := s.writerFor(path, options)
 		if err != nil {
 			s.logger.Errorf("Failed to open file writer: %v", err)
-		} else {
-			s.writers[path] = writer
+			failedWrites.WithLabelValues(writeFailureReason(err)).Inc()
+
+			// the record stays outstanding in the write-ahead log
+			return err
+		}
+
+		err = writer.Write(record, done)
+
+		// the writer has been evicted by another worker in the meantime
+		if err == errWriterClosed {
+			continue
+		}
+
+		if err == nil && flush {
+			err = writer.FlushAll()
+		}
+
+		if err != nil {
+			s.logger.Errorf("Failed to write record: %v", err)
+			failedWrites.WithLabelValues(writeFailureReason(err)).Inc()
+		}
+
+		return err
+	}
+}
+
+// writerFor returns the writer for the given path, opening a new one
+// if necessary.
+func (s *sink) writerFor(path string, options WriterOptions) (*writer, error) {
+	for {
+		// attempt to find an existing writer
+		s.lock.RLock()
+		writer, ok := s.writers[path]
+		seg := s.segments[path]
+		closing := s.closing[path]
+		s.lock.RUnlock()
+
+		if ok {
+			return writer, nil
+		}
+
+		// A writer evicted by another worker might still be closing the
+		// file, so opening it again has to wait until it is done.
+		if closing != nil {
+			<-closing.done
+			continue
+		}
+
+		// Only the worker responsible for this path creates writers for it,
+		// so the file can be opened without blocking the other workers.
+		// The retention must not remove files in the meantime.
+		s.openLock.RLock()
+
+		writer, err := NewWriter(path, options, seg, s.fileClosed(options))
+		if err != nil {
+			s.openLock.RUnlock()
+			return nil, err
+		}
+
+		s.lock.Lock()
+		evicted := s.evictWriters()
+		s.writers[path] = writer
+		s.segments[path] = writer.Segment()
+		s.lock.Unlock()
+
+		s.openLock.RUnlock()
+
+		for evictedPath, w := range evicted {
+			s.finishClosing(evictedPath, w)
+		}
+
+		return writer, nil
+	}
+}
+
+// evictWriters removes the least recently used writers until there is
+// room for a new one and returns them, so that they can be closed
+// without holding the lock. Their paths stay reserved until they have
+// been closed. The caller must hold the lock.
+func (s *sink) evictWriters() map[string]*writer {
+	limit := s.config.Writers.MaxOpen
+	evicted := make(map[string]*writer)
+
+	for limit > 0 && len(s.writers) >= limit {
+		var (
+			oldestPath string
+			oldest     *writer
+			oldestUsed time.Time
+		)
+
+		for path, writer := range s.writers {
+			used := writer.LastUsed()
+
+			if oldest == nil || used.Before(oldestUsed) {
+				oldestPath = path
+				oldest = writer
+				oldestUsed = used
+			}
 		}
+
+		delete(s.writers, oldestPath)
+
+		// without rotation, there is no state worth keeping around
+		if !oldest.options.Rotation.Enabled() {
+			delete(s.segments, oldestPath)
+		}
+
+		s.startClosing(oldestPath, oldest)
+
+		evicted[oldestPath] = oldest
+		evictedWriters.Inc()
+	}
+
+	return evicted
+}
+
+// closingWriter is a writer that has been removed from the open
+// writers, but is still flushing and closing its file.
+type closingWriter struct {
+	writer *writer
+	done   chan struct{}
+}
+
+// startClosing reserves the path of a writer that is about to be closed
+// without holding the lock. The caller must hold the lock.
+func (s *sink) startClosing(path string, writer *writer) {
+	s.closing[path] = &closingWriter{
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+}
+
+// finishClosing closes a writer and releases its path, so that the
+// responsible worker can open the file again.
+func (s *sink) finishClosing(path string, writer *writer) {
+	if err := writer.Close(); err != nil {
+		s.logger.Errorf("Failed to close writer %s: %v", path, err)
 	}
 
+	s.lock.Lock()
+	closing := s.closing[path]
+	delete(s.closing, path)
 	s.lock.Unlock()
 
-	if writer != nil {
-		if err = writer.Write(record); err != nil {
-			s.logger.Errorf("Failed to write record: %v", err)
+	close(closing.done)
+}
+
+// writeFailureReasons are the causes of failed writes that are worth
+// distinguishing in metrics.
+var writeFailureReasons = []struct {
+	errno  syscall.Errno
+	reason string
+}{
+	{syscall.ENOSPC, "no_space"},
+	{syscall.EACCES, "permission_denied"},
+	{syscall.EPERM, "permission_denied"},
+	{syscall.EROFS, "read_only"},
+}
+
+// writeFailureReason classifies an error for the failed writes metric.
+func writeFailureReason(err error) string {
+	for _, r := range writeFailureReasons {
+		if errors.Is(err, r.errno) {
+			return r.reason
 		}
 	}
+
+	return "other"
 }
 
 func (s *sink) closeWriter(path string) {
@@ -140,39 +725,175 @@ func (s *sink) closeWriter(path string) {
 	s.lock.Lock()
 
 	writer, ok := s.writers[path]
+	delete(s.writers, path)
+
 	if ok {
-		writer.Close()
-		delete(s.writers, path)
+		// without rotation, there is no state worth keeping around
+		if !writer.options.Rotation.Enabled() {
+			delete(s.segments, path)
+		}
+
+		s.startClosing(path, writer)
 	}
 
 	s.lock.Unlock()
+
+	if ok {
+		s.finishClosing(path, writer)
+	}
+
 	s.logger.Debug("Done closing writer.")
 }
 
+// OpenFiles returns the filenames of all files that are currently
+// being written to, including compressed files that belong to the
+// same segment and files of writers that are still being closed.
+func (s *sink) OpenFiles() map[string]struct{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	files := make(map[string]struct{})
+
+	add := func(writer *writer) {
+		filename := writer.Filename()
+		files[filename] = struct{}{}
+
+		if deferredCompression(writer.options) {
+			files[filename+compressionExtension(writer.options.Compression)] = struct{}{}
+		}
+	}
+
+	for _, writer := range s.writers {
+		add(writer)
+	}
+
+	for _, closing := range s.closing {
+		add(closing.writer)
+	}
+
+	return files
+}
+
+// RemoveUnlessOpen calls remove for a file that is not being written to
+// and reports whether it did. No writers are opened until remove has
+// returned, so the file cannot be reopened while it is being removed.
+func (s *sink) RemoveUnlessOpen(filename string, remove func() error) (bool, error) {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+
+	if _, open := s.OpenFiles()[filename]; open {
+		return false, nil
+	}
+
+	return true, remove()
+}
+
+// fileClosed returns the callback for writers whenever they closed
+// a file.
+func (s *sink) fileClosed(options WriterOptions) func(string) {
+	return func(filename string) {
+		if deferredCompression(options) {
+			s.archiver.Add(filename, options.Compression)
+		}
+	}
+}
+
+func (s *sink) resumeArchiving(target string, compression string) {
+	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, archiveSuffix) {
+			s.archiver.Resume(path, compression)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		s.logger.Warnf("Failed to find files left to compress: %v", err)
+	}
+}
+
+// flushWriters writes the buffered records of all open writers.
+func (s *sink) flushWriters() {
+	s.lock.RLock()
+	writers := make([]*writer, 0, len(s.writers))
+	for _, writer := range s.writers {
+		writers = append(writers, writer)
+	}
+	s.lock.RUnlock()
+
+	for _, writer := range writers {
+		if err := writer.Flush(); err != nil {
+			s.logger.Errorf("Failed to flush writer: %v", err)
+		}
+	}
+}
+
 func (s *sink) closeExpiredWriters() {
 	s.closeWritersBy(time.Now())
+	s.forgetExpiredSegments(time.Now())
 }
 
 func (s *sink) closeAllWriters() {
 	s.closeWritersBy(time.Time{})
 }
 
+// closeRemainingWriters closes all writers directly, which is only safe
+// once the workers have stopped.
+func (s *sink) closeRemainingWriters() {
+	s.lock.Lock()
+	writers := s.writers
+	s.writers = make(map[string]*writer)
+	s.lock.Unlock()
+
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			s.logger.Errorf("Failed to close writer: %v", err)
+		}
+	}
+}
+
 func (s *sink) closeWritersBy(t time.Time) {
 	s.logger.Debugf("Starting to close writers... (t = %v)", t)
-	s.lock.RLock()
 
+	expired := make([]string, 0)
+
+	s.lock.RLock()
 	for path, writer := range s.writers {
-		if writer.Expired(t) {
-			s.jobs <- closeWriterJob{path}
+		if writer.Expired(t, s.config.Writers.TTL) {
+			expired = append(expired, path)
 		}
 	}
-
 	s.lock.RUnlock()
+
+	// send the jobs without holding the lock, as the workers
+	// might need it to make progress
+	for _, path := range expired {
+		s.controlFor(path) <- closeWriterJob{path}
+	}
+
 	s.logger.Debug("Done closing writers.")
 }
 
+// forgetExpiredSegments removes the rotation state of closed files
+// that have not been written to for a while. If a maximum age is
+// configured, such files will be rotated on their next write anyway,
+// otherwise the state can be recovered from disk.
+func (s *sink) forgetExpiredSegments(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ttl := s.segmentTTL
+
+	for path, seg := range s.segments {
+		if _, open := s.writers[path]; !open && now.Sub(seg.updated) >= ttl {
+			delete(s.segments, path)
+		}
+	}
+}
+
 func (s *sink) Describe(descriptions chan<- *prometheus.Desc) {
 	descriptions <- prometheus.NewDesc("bunker_open_writers_total", "Total number of currently open file writers", nil, nil)
+	descriptions <- prometheus.NewDesc("bunker_queued_records", "Number of records waiting to be written", nil, nil)
 }
 
 func (s *sink) Collect(metrics chan<- prometheus.Metric) {
@@ -191,4 +912,12 @@ func (s *sink) Collect(metrics chan<- prometheus.Metric) {
 	gauge.Set(float64(total))
 
 	metrics <- gauge
+
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bunker_queued_records",
+	})
+
+	queued.Set(float64(s.capacity.Pending()))
+
+	metrics <- queued
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testConfig returns the default configuration, writing to a temporary
+// directory, with the given flags applied.
+func testConfig(t testing.TB, args ...string) *Config {
+	config, _, err := loadConfig(append([]string{"-target", t.TempDir()}, args...), flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	return config
+}
+
+func testLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	return logger
+}
+
+// testSink creates a sink for the configuration. The goroutines are not
+// started yet.
+func testSink(t testing.TB, config *Config) *sink {
+	filter, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	s, err := NewSink(config, filter, router, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+
+	return s
+}
+
+func testRecord(t testing.TB, namespace string, log string) *Record {
+	data := fmt.Sprintf(`{"date":"2020-01-01T12:00:00Z","log":%q,"kubernetes":{"namespace_name":%q}}`, log, namespace)
+
+	record := &Record{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	return record
+}
+
+func TestSinkCloseWritesQueuedRecords(t *testing.T) {
+	config := testConfig(t, "-flush-size", "65536", "-flush-interval", "1h")
+	s := testSink(t, config)
+
+	namespaces := 20
+	payload := Payload{}
+
+	for i := 0; i < namespaces; i++ {
+		payload.Records = append(payload.Records, testRecord(t, fmt.Sprintf("ns-%d", i), "hello"))
+	}
+
+	// queue the records before any writer has been opened
+	if _, _, err := s.AddPayload(payload); err != nil {
+		t.Fatalf("Failed to add payload: %v", err)
+	}
+
+	go s.GarbageCollect()
+	go s.ProcessQueue()
+
+	s.Close()
+
+	for i := 0; i < namespaces; i++ {
+		filename := filepath.Join(config.Target, "2020-01-01", fmt.Sprintf("ns-%d.json", i))
+
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", filename, err)
+		}
+
+		if !strings.Contains(string(content), `"hello"`) {
+			t.Errorf("Expected %s to contain the record, got %q.", filename, string(content))
+		}
+	}
+}
+
+func BenchmarkSinkWorkers(b *testing.B) {
+	const namespaces = 100
+
+	// syncing every record simulates a slow disk
+	disks := map[string][]string{
+		"buffered": {"-flush-size", "65536", "-fsync", "never"},
+		"sync":     {"-flush-size", "0", "-fsync", "batch"},
+	}
+
+	for _, disk := range []string{"buffered", "sync"} {
+		for _, workers := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("%s/workers=%d", disk, workers), func(b *testing.B) {
+				args := append([]string{"-workers", fmt.Sprint(workers), "-pattern", "%kubernetes_namespace_name%.json"}, disks[disk]...)
+				benchmarkSink(b, testConfig(b, args...), namespaces)
+			})
+		}
+	}
+}
+
+// benchmarkSink writes records for the given number of namespaces
+// concurrently.
+func benchmarkSink(b *testing.B, config *Config, namespaces int) {
+	s := testSink(b, config)
+
+	payloads := make([]Payload, namespaces)
+	for i := range payloads {
+		payloads[i] = Payload{
+			Records: []*Record{testRecord(b, fmt.Sprintf("ns-%d", i), "GET /healthz HTTP/1.1 200 OK")},
+		}
+	}
+
+	go s.GarbageCollect()
+	go s.ProcessQueue()
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+
+		for pb.Next() {
+			if _, _, err := s.AddPayload(payloads[i%namespaces]); err != nil {
+				b.Errorf("Failed to add payload: %v", err)
+				return
+			}
+
+			i++
+		}
+	})
+
+	// wait for all records to be written
+	s.Close()
+}
+
+func TestSinkDropOldestKeepsOrder(t *testing.T) {
+	config := testConfig(t, "-workers", "1", "-queue-size", "2", "-queue-policy", "drop-oldest")
+	s := testSink(t, config)
+
+	queue := s.queues[0]
+	job := func(log string) recordJob {
+		return recordJob{path: "records.json", record: testRecord(t, "default", log)}
+	}
+
+	queue <- job("first")
+	queue <- job("second")
+	s.capacity.ForceReserve(2)
+
+	// a close job is waiting for the worker while records are dropped
+	s.writers["records.json"] = &writer{}
+	go s.closeWritersBy(time.Time{})
+
+	dropped := make(chan bool)
+	go func() {
+		dropped <- s.dropOldest()
+	}()
+
+	select {
+	case ok := <-dropped:
+		if !ok {
+			t.Fatal("Expected a record to be dropped.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dropping a record blocked.")
+	}
+
+	if len(queue) != 1 {
+		t.Fatalf("Expected 1 job to be left, got %d.", len(queue))
+	}
+
+	if j := <-queue; j.record.Log != "second" {
+		t.Fatalf("Expected the second record to be left, got %q.", j.record.Log)
+	}
+
+	if s.dropOldest() {
+		t.Fatal("Expected no record to be left to drop.")
+	}
+
+	select {
+	case j := <-s.controls[0]:
+		if j.path != "records.json" {
+			t.Fatalf("Expected records.json to be closed, got %s.", j.path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the close job to be left for the worker.")
+	}
+}
+
+// writersTestSink creates a sink with just enough state to open and
+// evict writers, with a single worker to observe close jobs.
+func writersTestSink(maxOpen int, ttl time.Duration) *sink {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	return &sink{
+		config: &Config{
+			Writers: WritersOptions{TTL: ttl, GCInterval: time.Minute, MaxOpen: maxOpen},
+		},
+		logger:   logger,
+		queues:   []chan recordJob{make(chan recordJob, 100)},
+		controls: []chan closeWriterJob{make(chan closeWriterJob, 100)},
+		writers:  make(map[string]*writer),
+		closing:  make(map[string]*closingWriter),
+		segments: make(map[string]*segment),
+	}
+}
+
+func openTestWriters(t *testing.T, s *sink, names ...string) map[string]*writer {
+	dir := t.TempDir()
+	writers := make(map[string]*writer)
+
+	for _, name := range names {
+		// make sure every writer has a distinct last use
+		time.Sleep(2 * time.Millisecond)
+
+		w, err := s.writerFor(filepath.Join(dir, name), WriterOptions{Format: formatJSON})
+		if err != nil {
+			t.Fatalf("Failed to open writer %s: %v", name, err)
+		}
+
+		writers[name] = w
+	}
+
+	return writers
+}
+
+func openWriterNames(s *sink) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := make([]string, 0)
+	for path := range s.writers {
+		names = append(names, filepath.Base(path))
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestSinkEvictsLeastRecentlyUsedWriter(t *testing.T) {
+	s := writersTestSink(2, time.Minute)
+	writers := openTestWriters(t, s, "a.json", "b.json")
+
+	// a becomes the most recently used writer
+	time.Sleep(2 * time.Millisecond)
+
+	record, err := newRecord(map[string]interface{}{"log": "hello"})
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	if err := writers["a.json"].Write(record, nil); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+
+	openTestWriters(t, s, "c.json")
+
+	if names := openWriterNames(s); !reflect.DeepEqual(names, []string{"a.json", "c.json"}) {
+		t.Fatalf("Expected a.json and c.json to be open, got %v.", names)
+	}
+
+	if err := writers["b.json"].Write(record, nil); err != errWriterClosed {
+		t.Fatalf("Expected evicted writer to be closed, got %v.", err)
+	}
+}
+
+func TestSinkMaxOpenWriters(t *testing.T) {
+	testcases := []struct {
+		maxOpen  int
+		expected []string
+	}{
+		{maxOpen: 0, expected: []string{"1", "2", "3", "4", "5"}},
+		{maxOpen: 1, expected: []string{"5"}},
+		{maxOpen: 3, expected: []string{"3", "4", "5"}},
+	}
+
+	for _, testcase := range testcases {
+		s := writersTestSink(testcase.maxOpen, time.Minute)
+		openTestWriters(t, s, "1", "2", "3", "4", "5")
+
+		if names := openWriterNames(s); !reflect.DeepEqual(names, testcase.expected) {
+			t.Errorf("Expected %v to be open with a limit of %d, got %v.", testcase.expected, testcase.maxOpen, names)
+		}
+	}
+}
+
+func TestSinkClosesExpiredWriters(t *testing.T) {
+	ttl := 10 * time.Minute
+
+	s := writersTestSink(0, ttl)
+	writers := openTestWriters(t, s, "old.json", "new.json")
+
+	now := time.Now()
+	writers["old.json"].used = now.Add(-ttl)
+
+	if !writers["old.json"].Expired(now, ttl) || writers["new.json"].Expired(now, ttl) {
+		t.Fatal("Expected only old.json to be expired.")
+	}
+
+	s.closeWritersBy(now)
+
+	control := s.controls[0]
+	if len(control) != 1 {
+		t.Fatalf("Expected 1 close job, got %d.", len(control))
+	}
+
+	if job := <-control; filepath.Base(job.path) != "old.json" {
+		t.Fatalf("Expected old.json to be closed, got %s.", job.path)
+	}
+
+	// all writers are expired at the zero time, e.g. on shutdown
+	s.closeWritersBy(time.Time{})
+
+	if len(control) != 2 {
+		t.Fatalf("Expected 2 close jobs, got %d.", len(control))
+	}
+}
+
+func TestSinkWaitsForEvictedWriter(t *testing.T) {
+	s := writersTestSink(1, time.Minute)
+	path := filepath.Join(t.TempDir(), "a.json")
+
+	// another worker is still closing the evicted writer
+	closing := &closingWriter{writer: &writer{}, done: make(chan struct{})}
+	s.closing[path] = closing
+
+	opened := make(chan error)
+	go func() {
+		_, err := s.writerFor(path, WriterOptions{Format: formatJSON})
+		opened <- err
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("Expected the file not to be opened while it is being closed.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.lock.Lock()
+	delete(s.closing, path)
+	s.lock.Unlock()
+	close(closing.done)
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatalf("Failed to open writer: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the file to be opened once it has been closed.")
+	}
+}
+
+func TestSinkEvictionKeepsAllRecords(t *testing.T) {
+	config := testConfig(t, "-workers", "4", "-max-open-writers", "1", "-pattern", "%kubernetes_namespace_name%.json")
+	s := testSink(t, config)
+
+	go s.GarbageCollect()
+	go s.ProcessQueue()
+
+	const (
+		namespaces = 8
+		records    = 50
+	)
+
+	for i := 0; i < records; i++ {
+		payload := Payload{}
+		for ns := 0; ns < namespaces; ns++ {
+			payload.Records = append(payload.Records, testRecord(t, fmt.Sprintf("ns-%d", ns), "hello"))
+		}
+
+		if _, _, err := s.AddPayload(payload); err != nil {
+			t.Fatalf("Failed to add payload: %v", err)
+		}
+	}
+
+	s.Close()
+
+	for ns := 0; ns < namespaces; ns++ {
+		filename := filepath.Join(config.Target, fmt.Sprintf("ns-%d.json", ns))
+
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", filename, err)
+		}
+
+		if lines := strings.Count(string(content), "\n"); lines != records {
+			t.Errorf("Expected %d records in %s, got %d.", records, filename, lines)
+		}
+	}
+
+	if len(s.closing) != 0 {
+		t.Errorf("Expected no writers to be closing, got %d.", len(s.closing))
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// syslogMaxMessageSize limits the size of a single message.
+	syslogMaxMessageSize = 1024 * 1024
+
+	// syslogTag is the tag used for all syslog records.
+	syslogTag = "syslog"
+
+	// syslogDefaultPriority is user.notice, assumed for messages without
+	// a priority (RFC 3164, section 4.3.3).
+	syslogDefaultPriority = 13
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// SyslogOptions configure the syslog listeners. Empty addresses
+// disable the respective listener.
+type SyslogOptions struct {
+	UDP string
+	TCP string
+}
+
+func (o SyslogOptions) Enabled() bool {
+	return o.UDP != "" || o.TCP != ""
+}
+
+// SyslogMetadata is the syslog header of a record received via syslog.
+type SyslogMetadata struct {
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Hostname       string                       `json:"hostname"`
+	AppName        string                       `json:"app_name"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+}
+
+func (m *SyslogMetadata) Placeholders(values map[string]string) {
+	values["syslog_facility"] = m.Facility
+	values["syslog_severity"] = m.Severity
+	values["syslog_hostname"] = m.Hostname
+	values["syslog_app_name"] = m.AppName
+}
+
+// parseSyslog parses an RFC 5424 or RFC 3164 message. Messages that
+// do not follow RFC 3164 closely are still accepted, with the
+// remaining text as the log message.
+func parseSyslog(message []byte, received time.Time) (*Record, error) {
+	msg := string(bytes.TrimRight(message, "\r\n\x00"))
+	priority := syslogDefaultPriority
+
+	if strings.HasPrefix(msg, "<") {
+		end := strings.IndexByte(msg, '>')
+		if end < 2 || end > 4 {
+			return nil, errors.New("invalid priority")
+		}
+
+		p, err := strconv.Atoi(msg[1:end])
+		if err != nil || p < 0 || p >= len(syslogFacilities)*8 {
+			return nil, errors.New("invalid priority")
+		}
+
+		priority = p
+		msg = msg[end+1:]
+	}
+
+	meta := SyslogMetadata{
+		Facility: syslogFacilities[priority/8],
+		Severity: syslogSeverities[priority%8],
+	}
+
+	var (
+		date time.Time
+		text string
+		err  error
+	)
+
+	if strings.HasPrefix(msg, "1 ") {
+		date, text, err = parseRFC5424(msg[2:], &meta)
+	} else {
+		date, text = parseRFC3164(msg, received, &meta)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if date.IsZero() {
+		date = received
+	}
+
+	return newRecord(map[string]interface{}{
+		"date":   date.UTC().Format(time.RFC3339Nano),
+		"log":    text,
+		"syslog": meta,
+	})
+}
+
+// parseRFC5424 parses everything after "<PRI>1 ", i.e.
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG].
+func parseRFC5424(msg string, meta *SyslogMetadata) (time.Time, string, error) {
+	fields := make([]string, 5)
+
+	for i := range fields {
+		end := strings.IndexByte(msg, ' ')
+		if end < 0 {
+			end = len(msg)
+		}
+
+		fields[i] = nilValue(msg[:end])
+		msg = strings.TrimPrefix(msg[end:], " ")
+	}
+
+	var date time.Time
+
+	if fields[0] != "" {
+		var err error
+
+		date, err = time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return date, "", fmt.Errorf("invalid timestamp: %w", err)
+		}
+	}
+
+	meta.Hostname = fields[1]
+	meta.AppName = fields[2]
+	meta.ProcID = fields[3]
+	meta.MsgID = fields[4]
+
+	if strings.HasPrefix(msg, "-") {
+		msg = msg[1:]
+	} else {
+		data, rest, err := parseStructuredData(msg)
+		if err != nil {
+			return date, "", err
+		}
+
+		meta.StructuredData = data
+		msg = rest
+	}
+
+	msg = strings.TrimPrefix(msg, " ")
+	msg = strings.TrimPrefix(msg, "\ufeff") // BOM
+
+	return date, msg, nil
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+
+	return s
+}
+
+// parseStructuredData parses one or more [id name="value" ...] elements
+// and returns the remaining message.
+func parseStructuredData(msg string) (map[string]map[string]string, string, error) {
+	data := make(map[string]map[string]string)
+	invalid := errors.New("invalid structured data")
+
+	for strings.HasPrefix(msg, "[") {
+		msg = msg[1:]
+
+		end := strings.IndexAny(msg, " ]")
+		if end <= 0 {
+			return nil, "", invalid
+		}
+
+		params := make(map[string]string)
+		data[msg[:end]] = params
+		msg = msg[end:]
+
+		for strings.HasPrefix(msg, " ") {
+			msg = msg[1:]
+
+			eq := strings.Index(msg, `="`)
+			if eq <= 0 {
+				return nil, "", invalid
+			}
+
+			name := msg[:eq]
+			msg = msg[eq+2:]
+
+			value := strings.Builder{}
+			closed := false
+
+			for i := 0; i < len(msg); i++ {
+				c := msg[i]
+
+				if c == '\\' && i+1 < len(msg) && strings.IndexByte(`"\]`, msg[i+1]) >= 0 {
+					i++
+					c = msg[i]
+				} else if c == '"' {
+					msg = msg[i+1:]
+					closed = true
+					break
+				}
+
+				value.WriteByte(c)
+			}
+
+			if !closed {
+				return nil, "", invalid
+			}
+
+			params[name] = value.String()
+		}
+
+		if !strings.HasPrefix(msg, "]") {
+			return nil, "", invalid
+		}
+
+		msg = msg[1:]
+	}
+
+	return data, msg, nil
+}
+
+// parseRFC3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". As
+// the timestamp has no year, the year is chosen so that the date is
+// not in the future.
+func parseRFC3164(msg string, received time.Time, meta *SyslogMetadata) (time.Time, string) {
+	var date time.Time
+
+	const stamp = "Jan _2 15:04:05"
+
+	if len(msg) >= len(stamp) {
+		if t, err := time.ParseInLocation(stamp, msg[:len(stamp)], time.Local); err == nil {
+			local := received.In(time.Local)
+			date = time.Date(local.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+
+			if date.After(local.Add(24 * time.Hour)) {
+				date = date.AddDate(-1, 0, 0)
+			}
+
+			msg = strings.TrimPrefix(msg[len(stamp):], " ")
+
+			// the hostname is only present after a timestamp
+			if end := strings.IndexByte(msg, ' '); end > 0 && !strings.HasSuffix(msg[:end], ":") {
+				meta.Hostname = msg[:end]
+				msg = msg[end+1:]
+			}
+		}
+	}
+
+	// the tag consists of up to 32 alphanumeric characters and ends with
+	// "[pid]:" or ":"
+	end := strings.IndexAny(msg, "[: ")
+	if end > 0 && end <= 32 && msg[end] != ' ' {
+		tag := msg[:end]
+		rest := msg[end:]
+
+		if rest[0] == '[' {
+			if pidEnd := strings.Index(rest, "]:"); pidEnd > 0 {
+				meta.ProcID = rest[1:pidEnd]
+				rest = rest[pidEnd+1:]
+			}
+		}
+
+		if strings.HasPrefix(rest, ":") {
+			meta.AppName = tag
+			msg = strings.TrimPrefix(rest[1:], " ")
+		}
+	}
+
+	return date, msg
+}
+
+type syslogServer struct {
+	sink     *sink
+	logger   logrus.FieldLogger
+	udp      net.PacketConn
+	tcp      net.Listener
+	lock     sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+	alive    chan struct{}
+}
+
+func NewSyslogServer(config *Config, sink *sink, logger logrus.FieldLogger) (*syslogServer, error) {
+	s := &syslogServer{
+		sink:   sink,
+		logger: logger,
+		conns:  make(map[net.Conn]struct{}),
+		alive:  make(chan struct{}),
+	}
+
+	if config.Syslog.UDP != "" {
+		udp, err := net.ListenPacket("udp", config.Syslog.UDP)
+		if err != nil {
+			return nil, err
+		}
+
+		s.udp = udp
+	}
+
+	if config.Syslog.TCP != "" {
+		tcp, err := net.Listen("tcp", config.Syslog.TCP)
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+
+			return nil, err
+		}
+
+		s.tcp = tcp
+	}
+
+	return s, nil
+}
+
+// Run is meant to run as a separate goroutine and receives messages
+// until Close() is called.
+func (s *syslogServer) Run() {
+	defer close(s.alive)
+
+	wg := sync.WaitGroup{}
+
+	if s.udp != nil {
+		wg.Add(1)
+		go func() {
+			s.receiveUDP()
+			wg.Done()
+		}()
+	}
+
+	if s.tcp != nil {
+		wg.Add(1)
+		go func() {
+			s.acceptTCP()
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Close stops the listeners and waits for all connections to end.
+func (s *syslogServer) Close() {
+	s.lock.Lock()
+	s.closed = true
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	if s.udp != nil {
+		s.udp.Close()
+	}
+
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+
+	<-s.alive
+	s.handlers.Wait()
+}
+
+func (s *syslogServer) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closed
+}
+
+func (s *syslogServer) receiveUDP() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+
+			s.logger.Errorf("Failed to receive syslog message: %v", err)
+			continue
+		}
+
+		s.handleMessage(buf[:n])
+	}
+}
+
+func (s *syslogServer) acceptTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+
+			s.logger.Errorf("Failed to accept syslog connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.lock.Unlock()
+
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *syslogServer) handleConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+
+		s.handlers.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		message, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				s.logger.Warnf("Failed to read syslog message from %s: %v", conn.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		s.handleMessage(message)
+	}
+}
+
+// readSyslogFrame reads a single message from a TCP stream, which is
+// either prefixed with its length (octet counting) or terminated by a
+// newline (non-transparent framing), see RFC 6587.
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		length, err := readSyslogLength(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		message := make([]byte, length)
+		_, err = io.ReadFull(reader, message)
+
+		return message, err
+	}
+
+	message := make([]byte, 0)
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		message = append(message, line...)
+
+		if len(message) > syslogMaxMessageSize {
+			return nil, errors.New("message too large")
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF && len(message) > 0 {
+			return message, nil
+		}
+
+		return message, err
+	}
+}
+
+// readSyslogLength reads the decimal length prefix of an octet counted
+// frame, including the trailing space. Only as many digits as needed for
+// syslogMaxMessageSize are accepted, so that a client cannot make us
+// buffer an endless prefix.
+func readSyslogLength(reader *bufio.Reader) (int, error) {
+	maxDigits := len(strconv.Itoa(syslogMaxMessageSize))
+	length := 0
+
+	for digits := 0; ; digits++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if b == ' ' && digits > 0 {
+			break
+		}
+
+		if b < '0' || b > '9' || digits == maxDigits {
+			return 0, fmt.Errorf("invalid message length prefix (unexpected %q)", b)
+		}
+
+		length = length*10 + int(b-'0')
+	}
+
+	if length > syslogMaxMessageSize {
+		return 0, fmt.Errorf("message length %d exceeds %d bytes", length, syslogMaxMessageSize)
+	}
+
+	return length, nil
+}
+
+func (s *syslogServer) handleMessage(message []byte) {
+	record, err := parseSyslog(message, time.Now())
+	if err != nil {
+		s.logger.Debugf("Ignoring invalid syslog message: %v", err)
+		return
+	}
+
+	err = ingestPayload(s.sink, Payload{
+		Tag:     syslogTag,
+		Records: []*Record{record},
+	})
+	if err != nil {
+		s.logger.Debugf("Failed to store syslog message: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    string
+		expected string
+		valid    bool
+	}{
+		{name: "octet counting", input: "5 hello5 world", expected: "hello", valid: true},
+		{name: "newline", input: "<13>hello\nworld", expected: "<13>hello\n", valid: true},
+		{name: "non-digit prefix", input: "12a hello", valid: false},
+		{name: "too long", input: "1048577 hello", valid: false},
+		{name: "endless prefix", input: strings.Repeat("9", 64*1024), valid: false},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(strings.NewReader(testcase.input), 16)
+
+			message, err := readSyslogFrame(reader)
+			if !testcase.valid {
+				if err == nil {
+					t.Fatalf("Expected error, got message %q.", message)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Failed to read frame: %v", err)
+			}
+
+			if string(message) != testcase.expected {
+				t.Fatalf("Expected %q, got %q.", testcase.expected, message)
+			}
+		})
+	}
+}
+
+func TestParseSyslogRFC5424(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    string
+		date     time.Time
+		log      string
+		metadata string
+	}{
+		{
+			name:     "full header with structured data",
+			input:    `<165>1 2020-01-01T12:00:00.5Z host1 app 123 ID47 [exampleSDID@32473 iut="3" eventSource="App\"lic\]ation"][meta x="y"] hello world`,
+			date:     time.Date(2020, 1, 1, 12, 0, 0, 500000000, time.UTC),
+			log:      "hello world",
+			metadata: `{"facility":"local4","severity":"notice","hostname":"host1","app_name":"app","proc_id":"123","msg_id":"ID47","structured_data":{"exampleSDID@32473":{"eventSource":"App\"lic]ation","iut":"3"},"meta":{"x":"y"}}}`,
+		},
+		{
+			name:     "nil values",
+			input:    "<14>1 - - - - - - \ufeffjust a message\n",
+			log:      "just a message",
+			metadata: `{"facility":"user","severity":"info","hostname":"","app_name":""}`,
+		},
+		{
+			name:     "no message",
+			input:    "<0>1 2020-01-01T12:00:00+01:00 host app - - [id]",
+			date:     time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC),
+			metadata: `{"facility":"kern","severity":"emerg","hostname":"host","app_name":"app","structured_data":{"id":{}}}`,
+		},
+	}
+
+	received := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			record, err := parseSyslog([]byte(testcase.input), received)
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+
+			date := testcase.date
+			if date.IsZero() {
+				date = received
+			}
+
+			if !record.Date.Equal(date) {
+				t.Errorf("Expected date %v, got %v.", date, record.Date)
+			}
+
+			if record.Log != testcase.log {
+				t.Errorf("Expected log %q, got %q.", testcase.log, record.Log)
+			}
+
+			if metadata, _ := record.Field("syslog"); string(metadata) != testcase.metadata {
+				t.Errorf("Expected metadata\n%s\ngot\n%s", testcase.metadata, metadata)
+			}
+		})
+	}
+}
+
+func TestParseSyslogRFC3164(t *testing.T) {
+	received := time.Date(2020, 1, 1, 8, 0, 0, 0, time.Local)
+
+	testcases := []struct {
+		name     string
+		input    string
+		date     time.Time
+		log      string
+		metadata string
+	}{
+		{
+			name:     "full message",
+			input:    "<34>Oct  5 22:14:15 mymachine su[230]: 'su root' failed",
+			date:     time.Date(2019, 10, 5, 22, 14, 15, 0, time.Local),
+			log:      "'su root' failed",
+			metadata: `{"facility":"auth","severity":"crit","hostname":"mymachine","app_name":"su","proc_id":"230"}`,
+		},
+		{
+			name:     "same day, current year",
+			input:    "<13>Jan  1 07:59:00 host cron: job done",
+			date:     time.Date(2020, 1, 1, 7, 59, 0, 0, time.Local),
+			log:      "job done",
+			metadata: `{"facility":"user","severity":"notice","hostname":"host","app_name":"cron"}`,
+		},
+		{
+			name:     "no priority",
+			input:    "Dec 31 23:59:59 host kernel: panic",
+			date:     time.Date(2019, 12, 31, 23, 59, 59, 0, time.Local),
+			log:      "panic",
+			metadata: `{"facility":"user","severity":"notice","hostname":"host","app_name":"kernel"}`,
+		},
+		{
+			name:     "no header at all",
+			input:    "<13>free form text",
+			log:      "free form text",
+			metadata: `{"facility":"user","severity":"notice","hostname":"","app_name":""}`,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			record, err := parseSyslog([]byte(testcase.input), received)
+			if err != nil {
+				t.Fatalf("Failed to parse message: %v", err)
+			}
+
+			date := testcase.date
+			if date.IsZero() {
+				date = received
+			}
+
+			if !record.Date.Equal(date) {
+				t.Errorf("Expected date %v, got %v.", date, record.Date)
+			}
+
+			if record.Log != testcase.log {
+				t.Errorf("Expected log %q, got %q.", testcase.log, record.Log)
+			}
+
+			if metadata, _ := record.Field("syslog"); string(metadata) != testcase.metadata {
+				t.Errorf("Expected metadata\n%s\ngot\n%s", testcase.metadata, metadata)
+			}
+		})
+	}
+}
+
+func TestParseSyslogMalformed(t *testing.T) {
+	for _, input := range []string{
+		"<>hello",
+		"<1000>hello",
+		"<abc>hello",
+		"<192>1 - - - - - -",
+		"<13>1 yesterday host app - - - hello",
+		"<13>1 - host app - - [id hello",
+		`<13>1 - host app - - [id a="unterminated]`,
+		"<13>1 - host app - - [id a=1]",
+	} {
+		if record, err := parseSyslog([]byte(input), time.Now()); err == nil {
+			t.Errorf("Expected an error for %q, got %+v.", input, record)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	tailKeepaliveInterval = 15 * time.Second
+)
+
+var errTailClosed = errors.New("tail hub has been closed")
+
+// tailHub distributes newly ingested records to tail subscribers.
+// Publishing never blocks: if a subscriber's buffer is full, the
+// record is dropped for that subscriber.
+type tailHub struct {
+	lock        sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+	closed      bool
+}
+
+type tailSubscriber struct {
+	query   *recordQuery
+	records chan []byte
+	dropped uint64
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{
+		subscribers: make(map[*tailSubscriber]struct{}),
+	}
+}
+
+// Subscribe registers a new subscriber. The records channel is closed
+// when the hub is closed.
+func (h *tailHub) Subscribe(query *recordQuery, bufferSize int) (*tailSubscriber, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return nil, errTailClosed
+	}
+
+	sub := &tailSubscriber{
+		query:   query,
+		records: make(chan []byte, bufferSize),
+	}
+
+	h.subscribers[sub] = struct{}{}
+	tailSubscribers.Inc()
+
+	return sub, nil
+}
+
+func (h *tailHub) Unsubscribe(sub *tailSubscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.records)
+		tailSubscribers.Dec()
+	}
+}
+
+// Publish hands the record to all interested subscribers.
+func (h *tailHub) Publish(record *Record) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var encoded []byte
+
+	for sub := range h.subscribers {
+		if !sub.query.Matches(record) {
+			continue
+		}
+
+		// only encode records somebody is interested in
+		if encoded == nil {
+			var err error
+
+			encoded, err = encodeJSON(record)
+			if err != nil {
+				return
+			}
+		}
+
+		select {
+		case sub.records <- encoded:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			tailDroppedRecords.Inc()
+		}
+	}
+}
+
+// Close disconnects all subscribers and prevents new subscriptions.
+func (h *tailHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.records)
+		tailSubscribers.Dec()
+	}
+
+	h.closed = true
+}
+
+// Dropped returns the number of records dropped for this subscriber.
+func (s *tailSubscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func makeTailRequestHandler(config *Config, hub *tailHub) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query, err := parseRecordQuery(c.QueryParams())
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if err := authorizeQuery(c, query); err != nil {
+			return c.String(http.StatusForbidden, fmt.Sprintf("Forbidden: %v.", err))
+		}
+
+		if isWebsocketRequest(c.Request()) {
+			return tailWebsocket(c, hub, query, config.TailBuffer)
+		}
+
+		return tailEventStream(c, hub, query, config.TailBuffer)
+	}
+}
+
+// tailEventStream sends records as Server-Sent Events. Whenever records
+// had to be dropped, a "dropped" event with the total count is sent.
+func tailEventStream(c echo.Context, hub *tailHub, query *recordQuery, bufferSize int) error {
+	sub, err := hub.Subscribe(query, bufferSize)
+	if err != nil {
+		return c.String(http.StatusServiceUnavailable, "Server is shutting down.")
+	}
+	defer hub.Unsubscribe(sub)
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	keepalive := time.NewTicker(tailKeepaliveInterval)
+	defer keepalive.Stop()
+
+	reported := uint64(0)
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+
+		case encoded, ok := <-sub.records:
+			if !ok {
+				return nil
+			}
+
+			if dropped := sub.Dropped(); dropped != reported {
+				if _, err := fmt.Fprintf(response, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped); err != nil {
+					return nil
+				}
+
+				reported = dropped
+			}
+
+			if _, err := fmt.Fprintf(response, "data: %s\n\n", encoded); err != nil {
+				return nil
+			}
+
+			response.Flush()
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(response, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+
+			response.Flush()
+		}
+	}
+}
+
+// tailWebsocket sends each record as a text message. Whenever records
+// had to be dropped, a {"dropped": N} message is sent.
+func tailWebsocket(c echo.Context, hub *tailHub, query *recordQuery, bufferSize int) error {
+	sub, err := hub.Subscribe(query, bufferSize)
+	if err != nil {
+		return c.String(http.StatusServiceUnavailable, "Server is shutting down.")
+	}
+	defer hub.Unsubscribe(sub)
+
+	conn, err := upgradeWebsocket(c.Response(), c.Request())
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	defer conn.Close()
+
+	c.Response().Status = http.StatusSwitchingProtocols
+
+	clientGone := make(chan struct{})
+	go func() {
+		conn.ReadLoop()
+		close(clientGone)
+	}()
+
+	reported := uint64(0)
+
+	for {
+		select {
+		case <-clientGone:
+			return nil
+
+		case encoded, ok := <-sub.records:
+			if !ok {
+				return nil
+			}
+
+			if dropped := sub.Dropped(); dropped != reported {
+				if err := conn.WriteText([]byte(fmt.Sprintf(`{"dropped":%d}`, dropped))); err != nil {
+					return nil
+				}
+
+				reported = dropped
+			}
+
+			if err := conn.WriteText(encoded); err != nil {
+				return nil
+			}
+		}
+	}
+}
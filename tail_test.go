@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// waitForTailSubscriber blocks until a client has subscribed, so that
+// records are not published too early.
+func waitForTailSubscriber(hub *tailHub) {
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		hub.lock.RLock()
+		subscribed = len(hub.subscribers) > 0
+		hub.lock.RUnlock()
+	}
+}
+
+func TestTailRequiresReadScope(t *testing.T) {
+	config := testConfig(t)
+	config.InlineAuth = &AuthConfig{
+		Users: []UserConfig{
+			{Username: "writer", Password: "secret"},
+			{Username: "team", Password: "secret", AuthScope: AuthScope{Read: true, Namespaces: []string{"default"}}},
+		},
+	}
+
+	auth, err := NewAuth(config)
+	if err != nil {
+		t.Fatalf("Failed to create auth: %v", err)
+	}
+
+	hub := newTailHub()
+
+	e := echo.New()
+	e.GET("/tail", makeTailRequestHandler(config, hub), auth.Middleware)
+
+	for username, status := range map[string]int{"": http.StatusUnauthorized, "writer": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/tail", nil)
+		if username != "" {
+			req.SetBasicAuth(username, "secret")
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != status {
+			t.Errorf("Expected status %d for %q, got %d.", status, username, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/tail", nil)
+	req.SetBasicAuth("team", "secret")
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		e.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	waitForTailSubscriber(hub)
+
+	hub.Publish(testRecord(t, "kube-system", "secret"))
+	hub.Publish(testRecord(t, "default", "hello"))
+	hub.Close()
+	<-done
+
+	if body := rec.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, "hello") {
+		t.Errorf("Expected only records from the default namespace, got %q.", body)
+	}
+}
+
+func TestTailHubDropsRecords(t *testing.T) {
+	hub := newTailHub()
+
+	sub, err := hub.Subscribe(&recordQuery{}, 2)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	// records that do not match are never dropped
+	other, err := hub.Subscribe(&recordQuery{Namespace: "kube-system"}, 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	before := counterValue(t, tailDroppedRecords)
+
+	for i := 0; i < 5; i++ {
+		hub.Publish(testRecord(t, "default", fmt.Sprintf("record %d", i)))
+	}
+
+	if dropped := sub.Dropped(); dropped != 3 {
+		t.Errorf("Expected 3 dropped records, got %d.", dropped)
+	}
+
+	if dropped := other.Dropped(); dropped != 0 {
+		t.Errorf("Expected no dropped records for the other subscriber, got %d.", dropped)
+	}
+
+	if dropped := counterValue(t, tailDroppedRecords) - before; dropped != 3 {
+		t.Errorf("Expected the metric to count 3 dropped records, got %v.", dropped)
+	}
+
+	hub.Close()
+
+	received := []string{}
+	for encoded := range sub.records {
+		received = append(received, string(encoded))
+	}
+
+	if len(received) != 2 || !strings.Contains(received[0], "record 0") || !strings.Contains(received[1], "record 1") {
+		t.Errorf("Expected the first 2 records to be buffered, got %v.", received)
+	}
+}
+
+// blockingFlushRecorder blocks the first flush, which happens right
+// after subscribing, until it is released.
+type blockingFlushRecorder struct {
+	*httptest.ResponseRecorder
+
+	once    sync.Once
+	release chan struct{}
+}
+
+func (r *blockingFlushRecorder) Flush() {
+	r.once.Do(func() {
+		<-r.release
+	})
+
+	r.ResponseRecorder.Flush()
+}
+
+func TestTailEventStreamReportsDroppedRecords(t *testing.T) {
+	config := testConfig(t, "-tail-buffer", "1")
+	hub := newTailHub()
+
+	rec := &blockingFlushRecorder{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	req := httptest.NewRequest(http.MethodGet, "/tail", nil)
+
+	done := make(chan error)
+	go func() {
+		done <- makeTailRequestHandler(config, hub)(echo.New().NewContext(req, rec))
+	}()
+
+	waitForTailSubscriber(hub)
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(testRecord(t, "default", fmt.Sprintf("record %d", i)))
+	}
+
+	close(rec.release)
+	hub.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Handler failed: %v", err)
+	}
+
+	events := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n\n"), "\n\n")
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %q.", rec.Body.String())
+	}
+
+	if expected := "event: dropped\ndata: {\"dropped\":2}"; events[0] != expected {
+		t.Errorf("Expected %q, got %q.", expected, events[0])
+	}
+
+	if !strings.HasPrefix(events[1], "data: ") || !strings.Contains(events[1], "record 0") {
+		t.Errorf("Expected the first record, got %q.", events[1])
+	}
+}
+
+// hijackRecorder hands one end of a pipe to a handler hijacking the
+// connection.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+
+	conn net.Conn
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(r.conn), bufio.NewWriter(r.conn)), nil
+}
+
+// readWebsocketFrame reads a single unmasked frame sent by the server.
+func readWebsocketFrame(t *testing.T, reader *bufio.Reader) (byte, string) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+
+	length := uint64(header[1] & 0x7F)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(reader, ext); err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+
+	return header[0] & 0x0F, string(payload)
+}
+
+func TestTailWebsocketReportsDroppedRecords(t *testing.T) {
+	config := testConfig(t, "-tail-buffer", "1")
+	hub := newTailHub()
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+	req := httptest.NewRequest(http.MethodGet, "/tail", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-Websocket-Version", "13")
+
+	done := make(chan error)
+	go func() {
+		done <- makeTailRequestHandler(config, hub)(echo.New().NewContext(req, rec))
+	}()
+
+	// the handshake cannot complete before the client reads it, so
+	// no records are consumed yet
+	waitForTailSubscriber(hub)
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(testRecord(t, "default", fmt.Sprintf("record %d", i)))
+	}
+
+	reader := bufio.NewReader(client)
+
+	response, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status %d, got %d.", http.StatusSwitchingProtocols, response.StatusCode)
+	}
+
+	if opcode, message := readWebsocketFrame(t, reader); opcode != websocketOpText || message != `{"dropped":2}` {
+		t.Errorf("Expected dropped message, got opcode %d with %q.", opcode, message)
+	}
+
+	if opcode, message := readWebsocketFrame(t, reader); opcode != websocketOpText || !strings.Contains(message, "record 0") {
+		t.Errorf("Expected the first record, got opcode %d with %q.", opcode, message)
+	}
+
+	hub.Close()
+
+	if opcode, _ := readWebsocketFrame(t, reader); opcode != websocketOpClose {
+		t.Errorf("Expected close frame, got opcode %d.", opcode)
+	}
+
+	client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Handler failed: %v", err)
+	}
+}
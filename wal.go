@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	walPrefix = "wal-"
+	walSuffix = ".log"
+)
+
+// WALOptions control the write-ahead log. An empty directory disables it.
+type WALOptions struct {
+	Directory   string
+	SegmentSize int64
+	Sync        bool
+}
+
+// wal is an append-only log of accepted records. Records are appended
+// before a payload is acknowledged and a log segment is removed once
+// all of its records have been written to their target files.
+type wal struct {
+	options WALOptions
+	logger  logrus.FieldLogger
+	lock    sync.Mutex
+	active  *walSegment
+	file    *os.File
+	nextID  int
+	closed  bool
+}
+
+type walSegment struct {
+	filename    string
+	size        int64
+	outstanding int
+	sealed      bool
+}
+
+type walEntry struct {
+	Tag    string  `json:"tag"`
+	Record *Record `json:"record"`
+}
+
+// walRecord is a record recovered from the log during replay.
+type walRecord struct {
+	tag     string
+	record  *Record
+	segment *walSegment
+}
+
+func NewWAL(options WALOptions, logger logrus.FieldLogger) (*wal, error) {
+	if err := os.MkdirAll(options.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", options.Directory, err)
+	}
+
+	if options.SegmentSize <= 0 {
+		return nil, fmt.Errorf("segment size must be positive")
+	}
+
+	return &wal{
+		options: options,
+		logger:  logger,
+	}, nil
+}
+
+// Recover reads all existing log segments and returns their records,
+// which must be passed to Done() once they have been written. New
+// records are always appended to a new segment.
+func (w *wal) Recover() ([]walRecord, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	filenames, err := w.segmentFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]walRecord, 0)
+
+	walSegments.Set(float64(len(filenames)))
+
+	for _, filename := range filenames {
+		segment := &walSegment{
+			filename: filename,
+			sealed:   true,
+		}
+
+		entries, err := readWALSegment(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+
+		for _, entry := range entries {
+			records = append(records, walRecord{
+				tag:     entry.Tag,
+				record:  entry.Record,
+				segment: segment,
+			})
+		}
+
+		segment.outstanding = len(entries)
+
+		w.logger.Infof("Recovered %d records from %s.", len(entries), filename)
+
+		if segment.outstanding == 0 {
+			w.remove(segment)
+		}
+
+		// continue numbering after the last existing segment
+		if id := walSegmentID(filename); id >= w.nextID {
+			w.nextID = id + 1
+		}
+	}
+
+	return records, nil
+}
+
+func (w *wal) segmentFiles() ([]string, error) {
+	files, err := ioutil.ReadDir(w.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0)
+
+	for _, file := range files {
+		if walSegmentID(file.Name()) >= 0 {
+			filenames = append(filenames, filepath.Join(w.options.Directory, file.Name()))
+		}
+	}
+
+	sort.Slice(filenames, func(i, j int) bool {
+		return walSegmentID(filenames[i]) < walSegmentID(filenames[j])
+	})
+
+	return filenames, nil
+}
+
+// walSegmentID returns the numeric ID of a segment file or -1 if the
+// name is not a segment filename.
+func walSegmentID(filename string) int {
+	name := filepath.Base(filename)
+	if !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walSuffix) {
+		return -1
+	}
+
+	var id int
+	if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walSuffix), "%d", &id); err != nil {
+		return -1
+	}
+
+	return id
+}
+
+func readWALSegment(filename string) ([]walEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]walEntry, 0)
+	reader := bufio.NewReader(f)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// an incomplete last line was never acknowledged
+			return entries, nil
+		}
+
+		entry := walEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Record == nil {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+// Append durably stores the records and returns the segment they
+// were written to. outstanding is the number of writes to wait for
+// before the records are done, as records can be written to several
+// files.
+func (w *wal) Append(tag string, records []*Record, outstanding int) (*walSegment, error) {
+	buf := bytes.Buffer{}
+
+	for _, record := range records {
+		encoded, err := encodeJSON(walEntry{
+			Tag:    tag,
+			Record: record,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode record: %w", err)
+		}
+
+		buf.Write(encoded)
+		buf.WriteByte('\n')
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil, fmt.Errorf("write-ahead log is closed")
+	}
+
+	if w.active == nil || w.active.size >= w.options.SegmentSize {
+		if err := w.roll(); err != nil {
+			return nil, err
+		}
+	}
+
+	offset := w.active.size
+
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		err = fmt.Errorf("failed to write to %s: %w", w.active.filename, err)
+		w.discard(offset)
+
+		return nil, err
+	}
+
+	if w.options.Sync {
+		if err := w.file.Sync(); err != nil {
+			err = fmt.Errorf("failed to sync %s: %w", w.active.filename, err)
+			w.discard(offset)
+
+			return nil, err
+		}
+	}
+
+	w.active.size += int64(buf.Len())
+	w.active.outstanding += outstanding
+
+	return w.active, nil
+}
+
+// discard removes the entries of a failed append from the active
+// segment, as the payload is rejected and a partially written line would
+// otherwise be merged with the next entry. If the segment cannot be
+// truncated, it is sealed and the next append starts a new segment.
+func (w *wal) discard(offset int64) {
+	err := w.file.Truncate(offset)
+	if err == nil {
+		_, err = w.file.Seek(offset, io.SeekStart)
+	}
+
+	if err != nil {
+		w.logger.Errorf("Failed to truncate %s, starting a new segment: %v", w.active.filename, err)
+		w.seal()
+	}
+}
+
+// roll seals the active segment and starts a new one.
+func (w *wal) roll() error {
+	w.seal()
+
+	filename := filepath.Join(w.options.Directory, fmt.Sprintf("%s%010d%s", walPrefix, w.nextID, walSuffix))
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+
+	w.nextID++
+	w.file = f
+	w.active = &walSegment{
+		filename: filename,
+	}
+
+	walSegments.Inc()
+
+	return nil
+}
+
+func (w *wal) seal() {
+	if w.active == nil {
+		return
+	}
+
+	if err := w.file.Close(); err != nil {
+		w.logger.Errorf("Failed to close %s: %v", w.active.filename, err)
+	}
+
+	w.active.sealed = true
+
+	if w.active.outstanding == 0 {
+		w.remove(w.active)
+	}
+
+	w.active = nil
+	w.file = nil
+}
+
+// Expect adds n records to the outstanding records of a segment, used
+// when recovered records are written to several files.
+func (w *wal) Expect(segment *walSegment, n int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	segment.outstanding += n
+}
+
+// Done marks n records of the segment as written.
+func (w *wal) Done(segment *walSegment, n int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	segment.outstanding -= n
+
+	if segment.sealed && segment.outstanding == 0 {
+		w.remove(segment)
+	}
+}
+
+func (w *wal) remove(segment *walSegment) {
+	if err := os.Remove(segment.filename); err != nil {
+		w.logger.Errorf("Failed to remove %s: %v", segment.filename, err)
+		return
+	}
+
+	walSegments.Dec()
+}
+
+// Close seals the active segment, which is removed if all of its
+// records have been written.
+func (w *wal) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.seal()
+	w.closed = true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func testWAL(t *testing.T, dir string) *wal {
+	w, err := NewWAL(WALOptions{Directory: dir, SegmentSize: 1024 * 1024}, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to create write-ahead log: %v", err)
+	}
+
+	return w
+}
+
+func appendWAL(t *testing.T, w *wal, logs ...string) *walSegment {
+	records := make([]*Record, 0, len(logs))
+	for _, log := range logs {
+		records = append(records, testRecord(t, "default", log))
+	}
+
+	segment, err := w.Append("tag", records, len(records))
+	if err != nil {
+		t.Fatalf("Failed to append records: %v", err)
+	}
+
+	return segment
+}
+
+// recoveredLogs replays the write-ahead log in dir and returns the log
+// lines of all recovered records.
+func recoveredLogs(t *testing.T, dir string) []string {
+	records, err := testWAL(t, dir).Recover()
+	if err != nil {
+		t.Fatalf("Failed to recover records: %v", err)
+	}
+
+	logs := make([]string, 0, len(records))
+	for _, r := range records {
+		logs = append(logs, r.record.Log)
+	}
+
+	return logs
+}
+
+func TestWALRecoverTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+
+	w := testWAL(t, dir)
+	appendWAL(t, w, "first", "second")
+	segment := appendWAL(t, w, "third")
+	w.Close()
+
+	info, err := os.Stat(segment.filename)
+	if err != nil {
+		t.Fatalf("Failed to stat segment: %v", err)
+	}
+
+	// a crash in the middle of the last entry
+	if err := os.Truncate(segment.filename, info.Size()-5); err != nil {
+		t.Fatalf("Failed to truncate segment: %v", err)
+	}
+
+	if logs := recoveredLogs(t, dir); !reflect.DeepEqual(logs, []string{"first", "second"}) {
+		t.Fatalf("Expected the complete entries to be recovered, got %v.", logs)
+	}
+}
+
+func TestWALRecoverCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	w := testWAL(t, dir)
+	segment := appendWAL(t, w, "first")
+	w.Close()
+
+	f, err := os.OpenFile(segment.filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+
+	if _, err := f.WriteString("{\"tag\":\"tag\",\"rec\n{\"tag\":\"tag\"}\n"); err != nil {
+		t.Fatalf("Failed to corrupt segment: %v", err)
+	}
+	f.Close()
+
+	if logs := recoveredLogs(t, dir); !reflect.DeepEqual(logs, []string{"first"}) {
+		t.Fatalf("Expected only the valid entry to be recovered, got %v.", logs)
+	}
+}
+
+func TestWALDiscardsFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+
+	w := testWAL(t, dir)
+	appendWAL(t, w, "first")
+
+	// a partially written entry of a rejected payload
+	offset := w.active.size
+	if _, err := w.file.Write([]byte(`{"tag":"tag","record":{"lo`)); err != nil {
+		t.Fatalf("Failed to write partial entry: %v", err)
+	}
+	w.discard(offset)
+
+	appendWAL(t, w, "second")
+	w.Close()
+
+	if logs := recoveredLogs(t, dir); !reflect.DeepEqual(logs, []string{"first", "second"}) {
+		t.Fatalf("Expected both entries to be recovered, got %v.", logs)
+	}
+}
+
+func TestWALStartsNewSegmentAfterFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	w := testWAL(t, dir)
+	first := appendWAL(t, w, "first")
+
+	// writing and truncating the file fails from now on
+	w.file.Close()
+
+	if _, err := w.Append("tag", []*Record{testRecord(t, "default", "lost")}, 1); err == nil {
+		t.Fatal("Expected appending to a closed file to fail.")
+	}
+
+	second := appendWAL(t, w, "second")
+	w.Close()
+
+	if first == second {
+		t.Fatal("Expected a new segment after the failed write.")
+	}
+
+	if logs := recoveredLogs(t, dir); !reflect.DeepEqual(logs, []string{"first", "second"}) {
+		t.Fatalf("Expected both entries to be recovered, got %v.", logs)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a minimal server-side WebSocket (RFC 6455) implementation,
+// sufficient to push text messages to clients.
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	websocketOpText  = 0x1
+	websocketOpClose = 0x8
+	websocketOpPing  = 0x9
+	websocketOpPong  = 0xA
+
+	websocketWriteTimeout = 10 * time.Second
+)
+
+var errWebsocketClosed = errors.New("websocket closed by peer")
+
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+func isWebsocketRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgradeWebsocket performs the opening handshake and takes over
+// the underlying connection.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, errors.New("invalid websocket handshake")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{
+		conn:   conn,
+		reader: rw.Reader,
+	}, nil
+}
+
+// WriteText sends a single text message.
+func (c *websocketConn) WriteText(data []byte) error {
+	return c.writeFrame(websocketOpText, data)
+}
+
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+
+	_, err := c.conn.Write(payload)
+
+	return err
+}
+
+// ReadLoop consumes incoming frames, answers pings and returns once
+// the client closes the connection or an error occurs. Messages sent
+// by the client are ignored.
+func (c *websocketConn) ReadLoop() error {
+	header := make([]byte, 2)
+
+	for {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+
+		if !masked {
+			return errors.New("received unmasked frame from client")
+		}
+
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return err
+		}
+
+		// control frames carry small payloads, everything else is discarded
+		if opcode < websocketOpClose {
+			if _, err := io.CopyN(ioutil.Discard, c.reader, int64(length)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if length > 125 {
+			return fmt.Errorf("control frame too large (%d bytes)", length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case websocketOpClose:
+			c.writeFrame(websocketOpClose, payload)
+			return errWebsocketClosed
+
+		case websocketOpPing:
+			if err := c.writeFrame(websocketOpPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close sends a close frame and closes the connection.
+func (c *websocketConn) Close() error {
+	c.writeFrame(websocketOpClose, nil)
+	return c.conn.Close()
+}
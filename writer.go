@@ -1,65 +1,676 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	writerTTL = 1 * time.Minute
-)
+const segmentTTL = 1 * time.Hour
+
+// errWriterClosed is returned when writing to a writer that has been
+// closed, e.g. because it was evicted by another worker.
+var errWriterClosed = errors.New("writer has been closed")
+
+// processStarted is used to tell files left behind by a previous run,
+// which might have been interrupted, from those written since.
+var processStarted = time.Now()
+
+// encodeError is returned for records that cannot be encoded, as
+// opposed to failures of the file itself.
+type encodeError struct {
+	err error
+}
+
+func (e *encodeError) Error() string {
+	return fmt.Sprintf("failed to encode record: %v", e.err)
+}
+
+func (e *encodeError) Unwrap() error {
+	return e.err
+}
+
+func isEncodeError(err error) bool {
+	var e *encodeError
+	return errors.As(err, &e)
+}
+
+// WriterOptions control how records are written to files.
+type WriterOptions struct {
+	Format          string
+	Columns         []string
+	Rotation        RotationPolicy
+	Compression     string
+	CompressionMode string
+	Flush           FlushPolicy
+}
 
+// StreamCompression returns the compression applied while writing.
+func (o WriterOptions) StreamCompression() string {
+	if o.CompressionMode == compressionModeStream {
+		return o.Compression
+	}
+
+	return compressionNone
+}
+
+// RotationPolicy decides when a writer rolls over to a new file.
+// Zero values disable the respective limit.
+type RotationPolicy struct {
+	MaxBytes   int64
+	MaxRecords int
+	MaxAge     time.Duration
+}
+
+func (p RotationPolicy) Enabled() bool {
+	return p.MaxBytes > 0 || p.MaxRecords > 0 || p.MaxAge > 0
+}
+
+func (p RotationPolicy) Exceeded(s *segment, now time.Time) bool {
+	// never rotate empty files
+	if s.bytes == 0 {
+		return false
+	}
+
+	return (p.MaxBytes > 0 && s.bytes >= p.MaxBytes) ||
+		(p.MaxRecords > 0 && s.records >= p.MaxRecords) ||
+		(p.MaxAge > 0 && now.Sub(s.started) >= p.MaxAge)
+}
+
+// segment is the rotation state of one output file. It outlives
+// the writer, so that closing and reopening a writer does not reset
+// the age of the current file.
+type segment struct {
+	index   int
+	bytes   int64
+	records int
+	started time.Time
+	updated time.Time
+}
+
+// writer writes records to a file. It is only ever written to by
+// a single worker, the lock protects against concurrent reads of its
+// state by the garbage collection.
 type writer struct {
-	file    *os.File
-	expires time.Time
+	lock       sync.Mutex
+	path       string
+	options    WriterOptions
+	encoder    recordEncoder
+	file       *os.File
+	buffer     *fileBuffer
+	compressor io.WriteCloser
+	parquet    *parquetWriter
+	used       time.Time
+	stopped    bool
+	segment    *segment
+
+	// closed is called with the filename after a file has been
+	// closed, either because the writer was closed or rotated.
+	closed func(filename string)
+
+	// unflushed are the callbacks for records that are still
+	// buffered by the file buffer, compressor or Parquet writer.
+	unflushed []func()
 }
 
-func NewWriter(path string) (*writer, error) {
+// NewWriter opens the current segment for the given path. If seg is
+// nil, the segment state is recovered from the files on disk.
+func NewWriter(path string, options WriterOptions, seg *segment, closed func(string)) (*writer, error) {
+	var (
+		encoder recordEncoder
+		err     error
+	)
+
+	if options.Format != formatParquet {
+		encoder, err = newRecordEncoder(options.Format, options.Columns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	directory := filepath.Dir(path)
 	if err := os.MkdirAll(directory, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory %s: %v", directory, err)
+		return nil, fmt.Errorf("failed to create directory %s: %w", directory, err)
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if seg == nil {
+		seg, err = recoverSegment(path, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine current segment of %s: %w", path, err)
+		}
+	}
+
+	w := &writer{
+		path:    path,
+		options: options,
+		encoder: encoder,
+		segment: seg,
+		closed:  closed,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	w.touch()
+
+	return w, nil
+}
+
+func (w *writer) open() error {
+	// Parquet files cannot be appended to, so existing files are
+	// continued in a new segment.
+	if w.options.Format == formatParquet {
+		if err := w.skipExistingSegments(); err != nil {
+			return err
+		}
+	}
+
+	filename := w.filename()
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %s for appending: %v", path, err)
+		return fmt.Errorf("failed to open %s for appending: %w", filename, err)
+	}
+
+	w.file = f
+	w.buffer = newFileBuffer(f, w.options.Flush)
+
+	if compression := w.options.StreamCompression(); compression != compressionNone {
+		w.compressor, err = newCompressor(w.buffer, compression)
+		if err != nil {
+			f.Close()
+			w.file = nil
+			w.buffer = nil
+
+			return fmt.Errorf("failed to set up compression: %w", err)
+		}
+	}
+
+	if w.options.Format == formatParquet {
+		w.parquet, err = newParquetWriter(w.buffer)
+		if err != nil {
+			f.Close()
+			w.file = nil
+			w.buffer = nil
+
+			return fmt.Errorf("failed to write Parquet header: %w", err)
+		}
 	}
 
-	return &writer{
-		file:    f,
-		expires: time.Now().Add(writerTTL),
-	}, nil
+	return nil
+}
+
+func (w *writer) skipExistingSegments() error {
+	for {
+		info, err := os.Stat(w.filename())
+		if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		*w.segment = segment{
+			index:   w.segment.index + 1,
+			started: now,
+			updated: now,
+		}
+	}
+}
+
+// Filename returns the path of the file currently being written to.
+func (w *writer) Filename() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.filename()
+}
+
+func (w *writer) filename() string {
+	return segmentFilename(w.path, w.segment.index) + compressionExtension(w.options.StreamCompression())
+}
+
+// Segment returns the rotation state of this writer.
+func (w *writer) Segment() *segment {
+	return w.segment
 }
 
+// Close closes the file. Writing afterwards fails with
+// errWriterClosed.
 func (w *writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.stopped = true
+
+	return w.close()
+}
+
+func (w *writer) close() error {
 	var err error
 
+	if w.parquet != nil {
+		err = w.parquet.Close()
+		w.parquet = nil
+	}
+
+	if w.compressor != nil {
+		if closeErr := w.compressor.Close(); err == nil {
+			err = closeErr
+		}
+
+		w.compressor = nil
+	}
+
+	if w.buffer != nil {
+		if closeErr := w.buffer.Close(); err == nil {
+			err = closeErr
+		}
+
+		w.buffer = nil
+	}
+
 	if w.file != nil {
-		err = w.file.Close()
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+
 		w.file = nil
+
+		if w.closed != nil {
+			w.closed(w.filename())
+		}
+	}
+
+	if err != nil {
+		w.forgetUnflushed()
+	} else {
+		w.releaseUnflushed()
 	}
 
 	return err
 }
 
-func (w *writer) Write(record *Record) error {
-	w.Touch()
+func (w *writer) releaseUnflushed() {
+	for _, done := range w.unflushed {
+		done()
+	}
+	w.unflushed = nil
+}
+
+// forgetUnflushed drops the callbacks of buffered records after the
+// file failed, as these records might have been lost. They stay
+// outstanding in the write-ahead log and are written again after a
+// restart.
+func (w *writer) forgetUnflushed() {
+	w.unflushed = nil
+}
+
+// Write writes the record. The done callback (if given) is called
+// once the record has been handed to the operating system or if it
+// cannot be encoded. If writing to the file fails, it is not called
+// for this or any buffered record.
+func (w *writer) Write(record *Record, done func()) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// the caller is expected to retry with a new writer
+	if w.stopped {
+		return errWriterClosed
+	}
+
+	err := w.write(record)
+
+	if err != nil && !isEncodeError(err) {
+		w.forgetUnflushed()
+		return err
+	}
+
+	if done != nil {
+		if err == nil && w.buffered() {
+			w.unflushed = append(w.unflushed, done)
+		} else {
+			done()
+		}
+	}
+
+	// the buffer might have been flushed because it was full
+	if !w.buffered() {
+		w.releaseUnflushed()
+	}
+
+	return err
+}
+
+// buffered returns true if records might not have been handed to the
+// operating system yet.
+func (w *writer) buffered() bool {
+	return w.compressor != nil || w.parquet != nil || (w.buffer != nil && w.buffer.Buffered() > 0)
+}
+
+// Flush is called once per flush interval and writes buffered records
+// to the file, which is synced according to the fsync policy. Records
+// buffered by a compressor or Parquet writer are only written once the
+// file is closed.
+func (w *writer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	encoder := json.NewEncoder(w.file)
-	if err := encoder.Encode(record); err != nil {
-		return fmt.Errorf("failed to write record: %v", err)
+	if w.buffer == nil {
+		return nil
+	}
+
+	err := w.buffer.FlushInterval()
+
+	if err != nil {
+		w.forgetUnflushed()
+		return fmt.Errorf("failed to flush %s: %w", w.filename(), err)
+	}
+
+	if !w.buffered() {
+		w.releaseUnflushed()
 	}
 
 	return nil
 }
 
-func (w *writer) Expired(now time.Time) bool {
-	return now.IsZero() || now.After(w.expires)
+// FlushAll writes all records to the file, including those buffered
+// by a compressor or Parquet writer. Compressed streams stay valid and
+// Parquet files get a new row group, so this is only meant for
+// synchronous writes.
+func (w *writer) FlushAll() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.buffer == nil {
+		return nil
+	}
+
+	var err error
+
+	if w.parquet != nil {
+		err = w.parquet.flush()
+	}
+
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok && err == nil {
+		err = flusher.Flush()
+	}
+
+	if err == nil {
+		err = w.buffer.Flush()
+	}
+
+	if err != nil {
+		w.forgetUnflushed()
+		return fmt.Errorf("failed to flush %s: %w", w.filename(), err)
+	}
+
+	w.releaseUnflushed()
+
+	return nil
 }
 
-func (w *writer) Touch() {
-	w.expires = time.Now().Add(writerTTL)
+func (w *writer) write(record *Record) error {
+	w.touch()
+
+	// opening the next file failed during a previous rotation
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	if w.options.Rotation.Exceeded(w.segment, now) {
+		if err := w.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	if w.parquet != nil {
+		err := w.parquet.Write(record)
+
+		// buffered records count towards the size, so that rotation
+		// does not have to wait for the next row group
+		w.segment.bytes = w.parquet.Size()
+		w.segment.updated = now
+
+		if isEncodeError(err) {
+			return err
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write record: %w", err)
+		}
+
+		w.segment.records++
+
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+
+	// new files start with the header, if the format has one
+	if w.segment.bytes == 0 {
+		buf.Write(w.encoder.Header())
+	}
+
+	if err := w.encoder.Encode(&buf, record); err != nil {
+		return &encodeError{err}
+	}
+
+	var out io.Writer = w.buffer
+	if w.compressor != nil {
+		out = w.compressor
+	}
+
+	n, err := out.Write(buf.Bytes())
+	w.segment.bytes += int64(n)
+	w.segment.updated = now
+
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	w.segment.records++
+
+	return nil
+}
+
+func (w *writer) rotate(now time.Time) error {
+	if err := w.close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", w.filename(), err)
+	}
+
+	*w.segment = segment{
+		index:   w.segment.index + 1,
+		started: now,
+		updated: now,
+	}
+
+	rotations.Inc()
+
+	return w.open()
+}
+
+// Expired returns true if the writer has not been used for the given
+// duration. All writers are expired at the zero time.
+func (w *writer) Expired(now time.Time, ttl time.Duration) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return now.IsZero() || now.Sub(w.used) >= ttl
+}
+
+// LastUsed returns when the writer was last written to.
+func (w *writer) LastUsed() time.Time {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.used
+}
+
+func (w *writer) touch() {
+	w.used = time.Now()
+}
+
+// segmentFilename returns the filename for the n-th segment of the
+// given path, i.e. "foo.json", "foo.1.json", "foo.2.json", ...
+func segmentFilename(path string, index int) string {
+	if index == 0 {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
+// recoverSegment finds the latest existing segment for the given path.
+// Segments can consist of a plain and a compressed file, the size of
+// a segment is always the uncompressed size.
+func recoverSegment(path string, options WriterOptions) (*segment, error) {
+	rotation := options.Rotation
+	now := time.Now()
+	seg := &segment{
+		started: now,
+		updated: now,
+	}
+
+	if rotation.Enabled() {
+		ext := filepath.Ext(path)
+		prefix := strings.TrimSuffix(filepath.Base(path), ext) + "."
+
+		files, err := ioutil.ReadDir(filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			_, name := compressionByFilename(file.Name())
+			if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+				continue
+			}
+
+			index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+			if err == nil && index > seg.index {
+				seg.index = index
+			}
+		}
+	}
+
+	plain := segmentFilename(path, seg.index)
+	found := false
+
+	for _, compression := range []string{compressionNone, compressionGzip, compressionZstd} {
+		filename := plain + compressionExtension(compression)
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		// New records must not be appended to an incomplete stream. Only
+		// files written by a previous run can be incomplete, files of
+		// deferred compression are repaired by the archiver.
+		if compression != compressionNone && compression == options.StreamCompression() && info.ModTime().Before(processStarted) {
+			if err := repairStream(filename, compression); err != nil {
+				return nil, fmt.Errorf("failed to repair %s: %w", filename, err)
+			}
+
+			if info, err = os.Stat(filename); err != nil {
+				return nil, err
+			}
+		}
+
+		// The creation time is not portably available; the last modification
+		// is a good enough approximation, as the sink keeps the segment
+		// state around until the file is older than the maximum age.
+		if !found || info.ModTime().Before(seg.started) {
+			seg.started = info.ModTime()
+			seg.updated = info.ModTime()
+		}
+
+		found = true
+
+		if compression == compressionNone {
+			seg.bytes += info.Size()
+
+			if rotation.MaxRecords > 0 {
+				_, records, err := scanRecords(filename)
+				if err != nil {
+					return nil, err
+				}
+
+				seg.records += records
+			}
+		} else if rotation.MaxBytes > 0 || rotation.MaxRecords > 0 {
+			bytes, records, err := scanRecords(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			seg.bytes += bytes
+			seg.records += records
+		} else {
+			// only used to prevent rotating empty segments
+			seg.bytes += info.Size()
+		}
+	}
+
+	return seg, nil
+}
+
+// scanRecords returns the uncompressed size and number of records
+// of the given file.
+func scanRecords(filename string) (int64, int, error) {
+	f, err := openFile(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	size := int64(0)
+	count := 0
+	reader := bufio.NewReader(f)
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		size += int64(len(line))
+
+		if err == nil {
+			count++
+			continue
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a truncated compressed stream, usually caused by a crash,
+			// should not prevent writing new records
+			return size, count, nil
+		}
+
+		return size, count, err
+	}
 }
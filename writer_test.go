@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRecoverSegmentRepairsOnlyPreviousFiles(t *testing.T) {
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("{\"log\":\"hello\"}\n"))
+	gz.Close()
+
+	// a complete member followed by an incomplete one
+	data := append(compressed.Bytes(), compressed.Bytes()[:10]...)
+
+	options := WriterOptions{
+		Format:          formatJSON,
+		Compression:     compressionGzip,
+		CompressionMode: compressionModeStream,
+	}
+
+	testcases := []struct {
+		name     string
+		modTime  time.Time
+		expected int
+	}{
+		{name: "left behind by a crash", modTime: processStarted.Add(-time.Hour), expected: compressed.Len()},
+		{name: "written by this process", modTime: time.Now(), expected: len(data)},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.json")
+			filename := path + ".gz"
+
+			if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			if err := os.Chtimes(filename, testcase.modTime, testcase.modTime); err != nil {
+				t.Fatalf("Failed to set modification time: %v", err)
+			}
+
+			if _, err := recoverSegment(path, options); err != nil {
+				t.Fatalf("Failed to recover segment: %v", err)
+			}
+
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatalf("Failed to stat file: %v", err)
+			}
+
+			if info.Size() != int64(testcase.expected) {
+				t.Fatalf("Expected file size %d, got %d.", testcase.expected, info.Size())
+			}
+		})
+	}
+}
+
+func TestWriterKeepsFailedRecordsOutstanding(t *testing.T) {
+	options := WriterOptions{
+		Format:          formatJSON,
+		Compression:     compressionNone,
+		CompressionMode: compressionModeStream,
+		Flush:           FlushPolicy{Size: 1024, Fsync: fsyncNever},
+	}
+
+	w, err := NewWriter(filepath.Join(t.TempDir(), "records.json"), options, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	done := 0
+	callback := func() { done++ }
+
+	if err := w.Write(testRecord(t, "default", "hello"), callback); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+
+	// make flushing the buffer fail
+	w.file.Close()
+
+	if err := w.Flush(); err == nil {
+		t.Fatal("Expected flushing to fail.")
+	}
+
+	w.Close()
+
+	if done != 0 {
+		t.Fatalf("Expected the record to stay outstanding, but it was marked as written.")
+	}
+}
+
+func TestWriterRecoversFromFailedRotation(t *testing.T) {
+	directory := t.TempDir()
+
+	options := WriterOptions{
+		Format:          formatJSON,
+		Compression:     compressionNone,
+		CompressionMode: compressionModeStream,
+		Rotation:        RotationPolicy{MaxRecords: 1},
+	}
+
+	w, err := NewWriter(filepath.Join(directory, "records.json"), options, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Write(testRecord(t, "default", "first"), nil); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+
+	// the next segment cannot be created
+	blocker := filepath.Join(directory, "records.1.json")
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	if err := w.Write(testRecord(t, "default", "second"), nil); err == nil {
+		t.Fatal("Expected rotation to fail.")
+	}
+
+	// writing again must not panic, but retry opening the file
+	if err := w.Write(testRecord(t, "default", "third"), nil); err == nil {
+		t.Fatal("Expected opening the file to fail again.")
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+
+	if err := w.Write(testRecord(t, "default", "fourth"), nil); err != nil {
+		t.Fatalf("Failed to write record after the file could be opened again: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(blocker)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	if !bytes.Contains(content, []byte(`"fourth"`)) {
+		t.Fatalf("Expected the record to be written to the next segment, got %q.", string(content))
+	}
+}
+
+func TestWriterFlushAll(t *testing.T) {
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			options := WriterOptions{
+				Format:          formatJSON,
+				Compression:     compression,
+				CompressionMode: compressionModeStream,
+				Flush:           FlushPolicy{Size: 65536, Fsync: fsyncNever},
+			}
+
+			w, err := NewWriter(filepath.Join(t.TempDir(), "records.json"), options, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			defer w.Close()
+
+			done := false
+			if err := w.Write(testRecord(t, "default", "hello"), func() { done = true }); err != nil {
+				t.Fatalf("Failed to write record: %v", err)
+			}
+
+			if done {
+				t.Fatal("Expected the record to be buffered.")
+			}
+
+			if err := w.FlushAll(); err != nil {
+				t.Fatalf("Failed to flush: %v", err)
+			}
+
+			if !done {
+				t.Fatal("Expected the record to be marked as written.")
+			}
+
+			// the record can be read while the file is still open
+			f, err := openFile(w.Filename())
+			if err != nil {
+				t.Fatalf("Failed to open file: %v", err)
+			}
+			defer f.Close()
+
+			content := make([]byte, 1024)
+			n, _ := f.Read(content)
+
+			if !bytes.Contains(content[:n], []byte(`"hello"`)) {
+				t.Fatalf("Expected the record to be readable, got %q.", string(content[:n]))
+			}
+		})
+	}
+}
+
+func TestWriteFailureReason(t *testing.T) {
+	err := fmt.Errorf("failed to write record: %w", &os.PathError{Op: "write", Path: "records.json", Err: syscall.ENOSPC})
+
+	if reason := writeFailureReason(err); reason != "no_space" {
+		t.Fatalf("Expected reason no_space, got %q.", reason)
+	}
+
+	if reason := writeFailureReason(errors.New("no space left on device")); reason != "other" {
+		t.Fatalf("Expected reason other, got %q.", reason)
+	}
+}